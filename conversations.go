@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// CloseReason tells how a conversation ended.
+type CloseReason uint8
+
+const (
+	CLOSE_REASON_NONE CloseReason = iota
+	CLOSE_REASON_OPEN
+	CLOSE_REASON_FIN
+	CLOSE_REASON_RST
+	CLOSE_REASON_TIMEOUT
+	// dropped because of buffer limits
+	CLOSE_REASON_EVICTED
+	// ports were reused by a new connection
+	CLOSE_REASON_REUSED
+)
+
+type ConversationOrder uint8
+
+const (
+	CONVERSATION_ORDER_START ConversationOrder = iota
+	CONVERSATION_ORDER_BYTES
+	CONVERSATION_ORDER_PACKETS
+	CONVERSATION_ORDER_DURATION
+)
+
+const (
+	CONVERSATION_TIME_FORMAT = "2006-01-02 15:04:05.000"
+)
+
+func ParseConversationOrder(s string) (ConversationOrder, error) {
+	switch s {
+	case "start":
+		return CONVERSATION_ORDER_START, nil
+	case "bytes":
+		return CONVERSATION_ORDER_BYTES, nil
+	case "packets":
+		return CONVERSATION_ORDER_PACKETS, nil
+	case "duration":
+		return CONVERSATION_ORDER_DURATION, nil
+	default:
+		return CONVERSATION_ORDER_START, errors.New("order must be 'start', 'bytes', 'packets' or 'duration'.")
+	}
+}
+
+// Conversation is the traffic between two endpoints, client being the side
+// which opened the connection or sent the first datagram.
+type Conversation struct {
+	Transport TransportType
+	Client    netip.AddrPort
+	Server    netip.AddrPort
+
+	Start time.Time
+	End   time.Time
+
+	ClientPackets uint64
+	ClientBytes   uint64
+	ServerPackets uint64
+	ServerBytes   uint64
+
+	Close CloseReason
+	// application protocol detected from the first payload, empty when unknown
+	Protocol string
+}
+
+func (c *Conversation) Duration() time.Duration {
+	return c.End.Sub(c.Start)
+}
+
+func (c *Conversation) Packets() uint64 {
+	return c.ClientPackets + c.ServerPackets
+}
+
+func (c *Conversation) Bytes() uint64 {
+	return c.ClientBytes + c.ServerBytes
+}
+
+// ConversationTable collects the conversations of a capture, added by the
+// TCP and UDP stacks when connections and flows close. Safe for concurrent
+// use.
+type ConversationTable struct {
+	mu sync.Mutex
+
+	conversations []*Conversation
+}
+
+func NewConversationTable() *ConversationTable {
+	return &ConversationTable{}
+}
+
+func (t *ConversationTable) Add(c *Conversation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conversations = append(t.conversations, c)
+}
+
+// Sorted returns the conversations in the given order, largest first when
+// ordered by size or duration.
+func (t *ConversationTable) Sorted(order ConversationOrder) []*Conversation {
+	t.mu.Lock()
+	conversations := append([]*Conversation(nil), t.conversations...)
+	t.mu.Unlock()
+
+	sort.SliceStable(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+
+		switch order {
+		case CONVERSATION_ORDER_BYTES:
+			return a.Bytes() > b.Bytes()
+		case CONVERSATION_ORDER_PACKETS:
+			return a.Packets() > b.Packets()
+		case CONVERSATION_ORDER_DURATION:
+			return a.Duration() > b.Duration()
+		default:
+			return a.Start.Before(b.Start)
+		}
+	})
+
+	return conversations
+}
+
+func (t *ConversationTable) WriteTable(w io.Writer, order ConversationOrder) {
+	conversations := t.Sorted(order)
+	if len(conversations) == 0 {
+		return
+	}
+
+	var out bytes.Buffer
+	out.WriteString("\nConversations:\n")
+
+	tw := tabwriter.NewWriter(&out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	tw.Write([]byte("start\tduration\tproto\tclient\tserver\tpackets >\tbytes >\tpackets <\tbytes <\tclose\tapp\t\n"))
+
+	for _, c := range conversations {
+		tw.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t\n",
+			c.Start.Format(CONVERSATION_TIME_FORMAT), c.Duration(), c.Transport,
+			c.Client, c.Server,
+			c.ClientPackets, c.ClientBytes, c.ServerPackets, c.ServerBytes,
+			c.Close, conversationProtocolString(c.Protocol))))
+	}
+	tw.Flush()
+
+	w.Write(out.Bytes())
+}
+
+func (t *ConversationTable) WriteCSV(w io.Writer, order ConversationOrder) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"start", "duration", "proto", "client", "server",
+		"client_packets", "client_bytes", "server_packets", "server_bytes", "close", "app"})
+
+	for _, c := range t.Sorted(order) {
+		cw.Write([]string{
+			c.Start.UTC().Format(time.RFC3339Nano),
+			strconv.FormatFloat(c.Duration().Seconds(), 'f', 6, 64),
+			c.Transport.String(),
+			c.Client.String(),
+			c.Server.String(),
+			strconv.FormatUint(c.ClientPackets, 10),
+			strconv.FormatUint(c.ClientBytes, 10),
+			strconv.FormatUint(c.ServerPackets, 10),
+			strconv.FormatUint(c.ServerBytes, 10),
+			c.Close.String(),
+			c.Protocol,
+		})
+	}
+
+	cw.Flush()
+}
+
+func conversationProtocolString(protocol string) string {
+	if protocol == "" {
+		return "-"
+	}
+
+	return protocol
+}
+
+// tcpConversation builds the conversation of a TCP connection from its
+// metrics.
+func tcpConversation(conn *TCPConnection, reason CloseReason) *Conversation {
+	a := conn.ClientFlow.Address
+	m := &conn.Metrics
+
+	return &Conversation{
+		Transport:     TRANSPORT_TYPE_TCP,
+		Client:        netip.AddrPortFrom(a.SourceAddress, a.SourcePort),
+		Server:        netip.AddrPortFrom(a.DestinationAddress, a.DestinationPort),
+		Start:         m.Start,
+		End:           m.End,
+		ClientPackets: m.Client.Packets,
+		ClientBytes:   m.Client.Bytes,
+		ServerPackets: m.Server.Packets,
+		ServerBytes:   m.Server.Bytes,
+		Close:         reason,
+		Protocol:      conn.Protocol,
+	}
+}
+
+func udpConversation(flow *UDPFlow, reason CloseReason) *Conversation {
+	a := flow.Address
+
+	return &Conversation{
+		Transport:     TRANSPORT_TYPE_UDP,
+		Client:        netip.AddrPortFrom(a.SourceAddress, a.SourcePort),
+		Server:        netip.AddrPortFrom(a.DestinationAddress, a.DestinationPort),
+		Start:         flow.Start,
+		End:           flow.lastSeen,
+		ClientPackets: flow.Client.Datagrams,
+		ClientBytes:   flow.Client.Bytes,
+		ServerPackets: flow.Server.Datagrams,
+		ServerBytes:   flow.Server.Bytes,
+		Close:         reason,
+		Protocol:      flow.Protocol,
+	}
+}
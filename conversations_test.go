@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testUDPPacket(timestamp time.Time, from, to testTCPEndpoint, payload []byte) *Packet {
+	data := make([]byte, UDP_FRAME_HEADER_LENGTH, UDP_FRAME_HEADER_LENGTH+len(payload))
+	binary.BigEndian.PutUint16(data[0:2], from.Port)
+	binary.BigEndian.PutUint16(data[2:4], to.Port)
+	binary.BigEndian.PutUint16(data[4:6], uint16(UDP_FRAME_HEADER_LENGTH+len(payload)))
+	data = append(data, payload...)
+
+	udpFrame, err := NewUDPFrame(data)
+	if err != nil {
+		panic(err)
+	}
+
+	packet := testIPPacket(timestamp, from.Address, to.Address)
+	packet.Protocol = PROTOCOL_UDP
+	packet.TransportType = TRANSPORT_TYPE_UDP
+	packet.UDP = udpFrame
+
+	return packet
+}
+
+func TestConversationTable(t *testing.T) {
+	table := NewConversationTable()
+	ts := time.Unix(1440000000, 0)
+
+	//
+	// closed, reset and open TCP connections
+	//
+	tcpStack := NewTCPStack(&testTCPListener{})
+	tcpStack.Conversations = table
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+		{false, 0, 0, "HTTP/1.1 204 No Content\r\n\r\n"},
+		{true, 18, testFIN, ""},
+		{false, 27, testFIN, ""},
+	})
+
+	other := testTCPEndpoint{"10.0.0.3", 40001}
+	tcpStack.NewPacket(testTCPPacket(ts.Add(time.Second), other, testServer, 2000, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(ts.Add(2*time.Second), testServer, other, 0, 2001, testRST|testACK, nil))
+
+	tcpStack.NewPacket(testTCPPacket(ts.Add(3*time.Second), testClient, testServer, 3000, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(ts.Add(3*time.Second), testServer, testClient, 7000, 3001, testSYN|testACK, nil))
+	tcpStack.NewPacket(testTCPPacket(ts.Add(3*time.Second), testClient, testServer, 3001, 7001, testACK, []byte("SSH-2.0-test\r\n")))
+	tcpStack.Close()
+
+	//
+	// UDP
+	//
+	dnsClient := testTCPEndpoint{"10.0.0.1", 50000}
+	dnsServer := testTCPEndpoint{"10.0.0.53", 53}
+	udpStack := NewUDPStack(NewUDPDispatcher())
+	udpStack.Conversations = table
+	udpStack.NewPacket(testUDPPacket(ts.Add(4*time.Second), dnsClient, dnsServer, make([]byte, 30)))
+	udpStack.NewPacket(testUDPPacket(ts.Add(5*time.Second), dnsServer, dnsClient, make([]byte, 100)))
+	udpStack.Close()
+
+	type result struct {
+		client, server string
+		clientPackets  uint64
+		clientBytes    uint64
+		serverPackets  uint64
+		serverBytes    uint64
+		close          CloseReason
+		protocol       string
+		duration       time.Duration
+	}
+
+	want := []result{
+		{"10.0.0.1:40000", "10.0.0.2:80", 4, 18, 3, 27, CLOSE_REASON_FIN, "http", 0},
+		{"10.0.0.3:40001", "10.0.0.2:80", 1, 0, 1, 0, CLOSE_REASON_RST, "", time.Second},
+		{"10.0.0.1:40000", "10.0.0.2:80", 2, 14, 1, 0, CLOSE_REASON_OPEN, "ssh", 0},
+		{"10.0.0.1:50000", "10.0.0.53:53", 1, 30, 1, 100, CLOSE_REASON_OPEN, "dns", time.Second},
+	}
+
+	got := table.Sorted(CONVERSATION_ORDER_START)
+	if len(got) != len(want) {
+		t.Fatalf("TestConversationTable mismatch, got: %d conversations, want %d", len(got), len(want))
+	}
+
+	for i, w := range want {
+		c := got[i]
+		r := result{c.Client.String(), c.Server.String(), c.ClientPackets, c.ClientBytes,
+			c.ServerPackets, c.ServerBytes, c.Close, c.Protocol, c.Duration()}
+
+		if r != w {
+			t.Errorf("TestConversationTable[%d] mismatch, got: %+v, want %+v", i, r, w)
+		}
+	}
+
+	//
+	// ordering
+	//
+	if got := table.Sorted(CONVERSATION_ORDER_BYTES); got[0].Server.Port() != 53 {
+		t.Errorf("TestConversationTable bytes order mismatch, got: %s first", got[0].Server)
+	}
+	if got := table.Sorted(CONVERSATION_ORDER_PACKETS); got[0].Close != CLOSE_REASON_FIN {
+		t.Errorf("TestConversationTable packets order mismatch, got: %s first", got[0].Close)
+	}
+
+	var out bytes.Buffer
+	table.WriteCSV(&out, CONVERSATION_ORDER_START)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	wantLine := "2015-08-19T16:00:04Z,1.000000,UDP,10.0.0.1:50000,10.0.0.53:53,1,30,1,100,open,dns"
+	if len(lines) != 5 || lines[4] != wantLine {
+		t.Errorf("TestConversationTable CSV mismatch, got: %q, want last line %q", lines, wantLine)
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	tcpCases := []struct {
+		in   string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\n", "http"},
+		{"HTTP/1.1 200 OK\r\n", "http"},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", "http2"},
+		{"\x16\x03\x01\x02\x00\x01", "tls"},
+		{"SSH-2.0-OpenSSH_9.0\r\n", "ssh"},
+		{"+OK ready\r\n", ""},
+	}
+
+	for i, c := range tcpCases {
+		if got := DetectTCPProtocol([]byte(c.in)); got != c.want {
+			t.Errorf("DetectTCPProtocol[%d] mismatch, got: %q, want %q", i, got, c.want)
+		}
+	}
+
+	udpCases := []struct {
+		port uint16
+		in   []byte
+		want string
+	}{
+		{53, make([]byte, 12), "dns"},
+		{53, make([]byte, 4), ""},
+		{5353, make([]byte, 12), "mdns"},
+		{123, make([]byte, 48), "ntp"},
+		{443, []byte{0xc3, 0, 0, 0, 1}, "quic"},
+		{443, []byte{0x43, 0, 0, 0, 1}, ""},
+		{4433, append([]byte{0x16, 0xfe, 0xfd}, make([]byte, 10)...), "dtls"},
+	}
+
+	for i, c := range udpCases {
+		if got := DetectUDPProtocol(c.port, c.in); got != c.want {
+			t.Errorf("DetectUDPProtocol[%d] mismatch, got: %q, want %q", i, got, c.want)
+		}
+	}
+}
@@ -4,29 +4,69 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	HTTP_HEADER_TIME_FORMAT = "02.01.2006 15:04:05.000"
+
+	DEFAULT_HTTP_RESYNC_LIMIT = 64 * 1024
 )
 
 type HttpData struct {
 	conn         TCPListenerConnection
 	dataReceived bool
 
+	// streams are aligned to a message boundary, only relevant for
+	// connections picked up mid-stream and directions with lost data
+	reqSynced  bool
+	respSynced bool
+
+	// data was lost before the first request, wait for the next request
+	// like on connections picked up mid-stream
+	resync bool
+	// data skipped while waiting for the first request, kept for the
+	// fallback
+	skipped      []httpSkippedData
+	skippedBytes int
+	// length of the last gap, reported by the parser of its direction
+	gapLength uint32
+
 	reqReader  *io.PipeReader
 	reqWriter  *io.PipeWriter
 	respReader *io.PipeReader
 	respWriter *io.PipeWriter
 
-	wg            sync.WaitGroup
+	// capture times of the messages written to the pipes
+	reqTimes  timeQueue
+	respTimes timeQueue
+
+	// requests parsed on the connection, used only by the request parser
+	requestCount int
+	// methods of the parsed requests for the response parser, empty for
+	// requests lost in a gap
+	methods *requestMethodQueue
+
+	// parsers of the directions, restarted separately after a gap
+	reqWg         sync.WaitGroup
+	respWg        sync.WaitGroup
 	reqRespWriter *HttpRequestResponseWriter
 }
 
+type httpSkippedData struct {
+	data       []byte
+	isClient   bool
+	timestamps TCPTimestamps
+}
+
 func (httpData *HttpData) Close() {
 	if httpData.reqWriter != nil {
 		httpData.reqWriter.Close()
@@ -35,25 +75,264 @@ func (httpData *HttpData) Close() {
 		httpData.respWriter.Close()
 	}
 
-	httpData.wg.Wait()
+	httpData.reqWg.Wait()
+	httpData.respWg.Wait()
 
 	if httpData.reqRespWriter != nil {
 		httpData.reqRespWriter.Close()
 	}
 }
 
+// timeQueue passes the capture times of messages from the listener to the
+// parser of their pipe. A message is assumed to start with the data chunk
+// in which its first line is seen.
+type timeQueue struct {
+	mu    sync.Mutex
+	times []time.Time
+	last  time.Time
+}
+
+func (q *timeQueue) Push(t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.times = append(q.times, t)
+}
+
+// Pop returns the time of the next message, or the previous time when the
+// start of the message was not seen at a chunk boundary.
+func (q *timeQueue) Pop() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.times) > 0 {
+		q.last = q.times[0]
+		q.times = q.times[1:]
+	}
+
+	return q.last
+}
+
+// requestMethodQueue passes the methods of parsed requests from the request
+// parser to the response parser, which needs them to tell whether a
+// response has a body. Pop waits until the request parser has either parsed
+// the next request or consumed all request data written so far, the data of
+// a request is written before its response.
+type requestMethodQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	methods []string
+	closed  bool
+
+	// request data written to the pipe and read from it by the parser
+	written int
+	read    int
+	reading bool
+}
+
+func newRequestMethodQueue() *requestMethodQueue {
+	q := &requestMethodQueue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// Written is called before writing request data to the pipe.
+func (q *requestMethodQueue) Written(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.written += n
+}
+
+func (q *requestMethodQueue) Push(method string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.methods = append(q.methods, method)
+	q.cond.Broadcast()
+}
+
+// Close is called when the request parser stops.
+func (q *requestMethodQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Pop returns the method of the next request, false when the request is not
+// known.
+func (q *requestMethodQueue) Pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.methods) == 0 && !q.closed && !(q.reading && q.read == q.written) {
+		q.cond.Wait()
+	}
+
+	if len(q.methods) == 0 {
+		return "", false
+	}
+
+	method := q.methods[0]
+	q.methods = q.methods[1:]
+
+	return method, true
+}
+
+// Reset is called before a new request parser starts, after the previous
+// one stopped at a gap.
+func (q *requestMethodQueue) Reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = false
+	q.written, q.read = 0, 0
+}
+
+// Reader wraps the reader of the request parser to track when it waits for
+// more data.
+func (q *requestMethodQueue) Reader(r io.Reader) io.Reader {
+	return requestMethodQueueReader{q, r}
+}
+
+type requestMethodQueueReader struct {
+	q *requestMethodQueue
+	r io.Reader
+}
+
+func (r requestMethodQueueReader) Read(p []byte) (int, error) {
+	q := r.q
+
+	q.mu.Lock()
+	q.reading = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	n, err := r.r.Read(p)
+
+	q.mu.Lock()
+	q.reading = false
+	q.read += n
+	q.mu.Unlock()
+
+	return n, err
+}
+
+// errTCPGap is returned by the pipe of a direction in which data was lost
+var errTCPGap = errors.New("data missing from tcp stream")
+
+// errTCPReset is returned by the pipes of a connection aborted with RST
+var errTCPReset = errors.New("tcp connection reset")
+
+// errTCPTruncated is returned by the pipes of a connection evicted or still
+// open when the capture ended
+var errTCPTruncated = errors.New("tcp stream truncated")
+
+// Gap ends the message in progress in the direction with the gap, its
+// parser outputs the exchange as incomplete. The direction is parsed again
+// from its next message, the other direction is not affected.
+func (httpData *HttpData) Gap(length uint32, isClient bool) {
+	if !httpData.dataReceived {
+		httpData.resync = true
+		return
+	}
+
+	httpData.gapLength = length
+	if isClient {
+		httpData.reqWriter.CloseWithError(errTCPGap)
+		httpData.reqWg.Wait()
+
+		httpData.reqSynced = false
+		httpData.reqTimes = timeQueue{}
+		httpData.methods.Reset()
+		httpData.startRequestParser()
+	} else {
+		httpData.respWriter.CloseWithError(errTCPGap)
+		httpData.respWg.Wait()
+
+		httpData.respSynced = false
+		httpData.respTimes = timeQueue{}
+		httpData.startResponseParser()
+	}
+}
+
+func (httpData *HttpData) startRequestParser() {
+	httpData.reqReader, httpData.reqWriter = io.Pipe()
+	httpData.reqWg.Add(1)
+
+	go func() {
+		defer httpData.reqWg.Done()
+		parseHttpRequest(httpData, httpData.reqRespWriter.ReqChan, true)
+	}()
+}
+
+func (httpData *HttpData) startResponseParser() {
+	httpData.respReader, httpData.respWriter = io.Pipe()
+	httpData.respWg.Add(1)
+
+	go func() {
+		defer httpData.respWg.Done()
+		parseHttpResponse(httpData, httpData.reqRespWriter.RespChan, false)
+	}()
+}
+
+// EndOfStream closes the pipe of one direction, so that its parser sees
+// the end of data without waiting for the whole connection to close.
+func (httpData *HttpData) EndOfStream(isClient bool, end StreamEnd) {
+	if !httpData.dataReceived {
+		return
+	}
+
+	w := httpData.respWriter
+	if isClient {
+		w = httpData.reqWriter
+	}
+
+	switch end {
+	case STREAM_END_RESET:
+		w.CloseWithError(errTCPReset)
+	case STREAM_END_TRUNCATED:
+		//
+		// requests waiting for a response will not get one
+		//
+		if !isClient {
+			httpData.reqRespWriter.Truncated = true
+		}
+		w.CloseWithError(errTCPTruncated)
+	default:
+		w.Close()
+	}
+}
+
 type HttpTCPListener struct {
-	conns map[TCPListenerConnection]*HttpData
+	writer io.Writer
+	conns  map[TCPListenerConnection]*HttpData
+
+	// receives the connections which turn out not to be http when set,
+	// otherwise their data is dropped
+	Fallback      TCPListener
+	fallbackConns map[TCPListenerConnection]bool
+
+	// bytes of a connection picked up mid-stream or after a gap searched
+	// for a request before the connection is passed to the fallback
+	ResyncLimit int
 }
 
-func NewHTTPTcpListener() *HttpTCPListener {
+func NewHTTPTcpListener(writer io.Writer) *HttpTCPListener {
 	h := HttpTCPListener{}
+	h.writer = writer
 	h.conns = make(map[TCPListenerConnection]*HttpData)
+	h.fallbackConns = make(map[TCPListenerConnection]bool)
+	h.ResyncLimit = DEFAULT_HTTP_RESYNC_LIMIT
 
 	return &h
 }
 
-func (htl *HttpTCPListener) NewConnection(conn TCPListenerConnection) {
+func (htl *HttpTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
 	httpData := &HttpData{}
 	httpData.conn = conn
 	htl.conns[conn] = httpData
@@ -61,8 +340,13 @@ func (htl *HttpTCPListener) NewConnection(conn TCPListenerConnection) {
 	httpdebug("new connection")
 }
 
-func (htl *HttpTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool) {
+func (htl *HttpTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
 	httpdebug("data")
+	if htl.fallbackConns[conn] {
+		htl.Fallback.Data(conn, data, isClient, timestamps)
+		return
+	}
+
 	//
 	// find connection
 	//
@@ -78,6 +362,30 @@ func (htl *HttpTCPListener) Data(conn TCPListenerConnection, data []byte, isClie
 	// is this initial data package for this connection?
 	//
 	if !httpData.dataReceived {
+		//
+		// connection picked up mid-stream, wait for the next request boundary
+		//
+		if (conn.MidStream || httpData.resync) && (!isClient || !isHttpReq(data)) {
+			httpdebug("waiting for request boundary")
+
+			if htl.Fallback == nil {
+				return
+			}
+
+			httpData.skipped = append(httpData.skipped, httpSkippedData{append([]byte(nil), data...), isClient, timestamps})
+			httpData.skippedBytes += len(data)
+
+			//
+			// most likely not http, show what was skipped
+			//
+			if httpData.skippedBytes > htl.ResyncLimit {
+				httpdebug("no request boundary found")
+				htl.ClosedConnection(conn, timestamps.Last)
+				htl.startFallback(conn, httpData.skipped)
+			}
+			return
+		}
+
 		//
 		// make sure the data is http
 		//
@@ -86,46 +394,122 @@ func (htl *HttpTCPListener) Data(conn TCPListenerConnection, data []byte, isClie
 			// if data is not http, we are not interested in this connection
 			//
 			httpdebug("not http data")
-			htl.ClosedConnection(conn)
+			htl.ClosedConnection(conn, timestamps.Last)
+
+			if htl.Fallback != nil {
+				htl.startFallback(conn, []httpSkippedData{{data, isClient, timestamps}})
+			}
 			return
 		}
 
+		httpData.skipped = nil
+		httpData.skippedBytes = 0
+
 		//
 		// start request and response listeners
 		//
-		httpData.reqReader, httpData.reqWriter = io.Pipe()
-		httpData.respReader, httpData.respWriter = io.Pipe()
-		httpData.reqRespWriter = NewHttpRequestResponseWriter(os.Stdout, true)
-		httpData.wg.Add(2)
+		httpData.reqRespWriter = NewHttpRequestResponseWriter(htl.writer, true)
+		httpData.methods = newRequestMethodQueue()
 
-		//
-		// start goroutines
-		//
 		go httpData.reqRespWriter.Run()
-		go func() {
-			defer httpData.wg.Done()
-			parseHttpRequest(httpData, httpData.reqRespWriter.ReqChan, true)
-		}()
-		go func() {
-			defer httpData.wg.Done()
-			parseHttpResponse(httpData, httpData.reqRespWriter.RespChan, false)
-		}()
+		httpData.startRequestParser()
+		httpData.startResponseParser()
 
 		httpData.dataReceived = true
+		httpData.reqSynced = true
+		httpData.respSynced = !conn.MidStream && !httpData.resync
 	}
 	httpdebug("data received")
 
+	//
+	// skip the tail of a request after a gap
+	//
+	if isClient && !httpData.reqSynced {
+		if !isHttpReq(data) {
+			httpdebug("waiting for request boundary")
+			return
+		}
+
+		httpData.reqSynced = true
+	}
+
+	//
+	// skip the tail of a response which started before the pickup or a gap
+	//
+	if !isClient && !httpData.respSynced {
+		if !isHttpResp(data) {
+			httpdebug("waiting for response boundary")
+			return
+		}
+
+		httpData.respSynced = true
+	}
+
 	//
 	// write data
 	//
 	if isClient {
+		if isHttpReq(data) {
+			httpData.reqTimes.Push(timestamps.First)
+		}
+		httpData.methods.Written(len(data))
 		httpData.reqWriter.Write(data)
 	} else {
+		if isHttpResp(data) {
+			httpData.respTimes.Push(timestamps.First)
+		}
 		httpData.respWriter.Write(data)
 	}
 }
 
-func (htl *HttpTCPListener) ClosedConnection(conn TCPListenerConnection) {
+// startFallback passes a connection to the fallback with the data seen so
+// far.
+func (htl *HttpTCPListener) startFallback(conn TCPListenerConnection, skipped []httpSkippedData) {
+	htl.fallbackConns[conn] = true
+	htl.Fallback.NewConnection(conn, skipped[0].timestamps.First)
+
+	for _, s := range skipped {
+		htl.Fallback.Data(conn, s.data, s.isClient, s.timestamps)
+	}
+}
+
+func (htl *HttpTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	if htl.fallbackConns[conn] {
+		htl.Fallback.Gap(conn, length, isClient, timestamp)
+		return
+	}
+
+	httpData, ok := htl.conns[conn]
+	if !ok {
+		return
+	}
+
+	httpdebug(fmt.Sprintf("gap of %d bytes", length))
+	httpData.Gap(length, isClient)
+}
+
+func (htl *HttpTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+	if htl.fallbackConns[conn] {
+		htl.Fallback.EndOfStream(conn, isClient, end, timestamp)
+		return
+	}
+
+	httpData, ok := htl.conns[conn]
+	if !ok {
+		return
+	}
+
+	httpdebug("end of stream,", end)
+	httpData.EndOfStream(isClient, end)
+}
+
+func (htl *HttpTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	if htl.fallbackConns[conn] {
+		delete(htl.fallbackConns, conn)
+		htl.Fallback.ClosedConnection(conn, timestamp)
+		return
+	}
+
 	httpData, ok := htl.conns[conn]
 	if !ok {
 		return
@@ -138,12 +522,54 @@ func (htl *HttpTCPListener) ClosedConnection(conn TCPListenerConnection) {
 }
 
 func parseHttpResponse(httpData *HttpData, c chan []byte, addHeader bool) {
+	reader := bufio.NewReader(httpData.respReader)
+
+	var out bytes.Buffer
+	var req *http.Request
+	exchange := false
+
 	for {
-		var out bytes.Buffer
+		//
+		// the method of the request tells whether the response has a body,
+		// it is taken when the response starts and kept over interim
+		// responses
+		//
+		if !exchange {
+			if _, err := reader.Peek(1); err != nil {
+				//
+				// the start of the next response was lost
+				//
+				if errors.Is(err, errTCPGap) {
+					httpData.methods.Pop()
+					writeIncomplete(&out, httpData, err, "response")
+					out.WriteByte('\n')
+					c <- out.Bytes()
+				}
+				return
+			}
+
+			req = nil
+			if method, ok := httpData.methods.Pop(); ok && method != "" {
+				req = &http.Request{Method: method}
+			}
+			exchange = true
+		}
 
-		resp, err := http.ReadResponse(bufio.NewReader(httpData.respReader), nil)
+		resp, err := http.ReadResponse(reader, req)
+		if errors.Is(err, errTCPGap) {
+			writeIncomplete(&out, httpData, err, "response")
+			out.WriteByte('\n')
+			c <- out.Bytes()
+			return
+		}
 		if err != nil {
-			if err == io.ErrClosedPipe || err == io.EOF || err == io.ErrUnexpectedEOF {
+			if errors.Is(err, errTCPReset) || errors.Is(err, errTCPTruncated) || err == io.ErrClosedPipe || err == io.EOF || err == io.ErrUnexpectedEOF {
+				//
+				// interim responses of the last exchange
+				//
+				if out.Len() > 0 {
+					c <- out.Bytes()
+				}
 				return
 			}
 
@@ -152,11 +578,13 @@ func parseHttpResponse(httpData *HttpData, c chan []byte, addHeader bool) {
 			continue
 		}
 
+		timestamp := httpData.respTimes.Pop()
+
 		//
 		// Write header
 		//
-		if addHeader {
-			writeHeader(&out, httpData)
+		if addHeader && out.Len() == 0 {
+			writeHeader(&out, httpData, timestamp)
 		}
 
 		//
@@ -175,19 +603,54 @@ func parseHttpResponse(httpData *HttpData, c chan []byte, addHeader bool) {
 			}
 		}
 
+		//
+		// interim responses are shown with the final response to the same
+		// request
+		//
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			out.WriteByte('\n')
+			continue
+		}
+
+		//
+		// after a protocol switch or an established tunnel the data is no
+		// longer http, it is drained so that the listener is not blocked
+		//
+		if resp.StatusCode == http.StatusSwitchingProtocols ||
+			(req != nil && req.Method == http.MethodConnect && resp.StatusCode >= 200 && resp.StatusCode < 300) {
+			out.WriteByte('\n')
+			c <- out.Bytes()
+			io.Copy(ioutil.Discard, reader)
+			return
+		}
+
 		//
 		// Write content
 		//
-		defer resp.Body.Close()
+		//
+		// the body is read to its end before the next response, closing it
+		// right away keeps the bodies of a long connection from piling up
+		//
 		buf, err := ioutil.ReadAll(resp.Body)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if writeIncomplete(&out, httpData, err, "response") {
+			out.WriteByte('\n')
+			c <- out.Bytes()
+			return
+		}
+
+		exchange = false
 		if err != nil {
 			httpdebug("error while reading response body", err)
+			out.Reset()
 			continue
 		}
 
 		handlePayload(&out, buf, resp.Header)
 		out.WriteByte('\n')
 		c <- out.Bytes()
+		out = bytes.Buffer{}
 	}
 }
 
@@ -248,15 +711,37 @@ func handlePayload(out *bytes.Buffer, buf []byte, headers http.Header) error {
 }
 
 func parseHttpRequest(httpData *HttpData, c chan []byte, addHeader bool) {
+	//
+	// the reader is kept over requests, it may have buffered the start of
+	// the next pipelined one
+	//
+	reader := bufio.NewReader(httpData.methods.Reader(httpData.reqReader))
+	defer httpData.methods.Close()
+
 	for {
 		var out bytes.Buffer
 
 		//
 		// Read request
 		//
-		req, err := http.ReadRequest(bufio.NewReader(httpData.reqReader))
+		req, err := http.ReadRequest(reader)
+		if errors.Is(err, errTCPGap) {
+			//
+			// the start of a request was lost, its place is kept so that the
+			// following responses stay paired with their requests
+			//
+			httpData.methods.Push("")
+			httpData.requestCount += 1
+			if addHeader {
+				writeHeader(&out, httpData, httpData.reqTimes.Pop())
+			}
+			writeIncomplete(&out, httpData, err, "request")
+			out.WriteByte('\n')
+			c <- out.Bytes()
+			return
+		}
 		if err != nil {
-			if err == io.EOF || err == io.ErrClosedPipe {
+			if errors.Is(err, errTCPReset) || errors.Is(err, errTCPTruncated) || err == io.ErrClosedPipe || err == io.EOF || err == io.ErrUnexpectedEOF {
 				return
 			}
 
@@ -264,17 +749,22 @@ func parseHttpRequest(httpData *HttpData, c chan []byte, addHeader bool) {
 			continue
 		}
 
+		httpData.methods.Push(req.Method)
+
+		timestamp := httpData.reqTimes.Pop()
+		httpData.requestCount += 1
+
 		//
 		// Write header
 		//
 		if addHeader {
-			writeHeader(&out, httpData)
+			writeHeader(&out, httpData, timestamp)
 		}
 
 		//
 		// Write Request-Line
 		//
-		out.WriteString(green(fmt.Sprintf("%s %s %s", req.Method, req.URL, req.Proto)))
+		out.WriteString(green(fmt.Sprintf("%s %s %s", req.Method, req.RequestURI, req.Proto)))
 		out.WriteByte('\n')
 
 		//
@@ -290,8 +780,13 @@ func parseHttpRequest(httpData *HttpData, c chan []byte, addHeader bool) {
 		//
 		// Write content
 		//
-		defer req.Body.Close()
 		buf, err := ioutil.ReadAll(req.Body)
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+		if writeIncomplete(&out, httpData, err, "request") {
+			c <- out.Bytes()
+			return
+		}
 		if err != nil {
 			httpdebug("error while reading request body", err)
 			continue
@@ -306,6 +801,9 @@ type HttpRequestResponseWriter struct {
 	writer io.Writer
 	mutual bool
 
+	// stream of responses was truncated, set before Close
+	Truncated bool
+
 	ReqChan  chan []byte
 	RespChan chan []byte
 	done     chan bool
@@ -328,59 +826,87 @@ func (p *HttpRequestResponseWriter) Close() {
 	close(p.done)
 }
 
+// Run pairs requests with responses in the order they were sent, which is
+// also the order of pipelined requests. Both channels are read all the time,
+// so that neither parser blocks the other.
 func (p *HttpRequestResponseWriter) Run() {
-	for {
-		//
-		// Wait for request
-		//
-		req, ok := <-p.ReqChan
-
-		if !ok {
-			break
-		}
-
-		//
-		// Write request without waiting for response if mutual flag is not set
-		//
-		if !p.mutual {
-			p.writer.Write(req)
-		}
-
-		//
-		// Wait for response
-		//
-		resp, ok := <-p.RespChan
+	var requests, responses [][]byte
+	reqChan, respChan := p.ReqChan, p.RespChan
+
+	for reqChan != nil || respChan != nil {
+		select {
+		case req, ok := <-reqChan:
+			if !ok {
+				reqChan = nil
+				continue
+			}
 
-		if !ok {
 			//
-			// Write already read request
+			// Write request without waiting for response if mutual flag is not set
 			//
-			if p.mutual {
+			if !p.mutual {
 				p.writer.Write(req)
 			}
-
-			break
+			requests = append(requests, req)
+		case resp, ok := <-respChan:
+			if !ok {
+				respChan = nil
+				continue
+			}
+			responses = append(responses, resp)
 		}
 
-		//
-		// Write either request+response or only response depending on the mutuality flag
-		//
-		if p.mutual {
-			p.writer.Write(req)
+		for len(requests) > 0 && len(responses) > 0 {
+			p.write(requests[0], responses[0])
+			requests, responses = requests[1:], responses[1:]
 		}
+	}
+
+	//
+	// Write already read requests and responses without a pair
+	//
+	for _, req := range requests {
+		p.write(req, nil)
+	}
+	for _, resp := range responses {
 		p.writer.Write(resp)
 	}
 
 	p.done <- true
 }
 
+// write writes a request, unless already written, and its response. A
+// missing response is marked when the stream was truncated before it.
+func (p *HttpRequestResponseWriter) write(req, resp []byte) {
+	var out bytes.Buffer
+
+	if p.mutual {
+		out.Write(req)
+	}
+
+	switch {
+	case resp != nil:
+		out.Write(resp)
+	case p.Truncated:
+		out.WriteString(red("<no response: stream truncated>"))
+		out.WriteString("\n\n")
+	}
+
+	p.writer.Write(out.Bytes())
+}
+
 //
 // helpers
 //
 
 func statusText(statusCode int, status string) string {
-	splitted := strings.SplitN(status, " ", 2)
-	statusMessage := splitted[1]
+	//
+	// the reason phrase may be missing, e.g. "HTTP/1.1 204"
+	//
+	statusMessage := http.StatusText(statusCode)
+	if splitted := strings.SplitN(status, " ", 2); len(splitted) > 1 {
+		statusMessage = splitted[1]
+	}
 
 	var statusCodeStr string
 
@@ -411,17 +937,52 @@ func readGzip(data []byte) ([]byte, error) {
 	return ioutil.ReadAll(gzipReader)
 }
 
-func writeHeader(out *bytes.Buffer, httpData *HttpData) {
-	out.WriteString(fmt.Sprintf("[%s] %s -> %s:%d, req #%d",
-		"17.08.2015 11:59:10",
+func writeHeader(out *bytes.Buffer, httpData *HttpData, timestamp time.Time) {
+	out.WriteString(fmt.Sprintf("[%s] %s -> %s:%d, stream %d, req #%d",
+		timestamp.Format(HTTP_HEADER_TIME_FORMAT),
 		AddressToString(httpData.conn.ClientAddress),
 		AddressToString(httpData.conn.ServerAddress),
 		httpData.conn.ServerPort,
-		1,
+		httpData.conn.StreamIndex,
+		httpData.requestCount,
 	))
+
+	//
+	// capture interface and direction (pcap-ng only)
+	//
+	if httpData.conn.InterfaceName != "" || httpData.conn.Direction != DIRECTION_UNKNOWN {
+		out.WriteString(" [")
+		out.WriteString(CaptureInfoString(CaptureInfo{
+			InterfaceName: httpData.conn.InterfaceName,
+			Direction:     httpData.conn.Direction,
+		}))
+		out.WriteString("]")
+	}
 	out.WriteByte('\n')
 }
 
+// writeIncomplete marks a message of which the body was cut by lost data or
+// a reset. Returns false when err is not one of those.
+func writeIncomplete(out *bytes.Buffer, httpData *HttpData, err error, what string) bool {
+	var msg string
+
+	switch {
+	case errors.Is(err, errTCPGap):
+		msg = fmt.Sprintf("<incomplete: %d bytes missing from %s>", httpData.gapLength, what)
+	case errors.Is(err, errTCPReset):
+		msg = fmt.Sprintf("<incomplete: connection reset during %s>", what)
+	case errors.Is(err, errTCPTruncated):
+		msg = fmt.Sprintf("<incomplete: stream truncated during %s>", what)
+	default:
+		return false
+	}
+
+	out.WriteByte('\n')
+	out.WriteString(red(msg))
+
+	return true
+}
+
 func writeTextPayload(out *bytes.Buffer, buf []byte) {
 	payloadStr := string(buf)
 	payloadLen := len(payloadStr)
@@ -520,7 +1081,7 @@ func isHttpReq(bytes []byte) bool {
 		}
 	}
 
-	panic("should not end up here")
+	return false
 }
 
 func httpdebug(a ...interface{}) {
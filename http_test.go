@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestIsHttp(t *testing.T) {
@@ -14,6 +18,8 @@ func TestIsHttp(t *testing.T) {
 		{[]byte("HTTP/1.1"), false},
 		{[]byte("HTTP/1.1\r\n"), false},
 		{[]byte("GET HTTP/1.1\r\n"), false},
+		{[]byte("GET"), false},
+		{[]byte{}, false},
 	}
 
 	for i, c := range cases {
@@ -24,3 +30,327 @@ func TestIsHttp(t *testing.T) {
 		}
 	}
 }
+
+func TestIsHttpResp(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want bool
+	}{
+		{[]byte("HTTP/1.1 200 OK\r\n"), true},
+		{[]byte("HTTP/1.0 404 Not Found\r\n"), true},
+		{[]byte("HTTP/1.1"), false},
+		{[]byte("GET / HTTP/1.1\r\n"), false},
+		{[]byte("HTTP/x.1 200 OK\r\n"), false},
+	}
+
+	for i, c := range cases {
+		got := isHttpResp(c.in)
+
+		if got != c.want {
+			t.Errorf("TestIsHttpResp[%d] mismatch for data '%s'. got: %t, want %t", i, string(c.in), got, c.want)
+		}
+	}
+}
+
+// testSyncBuffer collects the output of the HTTP listener goroutines.
+type testSyncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *testSyncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testSyncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls the output until it contains s or a second has passed.
+func (b *testSyncBuffer) waitFor(s string) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if strings.Contains(b.String(), s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestHttpTCPListenerEndOfStream(t *testing.T) {
+	cases := []struct {
+		segments []testSegment
+		want     string
+	}{
+		// close-delimited body ends with the server's FIN while the client
+		// keeps its side open
+		{[]testSegment{
+			{true, 0, 0, "GET / HTTP/1.0\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\nhello"},
+			{false, 50, testFIN, ""},
+		}, "hello"},
+		// reset in the middle of a body
+		{[]testSegment{
+			{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nhello"},
+			{false, 44, testRST, ""},
+		}, "<incomplete: connection reset during response>"},
+		// capture ended in the middle of a body
+		{[]testSegment{
+			{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nhello"},
+		}, "<incomplete: stream truncated during response>"},
+		// capture ended before the response
+		{[]testSegment{
+			{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+		}, green("GET / HTTP/1.1") + "\n" + red("<no response: stream truncated>")},
+	}
+
+	for i, c := range cases {
+		out := &testSyncBuffer{}
+		htl := NewHTTPTcpListener(out)
+		tcpStack := NewTCPStack(htl)
+
+		testReplay(tcpStack, 1000, 5000, c.segments)
+		tcpStack.Close()
+
+		if !out.waitFor(c.want) {
+			t.Errorf("TestHttpTCPListenerEndOfStream[%d] output mismatch, got: %q, want to contain %q", i, out.String(), c.want)
+		}
+
+		for _, httpData := range htl.conns {
+			httpData.Close()
+		}
+	}
+}
+
+func TestHttpTCPListenerRequestTime(t *testing.T) {
+	out := &testSyncBuffer{}
+	htl := NewHTTPTcpListener(out)
+	tcpStack := NewTCPStack(htl)
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+		{false, 0, 0, "HTTP/1.1 204 No Content\r\n\r\n"},
+	})
+
+	want := "[" + time.Unix(1440000000, 0).Format(HTTP_HEADER_TIME_FORMAT) + "]"
+	if !out.waitFor(want) {
+		t.Errorf("TestHttpTCPListenerRequestTime output mismatch, got: %q, want to contain %q", out.String(), want)
+	}
+
+	for _, httpData := range htl.conns {
+		httpData.Close()
+	}
+}
+
+func TestHttpTCPListenerKeepAlive(t *testing.T) {
+	req1 := "GET /a HTTP/1.1\r\nHost: x\r\n\r\n"
+	req2 := "POST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody"
+	req3 := "GET /c HTTP/1.1\r\nHost: x\r\n\r\n"
+	resp1 := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\none"
+	resp2 := "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+	resp3 := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nthree\r\n0\r\n\r\n"
+
+	n1, n2, n3 := uint32(len(req1)), uint32(len(req2)), uint32(len(req3))
+	m1, m2 := uint32(len(resp1)), uint32(len(resp2))
+
+	cases := []struct {
+		name     string
+		segments []testSegment
+	}{
+		{"keep-alive", []testSegment{
+			{true, 0, 0, req1},
+			{false, 0, 0, resp1},
+			{true, n1, 0, req2},
+			{false, m1, 0, resp2},
+			{true, n1 + n2, 0, req3},
+			{false, m1 + m2, 0, resp3},
+		}},
+		{"pipelined", []testSegment{
+			{true, 0, 0, req1 + req2 + req3},
+			{false, 0, 0, resp1 + resp2},
+			{false, m1 + m2, 0, resp3},
+		}},
+		{"pipelined, split mid-request", []testSegment{
+			{true, 0, 0, req1 + req2[:10]},
+			{true, n1 + 10, 0, req2[10:] + req3},
+			{false, 0, 0, resp1 + resp2[:5]},
+			{false, m1 + 5, 0, resp2[5:] + resp3},
+		}},
+	}
+
+	want := []string{
+		", req #1", green("GET /a HTTP/1.1"), "one",
+		", req #2", green("POST /b HTTP/1.1"), "body", statusText(201, "201 Created"),
+		", req #3", green("GET /c HTTP/1.1"), "three",
+	}
+
+	for _, c := range cases {
+		out := &testSyncBuffer{}
+		htl := NewHTTPTcpListener(out)
+		tcpStack := NewTCPStack(htl)
+
+		testReplay(tcpStack, 1000, 5000, c.segments)
+		tcpStack.NewPacket(testTCPPacket(time.Unix(1440000000, 0), testClient, testServer, 1001+n1+n2+n3, 5001, testACK|testFIN, nil))
+		tcpStack.Close()
+
+		//
+		// parts of the exchanges in order
+		//
+		got := out.String()
+		rest := got
+		for _, w := range want {
+			i := strings.Index(rest, w)
+			if i < 0 {
+				t.Errorf("TestHttpTCPListenerKeepAlive[%s] mismatch, got: %q, want %q in order", c.name, got, w)
+				break
+			}
+			rest = rest[i+len(w):]
+		}
+
+		if strings.Contains(got, "<no response") {
+			t.Errorf("TestHttpTCPListenerKeepAlive[%s] unpaired request, got: %q", c.name, got)
+		}
+	}
+}
+
+func TestHttpTCPListenerResponseBodies(t *testing.T) {
+	post := "POST /a HTTP/1.1\r\nHost: x\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"
+	interim := "HTTP/1.1 100 Continue\r\n\r\n"
+	final := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 4\r\n\r\ndone"
+	connect := "CONNECT x:443 HTTP/1.1\r\nHost: x:443\r\n\r\n"
+	established := "HTTP/1.1 200 Connection established\r\n\r\n"
+
+	cases := []struct {
+		name     string
+		segments []testSegment
+		want     []string
+	}{
+		// HEAD response has a length but no body, the next response follows
+		{"head", []testSegment{
+			{true, 0, 0, "HEAD /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nhi"},
+		}, []string{green("HEAD /a HTTP/1.1"), "Content-Length: 5", green("GET /b HTTP/1.1"), "hi"}},
+		// no body after 204 and 304
+		{"204 and 304", []testSegment{
+			{true, 0, 0, "DELETE /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\nGET /c HTTP/1.1\r\nHost: x\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.1 204 No Content\r\n\r\nHTTP/1.1 304 Not Modified\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok"},
+		}, []string{green("DELETE /a HTTP/1.1"), "No Content", green("GET /b HTTP/1.1"), "Not Modified", green("GET /c HTTP/1.1"), "ok"}},
+		// status line without a reason phrase
+		{"no reason phrase", []testSegment{
+			{true, 0, 0, "DELETE /a HTTP/1.1\r\nHost: x\r\n\r\n"},
+			{false, 0, 0, "HTTP/1.1 204\r\n\r\n"},
+		}, []string{green("DELETE /a HTTP/1.1"), statusText(204, "204 No Content")}},
+		// interim response belongs to the exchange of the request
+		{"100 continue", []testSegment{
+			{true, 0, 0, post},
+			{false, 0, 0, interim},
+			{true, uint32(len(post)), 0, "body"},
+			{false, uint32(len(interim)), 0, final},
+			{true, uint32(len(post) + 4), 0, "GET /b HTTP/1.1\r\nHost: x\r\n\r\n"},
+			{false, uint32(len(interim) + len(final)), 0, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"},
+		}, []string{green("POST /a HTTP/1.1"), "body", "Continue", "done", green("GET /b HTTP/1.1"), "Not Found"}},
+		// tunnel data after CONNECT is not parsed
+		{"connect", []testSegment{
+			{true, 0, 0, connect},
+			{false, 0, 0, established},
+			{true, uint32(len(connect)), 0, "\x16\x03\x01\x00\x05hello"},
+			{false, uint32(len(established)), 0, "\x16\x03\x03\x00\x05world"},
+		}, []string{green("CONNECT x:443 HTTP/1.1"), "Connection established"}},
+	}
+
+	for _, c := range cases {
+		out := &testSyncBuffer{}
+		htl := NewHTTPTcpListener(out)
+		tcpStack := NewTCPStack(htl)
+
+		testReplay(tcpStack, 1000, 5000, c.segments)
+		tcpStack.Close()
+
+		got := out.String()
+		rest := got
+		for _, w := range c.want {
+			i := strings.Index(rest, w)
+			if i < 0 {
+				t.Errorf("TestHttpTCPListenerResponseBodies[%s] mismatch, got: %q, want %q in order", c.name, got, w)
+				break
+			}
+			rest = rest[i+len(w):]
+		}
+
+		if strings.Contains(got, "<no response") || strings.Contains(got, "world") {
+			t.Errorf("TestHttpTCPListenerResponseBodies[%s] mismatch, got: %q", c.name, got)
+		}
+	}
+}
+
+func TestHttpTCPListenerGap(t *testing.T) {
+	req1 := "GET /a HTTP/1.1\r\nHost: x\r\n\r\n"
+	req2 := "POST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody"
+	req3 := "GET /c HTTP/1.1\r\nHost: x\r\n\r\n"
+	resp1 := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\none"
+	resp2 := "HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"
+	resp3 := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nthree"
+
+	n1, n2 := uint32(len(req1)), uint32(len(req2))
+	m1, m2 := uint32(len(resp1)), uint32(len(resp2))
+
+	cases := []struct {
+		name     string
+		segments []testSegment
+		want     []string
+	}{
+		// pipelined responses queued before the gap are kept
+		{"response", []testSegment{
+			{true, 0, 0, req1 + req2 + req3},
+			{false, 0, 0, resp1 + resp2[:10]},
+			{false, m1 + 20, 0, resp2[20:]},
+			{false, m1 + m2, 0, resp3},
+		}, []string{
+			green("GET /a HTTP/1.1"), "one",
+			green("POST /b HTTP/1.1"), red("<incomplete: 10 bytes missing from response>"),
+			green("GET /c HTTP/1.1"), "three",
+		}},
+		// responses are parsed on while the requests resync
+		{"request", []testSegment{
+			{true, 0, 0, req1 + req2[:10]},
+			{true, n1 + 20, 0, req2[20:]},
+			{true, n1 + n2, 0, req3},
+			{false, 0, 0, resp1 + resp2 + resp3},
+		}, []string{
+			green("GET /a HTTP/1.1"), "one",
+			red("<incomplete: 10 bytes missing from request>"), statusText(201, "201 Created"),
+			green("GET /c HTTP/1.1"), "three",
+		}},
+	}
+
+	for _, c := range cases {
+		out := &testSyncBuffer{}
+		htl := NewHTTPTcpListener(out)
+		tcpStack := NewTCPStack(htl)
+		tcpStack.GapBufferThreshold = 1
+
+		testReplay(tcpStack, 1000, 5000, c.segments)
+		tcpStack.Close()
+
+		got := out.String()
+		rest := got
+		for _, w := range c.want {
+			i := strings.Index(rest, w)
+			if i < 0 {
+				t.Errorf("TestHttpTCPListenerGap[%s] mismatch, got: %q, want %q in order", c.name, got, w)
+				break
+			}
+			rest = rest[i+len(w):]
+		}
+
+		if strings.Contains(got, "<no response") {
+			t.Errorf("TestHttpTCPListenerGap[%s] unpaired request, got: %q", c.name, got)
+		}
+	}
+}
@@ -17,6 +17,30 @@ type ICMPFrameHeader struct {
 
 const (
 	ICMP_FRAME_HEADER_LENGTH = 8
+
+	ICMP_TYPE_ECHO_REPLY              = 0
+	ICMP_TYPE_DESTINATION_UNREACHABLE = 3
+	ICMP_TYPE_SOURCE_QUENCH           = 4
+	ICMP_TYPE_REDIRECT                = 5
+	ICMP_TYPE_ECHO_REQUEST            = 8
+	ICMP_TYPE_ROUTER_ADVERTISEMENT    = 9
+	ICMP_TYPE_ROUTER_SOLICITATION     = 10
+	ICMP_TYPE_TIME_EXCEEDED           = 11
+	ICMP_TYPE_PARAMETER_PROBLEM       = 12
+	ICMP_TYPE_TIMESTAMP_REQUEST       = 13
+	ICMP_TYPE_TIMESTAMP_REPLY         = 14
+
+	ICMPV6_TYPE_DESTINATION_UNREACHABLE = 1
+	ICMPV6_TYPE_PACKET_TOO_BIG          = 2
+	ICMPV6_TYPE_TIME_EXCEEDED           = 3
+	ICMPV6_TYPE_PARAMETER_PROBLEM       = 4
+	ICMPV6_TYPE_ECHO_REQUEST            = 128
+	ICMPV6_TYPE_ECHO_REPLY              = 129
+	ICMPV6_TYPE_ROUTER_SOLICITATION     = 133
+	ICMPV6_TYPE_ROUTER_ADVERTISEMENT    = 134
+	ICMPV6_TYPE_NEIGHBOR_SOLICITATION   = 135
+	ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT  = 136
+	ICMPV6_TYPE_REDIRECT                = 137
 )
 
 func NewICMPFrame(data []byte) (*ICMPFrame, error) {
@@ -51,3 +75,11 @@ func (h ICMPFrameHeader) Checksum() uint16 {
 func (h ICMPFrameHeader) Content() []byte {
 	return h.data[4:8]
 }
+
+func (h ICMPFrameHeader) Identifier() uint16 {
+	return binary.BigEndian.Uint16(h.data[4:6])
+}
+
+func (h ICMPFrameHeader) SequenceNumber() uint16 {
+	return binary.BigEndian.Uint16(h.data[6:8])
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+const (
+	DEFAULT_ICMP_ECHO_TIMEOUT = 10 * time.Second
+)
+
+type ICMPEchoKey struct {
+	SourceAddress      netip.Addr
+	DestinationAddress netip.Addr
+	Identifier         uint16
+	SequenceNumber     uint16
+}
+
+type ICMPDestinationStats struct {
+	Address netip.Addr
+
+	Sent     int
+	Received int
+
+	RTTMin   time.Duration
+	RTTMax   time.Duration
+	RTTTotal time.Duration
+}
+
+func (s *ICMPDestinationStats) AddRTT(rtt time.Duration) {
+	if s.Received == 0 || rtt < s.RTTMin {
+		s.RTTMin = rtt
+	}
+	if rtt > s.RTTMax {
+		s.RTTMax = rtt
+	}
+
+	s.RTTTotal += rtt
+	s.Received += 1
+}
+
+func (s *ICMPDestinationStats) RTTAvg() time.Duration {
+	if s.Received == 0 {
+		return 0
+	}
+
+	return s.RTTTotal / time.Duration(s.Received)
+}
+
+func (s *ICMPDestinationStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+
+	return float64(s.Sent-s.Received) / float64(s.Sent) * 100
+}
+
+// ICMPAnalyzer pairs echo requests with echo replies and collects
+// round-trip times per destination for both ICMP and ICMPv6. Other ICMP
+// messages are printed with all packets by -print-packets.
+type ICMPAnalyzer struct {
+	writer io.Writer
+
+	// requests without a reply within the timeout count as lost
+	Timeout   time.Duration
+	lastSweep time.Time
+
+	pending      map[ICMPEchoKey]time.Time
+	destinations map[netip.Addr]*ICMPDestinationStats
+	order        []netip.Addr
+
+	UnmatchedReplies int
+}
+
+func NewICMPAnalyzer(writer io.Writer) *ICMPAnalyzer {
+	return &ICMPAnalyzer{
+		writer:       writer,
+		Timeout:      DEFAULT_ICMP_ECHO_TIMEOUT,
+		pending:      make(map[ICMPEchoKey]time.Time),
+		destinations: make(map[netip.Addr]*ICMPDestinationStats),
+	}
+}
+
+func (a *ICMPAnalyzer) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_ICMP {
+		return
+	}
+
+	icmpFrame := packet.ICMP
+	timestamp := packet.Timestamp()
+	isV6 := packet.IsIPv6()
+	src := packet.SourceAddress()
+	dst := packet.DestinationAddress()
+	t := icmpFrame.Header.Type()
+
+	a.expirePending(timestamp)
+
+	switch {
+	case (!isV6 && t == ICMP_TYPE_ECHO_REQUEST) || (isV6 && t == ICMPV6_TYPE_ECHO_REQUEST):
+		key := ICMPEchoKey{src, dst, icmpFrame.Header.Identifier(), icmpFrame.Header.SequenceNumber()}
+
+		//
+		// retransmitted request with the same id/seq restarts the timer
+		//
+		if _, ok := a.pending[key]; !ok {
+			a.stats(dst).Sent += 1
+		}
+		a.pending[key] = timestamp
+	case (!isV6 && t == ICMP_TYPE_ECHO_REPLY) || (isV6 && t == ICMPV6_TYPE_ECHO_REPLY):
+		key := ICMPEchoKey{dst, src, icmpFrame.Header.Identifier(), icmpFrame.Header.SequenceNumber()}
+
+		sent, ok := a.pending[key]
+		if !ok {
+			icmpdebug(fmt.Sprintf("unmatched echo reply from %s, id %d, seq %d",
+				AddressToString(src), key.Identifier, key.SequenceNumber))
+			a.UnmatchedReplies += 1
+			return
+		}
+		delete(a.pending, key)
+
+		rtt := timestamp.Sub(sent)
+		a.stats(src).AddRTT(rtt)
+
+		io.WriteString(a.writer, fmt.Sprintf("[%-37s] %15s -> %15s: %s echo reply, id %d, seq %d, rtt %s\n",
+			timestamp,
+			AddressToString(src),
+			AddressToString(dst),
+			packet.NetworkType,
+			key.Identifier, key.SequenceNumber, rtt))
+	}
+}
+
+// expirePending forgets echo requests without a reply within the timeout.
+// Time is taken from the packets like in the TCP stack.
+func (a *ICMPAnalyzer) expirePending(now time.Time) {
+	if a.Timeout <= 0 || now.Sub(a.lastSweep) < IDLE_SWEEP_INTERVAL {
+		return
+	}
+	a.lastSweep = now
+
+	for key, sent := range a.pending {
+		if now.Sub(sent) >= a.Timeout {
+			delete(a.pending, key)
+		}
+	}
+}
+
+func (a *ICMPAnalyzer) stats(address netip.Addr) *ICMPDestinationStats {
+	s, ok := a.destinations[address]
+	if !ok {
+		s = &ICMPDestinationStats{Address: address}
+		a.destinations[address] = s
+		a.order = append(a.order, address)
+	}
+
+	return s
+}
+
+func (a *ICMPAnalyzer) WriteReport(w io.Writer) {
+	if len(a.order) == 0 {
+		return
+	}
+
+	io.WriteString(w, "\nICMP echo statistics:\n")
+	io.WriteString(w, fmt.Sprintf("%39s %6s %6s %7s %12s %12s %12s\n",
+		"destination", "sent", "recv", "loss", "rtt min", "rtt avg", "rtt max"))
+
+	for _, address := range a.order {
+		s := a.destinations[address]
+
+		io.WriteString(w, fmt.Sprintf("%39s %6d %6d %6.1f%% %12s %12s %12s\n",
+			AddressToString(s.Address), s.Sent, s.Received, s.Loss(),
+			s.RTTMin, s.RTTAvg(), s.RTTMax))
+	}
+
+	if a.UnmatchedReplies > 0 {
+		io.WriteString(w, fmt.Sprintf("unmatched echo replies: %d\n", a.UnmatchedReplies))
+	}
+}
+
+func icmpTypeCodeString(h *ICMPFrameHeader, isV6 bool) string {
+	var name, code, proto string
+
+	if isV6 {
+		proto = "ICMPv6"
+		name = ICMPv6TypeToString(h.Type())
+		code = ICMPv6CodeToString(h.Type(), h.Code())
+	} else {
+		proto = "ICMP"
+		name = ICMPTypeToString(h.Type())
+		code = ICMPCodeToString(h.Type(), h.Code())
+	}
+
+	s := fmt.Sprintf("%s Type %d (%s)", proto, h.Type(), name)
+	if code != "" {
+		s += fmt.Sprintf(", Code %d (%s)", h.Code(), code)
+	}
+
+	return s
+}
+
+func icmpdebug(a ...interface{}) {
+	if true {
+		debug("debug-icmp:", a...)
+	}
+}
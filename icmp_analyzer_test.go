@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testICMPFrame(t, code uint8, id, seq uint16) *ICMPFrame {
+	frame, _ := NewICMPFrame([]byte{t, code, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq)})
+	return frame
+}
+
+func testICMPPacket(timestamp time.Time, src, dst string, icmpFrame *ICMPFrame) *Packet {
+	packet := testIPPacket(timestamp, src, dst)
+	packet.TransportType = TRANSPORT_TYPE_ICMP
+	packet.ICMP = icmpFrame
+
+	return packet
+}
+
+func TestICMPAnalyzerEchoPairing(t *testing.T) {
+	var out bytes.Buffer
+	a := NewICMPAnalyzer(&out)
+
+	client, server := "10.0.0.1", "10.0.0.2"
+	start := time.Unix(1440000000, 0)
+
+	a.NewPacket(testICMPPacket(start, client, server, testICMPFrame(ICMP_TYPE_ECHO_REQUEST, 0, 1, 1)))
+	a.NewPacket(testICMPPacket(start.Add(10*time.Millisecond), server, client, testICMPFrame(ICMP_TYPE_ECHO_REPLY, 0, 1, 1)))
+	a.NewPacket(testICMPPacket(start.Add(time.Second), client, server, testICMPFrame(ICMP_TYPE_ECHO_REQUEST, 0, 1, 2)))
+	a.NewPacket(testICMPPacket(start.Add(2*time.Second), client, server, testICMPFrame(ICMP_TYPE_ECHO_REQUEST, 0, 1, 3)))
+	a.NewPacket(testICMPPacket(start.Add(2*time.Second+30*time.Millisecond), server, client, testICMPFrame(ICMP_TYPE_ECHO_REPLY, 0, 1, 3)))
+	a.NewPacket(testICMPPacket(start.Add(3*time.Second), server, client, testICMPFrame(ICMP_TYPE_ECHO_REPLY, 0, 1, 99)))
+
+	s := a.destinations[netip.MustParseAddr(server)]
+	if s == nil {
+		t.Fatal("TestICMPAnalyzerEchoPairing: no stats for destination")
+	}
+
+	if s.Sent != 3 || s.Received != 2 {
+		t.Errorf("TestICMPAnalyzerEchoPairing sent/received mismatch, got: %d/%d, want 3/2", s.Sent, s.Received)
+	}
+
+	if s.RTTMin != 10*time.Millisecond || s.RTTMax != 30*time.Millisecond || s.RTTAvg() != 20*time.Millisecond {
+		t.Errorf("TestICMPAnalyzerEchoPairing rtt mismatch, got: %s/%s/%s", s.RTTMin, s.RTTAvg(), s.RTTMax)
+	}
+
+	if a.UnmatchedReplies != 1 {
+		t.Errorf("TestICMPAnalyzerEchoPairing unmatched replies mismatch, got: %d, want 1", a.UnmatchedReplies)
+	}
+}
+
+func TestICMPAnalyzerTimeout(t *testing.T) {
+	var out bytes.Buffer
+	a := NewICMPAnalyzer(&out)
+
+	client, server := "10.0.0.1", "10.0.0.2"
+	start := time.Unix(1440000000, 0)
+
+	a.NewPacket(testICMPPacket(start, client, server, testICMPFrame(ICMP_TYPE_ECHO_REQUEST, 0, 1, 1)))
+	a.NewPacket(testICMPPacket(start.Add(time.Second), server, client, testICMPFrame(ICMP_TYPE_DESTINATION_UNREACHABLE, 3, 0, 0)))
+	a.NewPacket(testICMPPacket(start.Add(11*time.Second), client, server, testICMPFrame(ICMP_TYPE_ECHO_REQUEST, 0, 1, 2)))
+
+	if len(a.pending) != 1 {
+		t.Errorf("TestICMPAnalyzerTimeout pending mismatch, got: %d, want 1", len(a.pending))
+	}
+
+	//
+	// reply after the timeout is not paired
+	//
+	a.NewPacket(testICMPPacket(start.Add(12*time.Second), server, client, testICMPFrame(ICMP_TYPE_ECHO_REPLY, 0, 1, 1)))
+
+	if a.UnmatchedReplies != 1 {
+		t.Errorf("TestICMPAnalyzerTimeout unmatched replies mismatch, got: %d, want 1", a.UnmatchedReplies)
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("TestICMPAnalyzerTimeout unexpected output, got: %q", out.String())
+	}
+}
+
+func TestICMPTypeCodeString(t *testing.T) {
+	cases := []struct {
+		t, code uint8
+		isV6    bool
+		want    string
+	}{
+		{ICMP_TYPE_ECHO_REQUEST, 0, false, "ICMP Type 8 (echo request)"},
+		{ICMP_TYPE_DESTINATION_UNREACHABLE, 3, false, "ICMP Type 3 (destination unreachable), Code 3 (port unreachable)"},
+		{ICMPV6_TYPE_ECHO_REPLY, 0, true, "ICMPv6 Type 129 (echo reply)"},
+		{ICMPV6_TYPE_TIME_EXCEEDED, 0, true, "ICMPv6 Type 3 (time exceeded), Code 0 (hop limit exceeded in transit)"},
+	}
+
+	for i, c := range cases {
+		got := icmpTypeCodeString(testICMPFrame(c.t, c.code, 0, 0).Header, c.isV6)
+		if got != c.want {
+			t.Errorf("TestICMPTypeCodeString[%d] mismatch, got: %q, want %q", i, got, c.want)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 )
 
 type TestICMPFrameHeaderResult struct {
-	Type     uint8
-	Code     uint8
-	Checksum uint16
-	Content  []byte
+	Type           uint8
+	Code           uint8
+	Checksum       uint16
+	Content        []byte
+	Identifier     uint16
+	SequenceNumber uint16
 }
 
 func TestICMPParsing(t *testing.T) {
@@ -22,10 +24,12 @@ func TestICMPParsing(t *testing.T) {
 			0x7d, 0x76, // Checksum
 			0x3b, 0x02, 0x00, 0x09, // Content
 		}, TestICMPFrameHeaderResult{
-			Type:     8,
-			Code:     0,
-			Checksum: 0x7d76,
-			Content:  []byte{0x3b, 0x02, 0x00, 0x09},
+			Type:           8,
+			Code:           0,
+			Checksum:       0x7d76,
+			Content:        []byte{0x3b, 0x02, 0x00, 0x09},
+			Identifier:     0x3b02,
+			SequenceNumber: 9,
 		}},
 	}
 
@@ -44,6 +48,14 @@ func TestICMPParsing(t *testing.T) {
 			t.Errorf("NewICMPFrameHeaderTest[%d].Checksum() mismatch, got: %d, want %d", i, got.Checksum(), c.want.Checksum)
 		}
 
+		if got.Identifier() != c.want.Identifier {
+			t.Errorf("NewICMPFrameHeaderTest[%d].Identifier() mismatch, got: %d, want %d", i, got.Identifier(), c.want.Identifier)
+		}
+
+		if got.SequenceNumber() != c.want.SequenceNumber {
+			t.Errorf("NewICMPFrameHeaderTest[%d].SequenceNumber() mismatch, got: %d, want %d", i, got.SequenceNumber(), c.want.SequenceNumber)
+		}
+
 		for i, contentPart := range got.Content() {
 			if contentPart != c.want.Content[i] {
 				t.Errorf("NewUDPFrameHeaderTest[%d].Content() mismatch, got: %d, want %d", i, got.Content(), c.want.Content)
@@ -36,6 +36,10 @@ type EnhancedPacketOptions struct {
 	Hash      *PacketHash
 	DropCount *uint64
 
+	// experimental
+	ProcessInfoIndex          *uint32
+	EffectiveProcessInfoIndex *uint32
+
 	Unsupported RawOptions
 }
 
@@ -225,7 +229,7 @@ func (s *Stream) newEnhancedPacketBlock(body []byte, totalLength uint32) (*Enhan
 	//
 	return &EnhancedPacketBlock{
 		totalLength:    totalLength,
-		Interface:    ifdb,
+		Interface:      ifdb,
 		InterfaceId:    interfaceId,
 		Timestamp:      timestamp(tsHigh, tsLow, ifdb),
 		CapturedLength: capLen,
@@ -258,6 +262,12 @@ func (s *Stream) parseEnhancedPacketOptions(rawOpts *RawOptions) (*EnhancedPacke
 		case OPTION_EPB_DROPCOUNT:
 			val := s.sectionHeader.ByteOrder.Uint64(va[0])
 			opts.DropCount = &val
+		case OPTION_EXP_EPB_PIB_INDEX:
+			val := s.sectionHeader.ByteOrder.Uint32(va[0])
+			opts.ProcessInfoIndex = &val
+		case OPTION_EXP_EPB_EFFECTIVE_PIB_INDEX:
+			val := s.sectionHeader.ByteOrder.Uint32(va[0])
+			opts.EffectiveProcessInfoIndex = &val
 		default:
 			opts.Unsupported[k] = va
 		}
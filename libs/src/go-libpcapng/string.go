@@ -62,8 +62,11 @@ func (o EnhancedPacketOptions) String() string {
     Flags:        %s
     Hash:         %s
     Drop count:   %s
+    PIB index:    %s
+    Eff. PIB idx: %s
     Unsupported:  %s
-  ]`, optValStr(o.Comment), optValStr(o.Flags), optValStr(o.Hash), optValStr(o.DropCount), unsupportedOpts(o.Unsupported))
+  ]`, optValStr(o.Comment), optValStr(o.Flags), optValStr(o.Hash), optValStr(o.DropCount),
+		optValStr(o.ProcessInfoIndex), optValStr(o.EffectiveProcessInfoIndex), unsupportedOpts(o.Unsupported))
 }
 
 func (f PacketFlags) String() string {
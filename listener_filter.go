@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// CaptureFilter matches packets by their capture metadata. Empty fields
+// match everything, so packets read from pcap files only pass filters
+// which leave the pcap-ng specific fields unset.
+type CaptureFilter struct {
+	InterfaceName string
+	Direction     PacketDirection
+	Process       string
+}
+
+func (f CaptureFilter) IsEmpty() bool {
+	return f.InterfaceName == "" && f.Direction == DIRECTION_UNKNOWN && f.Process == ""
+}
+
+func (f CaptureFilter) Match(c CaptureInfo) bool {
+	if f.InterfaceName != "" && f.InterfaceName != c.InterfaceName {
+		return false
+	}
+
+	if f.Direction != DIRECTION_UNKNOWN && f.Direction != c.Direction {
+		return false
+	}
+
+	if f.Process != "" {
+		if !c.HasProcess {
+			return false
+		}
+
+		if f.Process != c.ProcessName && f.Process != strconv.FormatUint(uint64(c.ProcessId), 10) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ParseDirection(s string) (PacketDirection, error) {
+	switch s {
+	case "":
+		return DIRECTION_UNKNOWN, nil
+	case "in", "inbound":
+		return DIRECTION_INBOUND, nil
+	case "out", "outbound":
+		return DIRECTION_OUTBOUND, nil
+	default:
+		return DIRECTION_UNKNOWN, errors.New("direction must be 'in' or 'out'.")
+	}
+}
+
+type FilterPacketListener struct {
+	filter         CaptureFilter
+	packetListener PacketListener
+}
+
+func (l FilterPacketListener) NewPacket(packet *Packet) {
+	if l.filter.Match(packet.Capture) {
+		l.packetListener.NewPacket(packet)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCaptureFilterMatch(t *testing.T) {
+	eth0In := CaptureInfo{InterfaceName: "eth0", Direction: DIRECTION_INBOUND}
+	curl := CaptureInfo{InterfaceName: "en0", Direction: DIRECTION_OUTBOUND, HasProcess: true, ProcessId: 42, ProcessName: "curl"}
+
+	cases := []struct {
+		filter CaptureFilter
+		in     CaptureInfo
+		want   bool
+	}{
+		{CaptureFilter{}, CaptureInfo{}, true},
+		{CaptureFilter{}, eth0In, true},
+		{CaptureFilter{InterfaceName: "eth0"}, eth0In, true},
+		{CaptureFilter{InterfaceName: "eth1"}, eth0In, false},
+		{CaptureFilter{Direction: DIRECTION_INBOUND}, eth0In, true},
+		{CaptureFilter{Direction: DIRECTION_OUTBOUND}, eth0In, false},
+		{CaptureFilter{Direction: DIRECTION_OUTBOUND}, CaptureInfo{}, false},
+		{CaptureFilter{Process: "curl"}, curl, true},
+		{CaptureFilter{Process: "42"}, curl, true},
+		{CaptureFilter{Process: "wget"}, curl, false},
+		{CaptureFilter{Process: "curl"}, eth0In, false},
+	}
+
+	for i, c := range cases {
+		got := c.filter.Match(c.in)
+		if got != c.want {
+			t.Errorf("TestCaptureFilterMatch[%d] mismatch, got: %t, want %t", i, got, c.want)
+		}
+	}
+}
+
+func TestCaptureInfoString(t *testing.T) {
+	cases := []struct {
+		in   CaptureInfo
+		want string
+	}{
+		{CaptureInfo{}, ""},
+		{CaptureInfo{InterfaceName: "eth0"}, "eth0"},
+		{CaptureInfo{InterfaceName: "eth0", Direction: DIRECTION_OUTBOUND}, "eth0 out"},
+		{CaptureInfo{Direction: DIRECTION_INBOUND}, "in"},
+		{CaptureInfo{InterfaceName: "en0", HasProcess: true, ProcessId: 42, ProcessName: "curl", Comment: "x"}, `en0, pid 42 (curl), comment: "x"`},
+	}
+
+	for i, c := range cases {
+		got := CaptureInfoString(c.in)
+		if got != c.want {
+			t.Errorf("TestCaptureInfoString[%d] mismatch, got: %q, want %q", i, got, c.want)
+		}
+	}
+}
@@ -12,8 +12,47 @@ func (mpl *MultiPacketListener) Add(pl PacketListener) {
 	mpl.PacketListeners = append(mpl.PacketListeners, pl)
 }
 
-func (mpl MultiPacketListener) NewPacket(timestamp time.Time, linkLayer, networkLayer, transportLayer interface{}) {
+func (mpl MultiPacketListener) NewPacket(packet *Packet) {
 	for _, pk := range mpl.PacketListeners {
-		pk.NewPacket(timestamp, linkLayer, networkLayer, transportLayer)
+		pk.NewPacket(packet)
+	}
+}
+
+// MultiTCPListener passes the events of a TCPStack to several listeners.
+type MultiTCPListener struct {
+	TCPListeners []TCPListener
+}
+
+func (mtl *MultiTCPListener) Add(l TCPListener) {
+	mtl.TCPListeners = append(mtl.TCPListeners, l)
+}
+
+func (mtl MultiTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	for _, l := range mtl.TCPListeners {
+		l.NewConnection(conn, timestamp)
+	}
+}
+
+func (mtl MultiTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	for _, l := range mtl.TCPListeners {
+		l.Data(conn, data, isClient, timestamps)
+	}
+}
+
+func (mtl MultiTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	for _, l := range mtl.TCPListeners {
+		l.Gap(conn, length, isClient, timestamp)
+	}
+}
+
+func (mtl MultiTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+	for _, l := range mtl.TCPListeners {
+		l.EndOfStream(conn, isClient, end, timestamp)
+	}
+}
+
+func (mtl MultiTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	for _, l := range mtl.TCPListeners {
+		l.ClosedConnection(conn, timestamp)
 	}
 }
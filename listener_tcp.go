@@ -1,20 +1,11 @@
 package main
 
-import (
-	"time"
-)
-
 type TCPPacketListener struct {
 	tcpStack *TCPStack
 }
 
-func (l *TCPPacketListener) NewPacket(timestamp time.Time, linkLayer, networkLayer, transportLayer interface{}) {
-	if transportLayer != nil {
-		switch transportLayer.(type) {
-		case *TCPFrame:
-			tcpFrame := transportLayer.(*TCPFrame)
-			nl := networkLayer
-			l.tcpStack.NewPacket(&nl, tcpFrame)
-		}
+func (l *TCPPacketListener) NewPacket(packet *Packet) {
+	if packet.TransportType == TRANSPORT_TYPE_TCP {
+		l.tcpStack.NewPacket(packet)
 	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+)
+
+const (
+	DEFAULT_SHARD_QUEUE_LENGTH = 1024
+)
+
+// ShardedTCPPacketListener spreads TCP packets over TCPStacks running on
+// their own goroutines. Both directions of a connection are sent to the
+// same shard, so packets of a connection are handled in capture order.
+// Listeners of the stacks must not share unsynchronized state.
+type ShardedTCPPacketListener struct {
+	shards []*TCPStack
+	queues []chan shardItem
+	wg     sync.WaitGroup
+}
+
+// shardItem is a packet for the stack of a shard, or a query run on the
+// goroutine of the shard.
+type shardItem struct {
+	packet *Packet
+	query  func(tcpStack *TCPStack)
+}
+
+func NewShardedTCPPacketListener(shards []*TCPStack, queueLength int) *ShardedTCPPacketListener {
+	l := &ShardedTCPPacketListener{
+		shards: shards,
+		queues: make([]chan shardItem, len(shards)),
+	}
+
+	for i, tcpStack := range shards {
+		queue := make(chan shardItem, queueLength)
+		l.queues[i] = queue
+
+		l.wg.Add(1)
+		go func(tcpStack *TCPStack) {
+			defer l.wg.Done()
+
+			for item := range queue {
+				if item.query != nil {
+					item.query(tcpStack)
+				} else {
+					tcpStack.NewPacket(item.packet)
+				}
+			}
+		}(tcpStack)
+	}
+
+	return l
+}
+
+func (l *ShardedTCPPacketListener) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_TCP {
+		return
+	}
+
+	l.queues[flowShard(packet, len(l.queues))] <- shardItem{packet: packet}
+}
+
+// Query runs fn for every shard on the goroutine of the shard, after the
+// packets queued before it, and waits until all have run. The stacks and
+// their listeners must only be read this way while packets are handled.
+// Not to be called after Close.
+func (l *ShardedTCPPacketListener) Query(fn func(shard int, tcpStack *TCPStack)) {
+	var wg sync.WaitGroup
+	wg.Add(len(l.queues))
+
+	for i, queue := range l.queues {
+		shard := i
+		queue <- shardItem{query: func(tcpStack *TCPStack) {
+			defer wg.Done()
+			fn(shard, tcpStack)
+		}}
+	}
+
+	wg.Wait()
+}
+
+// Close waits until the shards have handled all queued packets.
+func (l *ShardedTCPPacketListener) Close() {
+	for _, queue := range l.queues {
+		close(queue)
+	}
+
+	l.wg.Wait()
+}
+
+// flowShard hashes the endpoints of a packet independent of its direction.
+func flowShard(packet *Packet, n int) int {
+	if n == 1 {
+		return 0
+	}
+
+	a := packet.SourceAddrPort()
+	b := packet.DestinationAddrPort()
+	if b.Compare(a) < 0 {
+		a, b = b, a
+	}
+
+	h := hashAddrPort(FNV_OFFSET_BASIS_32, a)
+	h = hashAddrPort(h, b)
+
+	return int(h % uint32(n))
+}
+
+const (
+	FNV_OFFSET_BASIS_32 = 2166136261
+	FNV_PRIME_32        = 16777619
+)
+
+// hashAddrPort continues an FNV-1a hash, inlined to avoid allocating per
+// packet.
+func hashAddrPort(h uint32, ap netip.AddrPort) uint32 {
+	addr := ap.Addr().As16()
+	for _, b := range addr {
+		h = (h ^ uint32(b)) * FNV_PRIME_32
+	}
+
+	port := ap.Port()
+	h = (h ^ uint32(port>>8)) * FNV_PRIME_32
+	h = (h ^ uint32(port&0xff)) * FNV_PRIME_32
+
+	return h
+}
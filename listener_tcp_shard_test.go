@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testShardListener collects the data of all connections of all shards.
+type testShardListener struct {
+	mu   sync.Mutex
+	data map[TCPListenerConnection]*bytes.Buffer
+}
+
+func newTestShardListener() *testShardListener {
+	return &testShardListener{data: make(map[TCPListenerConnection]*bytes.Buffer)}
+}
+
+func (l *testShardListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.data[conn] = &bytes.Buffer{}
+}
+
+func (l *testShardListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.data[conn].Write(data)
+}
+
+func (l *testShardListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+}
+
+func (l *testShardListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+}
+
+func (l *testShardListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+}
+
+// benchShardListener checksums delivered data to simulate parsing work,
+// one per shard.
+type benchShardListener struct {
+	checksum uint32
+}
+
+func (l *benchShardListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+}
+
+func (l *benchShardListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	for i := 0; i < 8; i++ {
+		l.checksum = crc32.Update(l.checksum, crc32.IEEETable, data)
+	}
+}
+
+func (l *benchShardListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+}
+
+func (l *benchShardListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+}
+
+func (l *benchShardListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+}
+
+// testShardConversations interleaves the packets of conns connections,
+// each sending segments data segments in both directions.
+func testShardConversations(conns, segments, size int) []*Packet {
+	ts := time.Unix(1440000000, 0)
+	server := testTCPEndpoint{"10.0.0.2", 80}
+	payload := bytes.Repeat([]byte("x"), size)
+
+	perConn := make([][]*Packet, conns)
+	for i := range perConn {
+		client := testTCPEndpoint{fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), uint16(40000 + i)}
+		c, s := uint32(1000*i), uint32(5000*i)
+
+		packets := []*Packet{
+			testTCPPacket(ts, client, server, c, 0, testSYN, nil),
+			testTCPPacket(ts, server, client, s, c+1, testSYN|testACK, nil),
+			testTCPPacket(ts, client, server, c+1, s+1, testACK, nil),
+		}
+		c, s = c+1, s+1
+
+		for j := 0; j < segments; j++ {
+			packets = append(packets,
+				testTCPPacket(ts, client, server, c, s, testACK|testPSH, []byte(fmt.Sprintf("%d-%d;", i, j))),
+				testTCPPacket(ts, server, client, s, c, testACK|testPSH, payload),
+			)
+			c += uint32(len(fmt.Sprintf("%d-%d;", i, j)))
+			s += uint32(size)
+		}
+
+		packets = append(packets,
+			testTCPPacket(ts, client, server, c, s, testACK|testFIN, nil),
+			testTCPPacket(ts, server, client, s, c+1, testACK|testFIN, nil),
+		)
+
+		perConn[i] = packets
+	}
+
+	var all []*Packet
+	for j := 0; ; j++ {
+		added := false
+		for _, packets := range perConn {
+			if j < len(packets) {
+				all = append(all, packets[j])
+				added = true
+			}
+		}
+
+		if !added {
+			return all
+		}
+	}
+}
+
+func TestShardedTCPPacketListener(t *testing.T) {
+	packets := testShardConversations(50, 10, 16)
+
+	want := newTestShardListener()
+	tcpStack := NewTCPStack(want)
+	for _, packet := range packets {
+		tcpStack.NewPacket(packet)
+	}
+
+	for _, shards := range []int{1, 2, 7} {
+		got := newTestShardListener()
+
+		tcpStacks := make([]*TCPStack, shards)
+		for i := range tcpStacks {
+			tcpStacks[i] = NewTCPStack(got)
+		}
+
+		l := NewShardedTCPPacketListener(tcpStacks, DEFAULT_SHARD_QUEUE_LENGTH)
+		for _, packet := range packets {
+			l.NewPacket(packet)
+		}
+		l.Close()
+
+		if len(got.data) != len(want.data) {
+			t.Errorf("TestShardedTCPPacketListener[%d] connections mismatch, got: %d, want %d", shards, len(got.data), len(want.data))
+			continue
+		}
+
+		for conn, data := range want.data {
+			if !bytes.Equal(got.data[conn].Bytes(), data.Bytes()) {
+				t.Errorf("TestShardedTCPPacketListener[%d] data mismatch for %v, got: %q, want %q", shards, conn, got.data[conn].Bytes(), data.Bytes())
+			}
+		}
+
+		for i, tcpStack := range tcpStacks {
+			if len(tcpStack.connections) != 0 {
+				t.Errorf("TestShardedTCPPacketListener[%d] shard %d has %d flows left", shards, i, len(tcpStack.connections))
+			}
+		}
+	}
+}
+
+func TestFlowShard(t *testing.T) {
+	for _, packet := range testShardConversations(20, 1, 1) {
+		reply := testTCPPacket(packet.Timestamp(),
+			testTCPEndpoint{AddressToString(packet.DestinationAddress()), packet.DestinationPort()},
+			testTCPEndpoint{AddressToString(packet.SourceAddress()), packet.SourcePort()},
+			0, 0, testACK, nil)
+
+		if a, b := flowShard(packet, 8), flowShard(reply, 8); a != b {
+			t.Errorf("TestFlowShard directions of %s -> %s in different shards: %d, %d",
+				packet.SourceAddrPort(), packet.DestinationAddrPort(), a, b)
+		}
+	}
+}
+
+func benchmarkShards(b *testing.B, shards int, packets []*Packet) {
+	var total int64
+	for _, packet := range packets {
+		total += int64(len(packet.TCP.Payload))
+	}
+	b.SetBytes(total)
+	b.ReportAllocs()
+
+	for n := 0; n < b.N; n++ {
+		tcpStacks := make([]*TCPStack, shards)
+		for i := range tcpStacks {
+			tcpStacks[i] = NewTCPStack(&benchShardListener{})
+		}
+
+		l := NewShardedTCPPacketListener(tcpStacks, DEFAULT_SHARD_QUEUE_LENGTH)
+		for _, packet := range packets {
+			l.NewPacket(packet)
+		}
+		l.Close()
+	}
+}
+
+func BenchmarkShardedTCPPacketListener(b *testing.B) {
+	packets := testShardConversations(512, 32, 1400)
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			benchmarkShards(b, shards, packets)
+		})
+	}
+}
+
+// BenchmarkShardedReadStream reads the capture file named by
+// HTTPDUMP_BENCH_PCAP, decoding on the benchmark goroutine and reassembling
+// on the shards.
+func BenchmarkShardedReadStream(b *testing.B) {
+	file := os.Getenv("HTTPDUMP_BENCH_PCAP")
+	if file == "" {
+		b.Skip("HTTPDUMP_BENCH_PCAP not set")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+
+			for n := 0; n < b.N; n++ {
+				tcpStacks := make([]*TCPStack, shards)
+				for i := range tcpStacks {
+					tcpStacks[i] = NewTCPStack(&benchShardListener{})
+				}
+
+				l := NewShardedTCPPacketListener(tcpStacks, DEFAULT_SHARD_QUEUE_LENGTH)
+				readStream(bytes.NewReader(data), l)
+				l.Close()
+			}
+		})
+	}
+}
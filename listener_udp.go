@@ -0,0 +1,82 @@
+package main
+
+import (
+	"time"
+)
+
+// UDPDispatcher passes each UDP flow to the decoder registered for its
+// server port, or else for the protocol detected from its first datagram.
+// Flows without a decoder go to Default when set.
+type UDPDispatcher struct {
+	ports     map[uint16]UDPListener
+	protocols map[string]UDPListener
+	Default   UDPListener
+
+	// decoder chosen for each flow, nil when there is none
+	flows map[UDPListenerConnection]UDPListener
+}
+
+func NewUDPDispatcher() *UDPDispatcher {
+	return &UDPDispatcher{
+		ports:     make(map[uint16]UDPListener),
+		protocols: make(map[string]UDPListener),
+		flows:     make(map[UDPListenerConnection]UDPListener),
+	}
+}
+
+// HandlePort registers a decoder for flows to a server port.
+func (d *UDPDispatcher) HandlePort(port uint16, l UDPListener) {
+	d.ports[port] = l
+}
+
+// HandleProtocol registers a decoder for flows of a protocol returned by
+// DetectUDPProtocol.
+func (d *UDPDispatcher) HandleProtocol(protocol string, l UDPListener) {
+	d.protocols[protocol] = l
+}
+
+func (d *UDPDispatcher) NewFlow(conn UDPListenerConnection, timestamp time.Time) {
+	//
+	// the decoder is chosen with the first datagram
+	//
+}
+
+func (d *UDPDispatcher) Datagram(conn UDPListenerConnection, payload []byte, isClient bool, timestamp time.Time) {
+	l, ok := d.flows[conn]
+	if !ok {
+		l = d.listener(conn, payload)
+		d.flows[conn] = l
+
+		if l != nil {
+			l.NewFlow(conn, timestamp)
+		}
+	}
+
+	if l != nil {
+		l.Datagram(conn, payload, isClient, timestamp)
+	}
+}
+
+func (d *UDPDispatcher) ClosedFlow(conn UDPListenerConnection, timestamp time.Time) {
+	l, ok := d.flows[conn]
+	if !ok {
+		return
+	}
+	delete(d.flows, conn)
+
+	if l != nil {
+		l.ClosedFlow(conn, timestamp)
+	}
+}
+
+func (d *UDPDispatcher) listener(conn UDPListenerConnection, payload []byte) UDPListener {
+	if l, ok := d.ports[conn.ServerPort]; ok {
+		return l
+	}
+
+	if l, ok := d.protocols[DetectUDPProtocol(conn.ServerPort, payload)]; ok {
+		return l
+	}
+
+	return d.Default
+}
@@ -8,8 +8,10 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var payloadMaxLength int = 1024 * 2
@@ -20,19 +22,79 @@ func main() {
 	var cmd *exec.Cmd
 
 	var flagPrintPackets bool
+	var flagICMP bool
+	var flagAnomalies bool
+	var flagAnomalyTimeout time.Duration
+	var flagAnomalySYNFlood int
+	var flagAnomalyRSTStorm int
+	var flagAnomalyPortScan int
+	var flagPickup bool
+	var flagTCPSummary bool
+	var flagShards int
+	var flagExportDir string
+	var flagExportInterleaved bool
+	var flagConversations string
+	var flagFollow string
+	var flagHexDump bool
+	var flagSearch string
+	var flagSearchHex bool
+	var flagSearchIgnoreCase bool
+	var flagSearchContext int
+	var flagFollowFormat string
+	var flagConversationsSort string
 	var flagDebug bool
 	var flagPayloadMaxLength int
 	var flagFile string
 	var flagInterface string
+	var flagOverlap string
+	var flagGapTimeout time.Duration
+	var flagGapBuffer int
+	var flagIdleTimeout time.Duration
+	var flagUDPIdleTimeout time.Duration
+	var flagConnBuffer int
+	var flagTotalBuffer int
+	var flagFilterInterface string
+	var flagFilterDirection string
+	var flagFilterProcess string
 
 	//
 	// setup flags
 	//
 	flag.BoolVar(&flagPrintPackets, "print-packets", false, "")
+	flag.BoolVar(&flagICMP, "icmp", false, "")
+	flag.BoolVar(&flagAnomalies, "anomalies", false, "")
+	flag.DurationVar(&flagAnomalyTimeout, "anomaly-timeout", DEFAULT_ANOMALY_HANDSHAKE_TIMEOUT, "")
+	flag.IntVar(&flagAnomalySYNFlood, "anomaly-syn-flood", DEFAULT_ANOMALY_SYN_FLOOD, "")
+	flag.IntVar(&flagAnomalyRSTStorm, "anomaly-rst-storm", DEFAULT_ANOMALY_RST_STORM, "")
+	flag.IntVar(&flagAnomalyPortScan, "anomaly-port-scan", DEFAULT_ANOMALY_PORT_SCAN, "")
+	flag.BoolVar(&flagPickup, "pickup", false, "")
+	flag.BoolVar(&flagTCPSummary, "tcp-summary", false, "")
+	flag.IntVar(&flagShards, "shards", 1, "")
+	flag.StringVar(&flagExportDir, "export-dir", "", "")
+	flag.BoolVar(&flagExportInterleaved, "export-interleaved", false, "")
+	flag.StringVar(&flagConversations, "conversations", "", "")
+	flag.StringVar(&flagFollow, "follow", "", "")
+	flag.BoolVar(&flagHexDump, "hexdump", false, "")
+	flag.StringVar(&flagSearch, "search", "", "")
+	flag.BoolVar(&flagSearchHex, "search-hex", false, "")
+	flag.BoolVar(&flagSearchIgnoreCase, "search-i", false, "")
+	flag.IntVar(&flagSearchContext, "search-context", DEFAULT_SEARCH_CONTEXT, "")
+	flag.StringVar(&flagFollowFormat, "follow-format", "ascii", "")
+	flag.StringVar(&flagConversationsSort, "conversations-sort", "start", "")
 	flag.BoolVar(&flagDebug, "debug", false, "")
 	flag.IntVar(&flagPayloadMaxLength, "payload-len", 1024*2, "")
 	flag.StringVar(&flagFile, "r", "", "")
 	flag.StringVar(&flagInterface, "i", "", "")
+	flag.StringVar(&flagOverlap, "overlap", "first", "")
+	flag.DurationVar(&flagGapTimeout, "gap-timeout", DEFAULT_GAP_TIMEOUT, "")
+	flag.IntVar(&flagGapBuffer, "gap-buffer", DEFAULT_GAP_BUFFER_THRESHOLD, "")
+	flag.DurationVar(&flagIdleTimeout, "idle-timeout", DEFAULT_IDLE_TIMEOUT, "")
+	flag.DurationVar(&flagUDPIdleTimeout, "udp-idle-timeout", DEFAULT_UDP_IDLE_TIMEOUT, "")
+	flag.IntVar(&flagConnBuffer, "conn-buffer", DEFAULT_CONNECTION_BUFFER_LIMIT, "")
+	flag.IntVar(&flagTotalBuffer, "total-buffer", DEFAULT_BUFFER_LIMIT, "")
+	flag.StringVar(&flagFilterInterface, "filter-interface", "", "")
+	flag.StringVar(&flagFilterDirection, "filter-direction", "", "")
+	flag.StringVar(&flagFilterProcess, "filter-process", "", "")
 
 	flag.Usage = func() {
 		os.Stderr.WriteString(fmt.Sprintf("Usage: %s [expression]:\n", os.Args[0]))
@@ -42,8 +104,38 @@ func main() {
 		os.Stderr.WriteString("  -i <interface>. Listen on interface. Passed to tcpdump.\n")
 		os.Stderr.WriteString("  -r <file>. Read packets from file.\n")
 		os.Stderr.WriteString("  -payload-len <len>: Limit printed HTTP payload length to len bytes. [default 2048].\n")
+		os.Stderr.WriteString("  -hexdump: Print the data of TCP connections which are not HTTP as hexdump, limited by -payload-len.\n")
+		os.Stderr.WriteString("  -pickup: Pick up connections already in progress when capture starts.\n")
+		os.Stderr.WriteString("  -tcp-summary: Print RTT, retransmission and window metrics of every TCP connection when it closes.\n")
+		os.Stderr.WriteString("  -shards <n>: Reassemble TCP on n goroutines, connections are spread by address. [default 1].\n")
+		os.Stderr.WriteString("  -export-dir <dir>: Write the data of every TCP connection to files in dir, one per direction.\n")
+		os.Stderr.WriteString("  -export-interleaved: Write both directions of a connection to one file with direction markers.\n")
+		os.Stderr.WriteString("  -follow <stream|ip:port,ip:port>: Print only the data of one TCP stream, by index or by its endpoints.\n")
+		os.Stderr.WriteString("  -follow-format <ascii|hex|raw>: Format of the followed stream. [default ascii].\n")
+		os.Stderr.WriteString("  -search <regex>: Print matches of regex in TCP streams and UDP payloads instead of HTTP.\n")
+		os.Stderr.WriteString("  -search-hex: The -search pattern is bytes in hex, e.g. \"16 03 01\".\n")
+		os.Stderr.WriteString("  -search-i: Search case-insensitive.\n")
+		os.Stderr.WriteString("  -search-context <bytes>: Bytes printed around a match. [default 32].\n")
+		os.Stderr.WriteString("  -conversations <table|csv>: Print TCP and UDP conversations at exit.\n")
+		os.Stderr.WriteString("  -conversations-sort <start|bytes|packets|duration>: Order of the conversations. [default start].\n")
+		os.Stderr.WriteString("  -overlap <first|last>: Which copy of overlapping TCP data wins. [default first].\n")
+		os.Stderr.WriteString("  -gap-timeout <duration>: Skip data lost from a TCP stream after waiting for it this long in capture time, 0 to wait forever. [default 10s].\n")
+		os.Stderr.WriteString("  -gap-buffer <bytes>: Skip data lost from a TCP stream once this many bytes are buffered behind it, 0 for no limit. [default 4194304].\n")
+		os.Stderr.WriteString("  -idle-timeout <duration>: Drop TCP connections without packets for this long in capture time, 0 to keep forever. [default 5m].\n")
+		os.Stderr.WriteString("  -udp-idle-timeout <duration>: End UDP flows without datagrams for this long in capture time, 0 to keep forever. [default 1m].\n")
+		os.Stderr.WriteString("  -conn-buffer <bytes>: Drop TCP connections with more out-of-order data buffered, 0 for no limit. [default 16777216].\n")
+		os.Stderr.WriteString("  -total-buffer <bytes>: Drop least recently active TCP connections while all buffered data exceeds this, 0 for no limit. [default 268435456].\n")
+		os.Stderr.WriteString("  -icmp: Pair ICMP echo requests and replies, print round-trip statistics at exit.\n")
+		os.Stderr.WriteString("  -anomalies: Report refused and failed TCP handshakes, SYN floods, RST storms and port scans.\n")
+		os.Stderr.WriteString("  -anomaly-timeout <duration>: Report TCP handshakes not completed within duration, 0 to disable. [default 3s].\n")
+		os.Stderr.WriteString("  -anomaly-syn-flood <n>: Report n SYNs to one address and port within a second, 0 to disable. [default 100].\n")
+		os.Stderr.WriteString("  -anomaly-rst-storm <n>: Report n RSTs from one address within a second, 0 to disable. [default 100].\n")
+		os.Stderr.WriteString("  -anomaly-port-scan <n>: Report n ports of one address opened by one source within 10s, 0 to disable. [default 20].\n")
 		os.Stderr.WriteString("  -debug: Print debug output.\n")
-		os.Stderr.WriteString("  -print-packets: Print all packets.\n\n")
+		os.Stderr.WriteString("  -print-packets: Print all packets.\n")
+		os.Stderr.WriteString("  -filter-interface <name>: Only handle packets captured on interface (pcap-ng).\n")
+		os.Stderr.WriteString("  -filter-direction <in|out>: Only handle packets of given direction (pcap-ng).\n")
+		os.Stderr.WriteString("  -filter-process <name|pid>: Only handle packets of given process (pcap-ng).\n\n")
 		os.Stderr.WriteString("\n")
 		os.Stderr.WriteString("Example:\n")
 		os.Stderr.WriteString(fmt.Sprintf("%s -i eth0 host example.com and port 80\n", os.Args[0]))
@@ -58,22 +150,192 @@ func main() {
 	logDebug = flagDebug
 	payloadMaxLength = flagPayloadMaxLength
 
+	direction, err := ParseDirection(flagFilterDirection)
+	if err != nil {
+		fatal("-filter-direction:", err)
+	}
+
+	overlapPolicy, err := ParseOverlapPolicy(flagOverlap)
+	if err != nil {
+		fatal("-overlap:", err)
+	}
+
+	conversationOrder, err := ParseConversationOrder(flagConversationsSort)
+	if err != nil {
+		fatal("-conversations-sort:", err)
+	}
+
+	if flagConversations != "" && flagConversations != "table" && flagConversations != "csv" {
+		fatal("-conversations: must be 'table' or 'csv'.")
+	}
+
+	if flagAnomalyTimeout < 0 {
+		fatal("-anomaly-timeout: must not be negative.")
+	}
+
+	var follower *FollowTCPListener
+	if flagFollow != "" {
+		followFilter, err := ParseTCPFollowFilter(flagFollow)
+		if err != nil {
+			fatal("-follow:", err)
+		}
+
+		followFormat, err := ParseFollowFormat(flagFollowFormat)
+		if err != nil {
+			fatal("-follow-format:", err)
+		}
+
+		follower = NewFollowTCPListener(os.Stdout, followFilter, followFormat)
+	}
+
+	var searcher *StreamSearcher
+	if flagSearch != "" {
+		pattern, err := NewSearchPattern(flagSearch, flagSearchHex, flagSearchIgnoreCase)
+		if err != nil {
+			fatal("-search:", err)
+		}
+
+		searcher = NewStreamSearcher(os.Stdout, pattern)
+		searcher.Context = flagSearchContext
+	}
+
+	captureFilter := CaptureFilter{
+		InterfaceName: flagFilterInterface,
+		Direction:     direction,
+		Process:       flagFilterProcess,
+	}
+
+	//
+	// streams are numbered before anything else sees the packets
+	//
+	streamIndexer := NewTCPStreamIndexer()
+	streamIndexer.IdleTimeout = flagIdleTimeout
+
 	mpl := MultiPacketListener{}
+	mpl.Add(streamIndexer)
 	if logPackets {
 		mpl.Add(LoggingPacketListener{os.Stdout})
 	}
 
-	htl := NewHTTPTcpListener()
-	tcpStack := NewTCPStack(htl)
-	tsl := TCPPacketListener{tcpStack}
-	mpl.Add(&tsl)
+	var icmpAnalyzer *ICMPAnalyzer
+	if flagICMP {
+		icmpAnalyzer = NewICMPAnalyzer(os.Stdout)
+		mpl.Add(icmpAnalyzer)
+	}
+
+	var anomalyAnalyzer *TCPAnomalyAnalyzer
+	if flagAnomalies {
+		thresholds := DefaultAnomalyThresholds()
+		thresholds.HandshakeTimeout = flagAnomalyTimeout
+		thresholds.SYNFlood = flagAnomalySYNFlood
+		thresholds.RSTStorm = flagAnomalyRSTStorm
+		thresholds.PortScan = flagAnomalyPortScan
+
+		anomalyAnalyzer = NewTCPAnomalyAnalyzer(os.Stdout, thresholds)
+		mpl.Add(anomalyAnalyzer)
+	}
+
+	if searcher != nil {
+		mpl.Add(searcher)
+	}
+
+	var conversations *ConversationTable
+	if flagConversations != "" {
+		conversations = NewConversationTable()
+	}
+
+	//
+	// udp flows are tracked when something needs them
+	//
+	var udpStack *UDPStack
+	if conversations != nil {
+		udpStack = NewUDPStack(NewUDPDispatcher())
+		udpStack.IdleTimeout = flagUDPIdleTimeout
+		udpStack.Conversations = conversations
+		mpl.Add(udpStack)
+	}
+
+	if flagShards < 1 {
+		fatal("-shards: must be at least 1.")
+	}
+
+	if flagExportDir != "" {
+		if fi, err := os.Stat(flagExportDir); err != nil {
+			fatal("-export-dir:", err)
+		} else if !fi.IsDir() {
+			fatal("-export-dir: not a directory:", flagExportDir)
+		}
+	}
+
+	//
+	// every shard has its own http listener, connections never move
+	// between shards
+	//
+	htls := make([]*HttpTCPListener, flagShards)
+	tcpStacks := make([]*TCPStack, flagShards)
+	exporters := make([]*ExportTCPListener, 0, flagShards)
+
+	for i := range tcpStacks {
+		htls[i] = NewHTTPTcpListener(os.Stdout)
+		if flagHexDump {
+			htls[i].Fallback = NewHexDumpTCPListener(os.Stdout, payloadMaxLength)
+		}
+
+		//
+		// a followed stream or search results replace the http output
+		//
+		tcpListeners := MultiTCPListener{}
+		if follower != nil {
+			tcpListeners.Add(follower)
+		}
+		if searcher != nil {
+			tcpListeners.Add(searcher)
+		}
+		if follower == nil && searcher == nil {
+			tcpListeners.Add(htls[i])
+		}
+
+		if flagExportDir != "" {
+			exporter := NewExportTCPListener(flagExportDir)
+			exporter.Interleaved = flagExportInterleaved
+			exporters = append(exporters, exporter)
+
+			tcpListeners.Add(exporter)
+		}
+
+		tcpStack := NewTCPStack(tcpListeners)
+		tcpStack.MidStreamPickup = flagPickup
+		tcpStack.OverlapPolicy = overlapPolicy
+		tcpStack.GapTimeout = flagGapTimeout
+		tcpStack.GapBufferThreshold = flagGapBuffer
+		tcpStack.IdleTimeout = flagIdleTimeout
+		tcpStack.ConnectionBufferLimit = flagConnBuffer
+		tcpStack.BufferLimit = flagTotalBuffer
+		if flagTCPSummary {
+			tcpStack.SummaryWriter = os.Stdout
+		}
+		tcpStack.Conversations = conversations
+
+		tcpStacks[i] = tcpStack
+	}
+
+	//
+	// the debug monitor reads the stacks through the shard goroutines
+	//
+	var stl *ShardedTCPPacketListener
+	if flagShards == 1 && !logDebug {
+		mpl.Add(&TCPPacketListener{tcpStacks[0]})
+	} else {
+		stl = NewShardedTCPPacketListener(tcpStacks, DEFAULT_SHARD_QUEUE_LENGTH)
+		mpl.Add(stl)
+	}
 
 	//
 	// init debug monitor
 	//
 	var monitor *Monitor
 	if logDebug {
-		monitor = NewMonitor(tcpStack, htl)
+		monitor = NewMonitor(os.Stdout, stl, htls)
 		go monitor.RunPeriodic()
 	}
 
@@ -135,8 +397,32 @@ func main() {
 	//
 	// Run
 	//
-	err := readStream(r, mpl)
-	if err != nil {
+	var packetListener PacketListener = mpl
+	if !captureFilter.IsEmpty() {
+		packetListener = FilterPacketListener{captureFilter, mpl}
+	}
+
+	//
+	// stop reading on SIGINT/SIGTERM and flush what was captured like at
+	// the end of a file, a second signal exits at once
+	//
+	input := NewStoppableReader(r)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		maindebug("stopping on signal", sig)
+
+		input.Stop()
+		if cmd != nil {
+			cmd.Process.Signal(syscall.SIGTERM)
+		}
+	}()
+
+	err = readStream(input, packetListener)
+	if err != nil && !input.Stopped() {
 		switch err {
 		case io.EOF:
 			// OK
@@ -156,8 +442,37 @@ func main() {
 		monitor.Close()
 	}
 
-	for _, v := range htl.conns {
-		v.Close()
+	if stl != nil {
+		stl.Close()
+	}
+
+	for _, tcpStack := range tcpStacks {
+		tcpStack.Close()
+	}
+
+	for _, exporter := range exporters {
+		exporter.Close()
+	}
+
+	if icmpAnalyzer != nil {
+		icmpAnalyzer.WriteReport(os.Stdout)
+	}
+
+	if anomalyAnalyzer != nil {
+		anomalyAnalyzer.Close()
+		anomalyAnalyzer.WriteReport(os.Stdout)
+	}
+
+	if udpStack != nil {
+		udpStack.Close()
+	}
+
+	if conversations != nil {
+		if flagConversations == "csv" {
+			conversations.WriteCSV(os.Stdout, conversationOrder)
+		} else {
+			conversations.WriteTable(os.Stdout, conversationOrder)
+		}
 	}
 
 	if cmd != nil {
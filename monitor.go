@@ -1,33 +1,43 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"runtime"
 	"time"
 )
 
+// Monitor prints the counters of the TCP stacks and HTTP listeners
+// periodically. They are read on the goroutines of the shards, so that
+// packets can be handled meanwhile.
 type Monitor struct {
-	stop chan bool
+	writer io.Writer
+	stop   chan bool
 
-	tcpStack     *TCPStack
-	httpListener *HttpTCPListener
+	shards        *ShardedTCPPacketListener
+	httpListeners []*HttpTCPListener
 }
 
-func NewMonitor(tcpStack *TCPStack, httpListener *HttpTCPListener) *Monitor {
+// NewMonitor creates a monitor of shards, httpListeners are the HTTP
+// listeners of the shards by shard index.
+func NewMonitor(writer io.Writer, shards *ShardedTCPPacketListener, httpListeners []*HttpTCPListener) *Monitor {
 	return &Monitor{
-		tcpStack:     tcpStack,
-		httpListener: httpListener,
-		stop:         make(chan bool),
+		writer:        writer,
+		shards:        shards,
+		httpListeners: httpListeners,
+		stop:          make(chan bool),
 	}
 }
 
 func (m *Monitor) RunPeriodic() {
 	ticker := time.NewTicker(10 * time.Second)
 
+loop:
 	for {
 		select {
 		case <-m.stop:
-			break
+			break loop
 		case <-ticker.C:
 			m.WriteStats()
 		}
@@ -38,20 +48,71 @@ func (m *Monitor) RunPeriodic() {
 }
 
 func (m *Monitor) WriteStats() {
-	tcpStackTotal := 0
+	snapshots := make([]TCPStackSnapshot, len(m.httpListeners))
+	httpConnections := make([]int, len(m.httpListeners))
+
+	m.shards.Query(func(shard int, tcpStack *TCPStack) {
+		snapshots[shard] = tcpStack.Snapshot()
+		httpConnections[shard] = len(m.httpListeners[shard].conns)
+	})
+
+	var out bytes.Buffer
 	httpListenerTotal := 0
 
-	for range m.tcpStack.connections {
-		tcpStackTotal += 1
+	for i, snapshot := range snapshots {
+		prefix := "tcp stack"
+		if len(snapshots) > 1 {
+			prefix = fmt.Sprintf("tcp stack %d", i)
+		}
+
+		writeTCPStackStats(&out, prefix, snapshot)
+		httpListenerTotal += httpConnections[i]
 	}
 
-	for range m.httpListener.conns {
-		httpListenerTotal += 1
+	fmt.Fprintln(&out, "http listener total connections:", httpListenerTotal)
+	fmt.Fprintln(&out, "num of goroutines:", runtime.NumGoroutine())
+
+	m.writer.Write(out.Bytes())
+}
+
+// TCPStackSnapshot is a copy of the counters of a TCPStack.
+type TCPStackSnapshot struct {
+	Connections   int
+	BufferedBytes int
+
+	Stats     ReassemblyStats
+	Evictions EvictionStats
+	Totals    MetricsTotals
+}
+
+// Snapshot copies the counters of the stack, it must be called on the
+// goroutine which handles the packets of the stack.
+func (tcpStack *TCPStack) Snapshot() TCPStackSnapshot {
+	return TCPStackSnapshot{
+		Connections:   len(tcpStack.connections),
+		BufferedBytes: tcpStack.bufferedBytes,
+		Stats:         tcpStack.Stats,
+		Evictions:     tcpStack.Evictions,
+		Totals:        tcpStack.Totals,
 	}
+}
 
-	fmt.Println("tcp stack total connections:", tcpStackTotal)
-	fmt.Println("http listener total connections:", httpListenerTotal)
-	fmt.Println("num of goroutines:", runtime.NumGoroutine())
+func writeTCPStackStats(out io.Writer, prefix string, s TCPStackSnapshot) {
+	fmt.Fprintln(out, prefix+" total connections:", s.Connections)
+	fmt.Fprintln(out, prefix+" retransmissions:", s.Stats.Retransmissions)
+	fmt.Fprintln(out, prefix+" overlaps:", s.Stats.Overlaps)
+	fmt.Fprintln(out, prefix+" inconsistent retransmissions:", s.Stats.Inconsistencies)
+	fmt.Fprintln(out, prefix+" skipped gaps:", s.Stats.Gaps, "bytes:", s.Stats.GapBytes)
+	fmt.Fprintln(out, prefix+" buffered bytes:", s.BufferedBytes)
+	fmt.Fprintln(out, prefix+" idle evictions:", s.Evictions.Idle)
+	fmt.Fprintln(out, prefix+" connection buffer limit evictions:", s.Evictions.ConnectionLimit)
+	fmt.Fprintln(out, prefix+" global buffer limit evictions:", s.Evictions.GlobalLimit)
+	fmt.Fprintln(out, prefix+" connections closed by port reuse:", s.Evictions.Reused)
+	fmt.Fprintln(out, prefix+" closed connections:", s.Totals.Connections)
+	fmt.Fprintln(out, prefix+" avg handshake rtt:", s.Totals.HandshakeRTTAvg())
+	fmt.Fprintln(out, prefix+" packets:", s.Totals.Packets, "bytes:", s.Totals.Bytes)
+	fmt.Fprintln(out, prefix+" duplicate acks:", s.Totals.DuplicateACKs)
+	fmt.Fprintln(out, prefix+" zero windows:", s.Totals.ZeroWindows)
 }
 
 func (m *Monitor) Close() {
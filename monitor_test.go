@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMonitor(t *testing.T) {
+	packets := testShardConversations(50, 10, 16)
+
+	tcpStacks := make([]*TCPStack, 3)
+	htls := make([]*HttpTCPListener, len(tcpStacks))
+	for i := range tcpStacks {
+		htls[i] = NewHTTPTcpListener(&testSyncBuffer{})
+		tcpStacks[i] = NewTCPStack(htls[i])
+	}
+
+	l := NewShardedTCPPacketListener(tcpStacks, DEFAULT_SHARD_QUEUE_LENGTH)
+
+	var out bytes.Buffer
+	m := NewMonitor(&out, l, htls)
+
+	//
+	// stats are read while the shards handle packets
+	//
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for _, packet := range packets {
+			l.NewPacket(packet)
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		m.WriteStats()
+	}
+	wg.Wait()
+
+	out.Reset()
+	m.WriteStats()
+	l.Close()
+
+	for _, w := range []string{"tcp stack 0 total connections: 0\n", "tcp stack 2 closed connections:", "http listener total connections: 0\n"} {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("TestMonitor mismatch, got: %q, want it to contain %q", out.String(), w)
+		}
+	}
+
+	var closed uint64
+	for _, tcpStack := range tcpStacks {
+		closed += tcpStack.Totals.Connections
+	}
+	if closed != 50 {
+		t.Errorf("TestMonitor closed connections mismatch, got: %d, want %d", closed, 50)
+	}
+}
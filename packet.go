@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+)
+
+type LinkType uint8
+
+const (
+	LINK_TYPE_UNKNOWN LinkType = iota
+	LINK_TYPE_ETHERNET
+	LINK_TYPE_NULL
+)
+
+type NetworkType uint8
+
+const (
+	NETWORK_TYPE_UNKNOWN NetworkType = iota
+	NETWORK_TYPE_IPV4
+	NETWORK_TYPE_IPV6
+)
+
+type TransportType uint8
+
+const (
+	TRANSPORT_TYPE_UNKNOWN TransportType = iota
+	TRANSPORT_TYPE_TCP
+	TRANSPORT_TYPE_UDP
+	TRANSPORT_TYPE_ICMP
+)
+
+type PacketDirection uint8
+
+const (
+	DIRECTION_UNKNOWN PacketDirection = iota
+	DIRECTION_INBOUND
+	DIRECTION_OUTBOUND
+)
+
+// CaptureInfo holds the per-packet metadata of the capture file. Only
+// pcap-ng files carry more than the timestamp and the lengths, other
+// fields are left empty for pcap files.
+type CaptureInfo struct {
+	Timestamp      time.Time
+	CapturedLength uint32
+	OriginalLength uint32
+
+	InterfaceId          uint32
+	InterfaceName        string
+	InterfaceDescription string
+
+	Direction PacketDirection
+	Comment   string
+
+	HashAlgorithm string
+	Hash          []byte
+
+	HasProcess  bool
+	ProcessId   uint32
+	ProcessName string
+}
+
+// Packet is a decoded captured packet. Layers which are not present or
+// not supported are left nil and reported as *_TYPE_UNKNOWN.
+type Packet struct {
+	Capture CaptureInfo
+
+	LinkType      LinkType
+	NetworkType   NetworkType
+	TransportType TransportType
+
+	// IP protocol number, valid when NetworkType is known
+	Protocol uint8
+
+	Ethernet *EthernetFrame
+	Null     *NullFrame
+
+	IPv4 *IPv4Frame
+	IPv6 *IPv6Frame
+
+	TCP  *TCPFrame
+	UDP  *UDPFrame
+	ICMP *ICMPFrame
+
+	// index of the TCP connection, set by TCPStreamIndexer
+	TCPStream uint64
+}
+
+func (p *Packet) Timestamp() time.Time {
+	return p.Capture.Timestamp
+}
+
+func (p *Packet) SourceAddress() netip.Addr {
+	switch p.NetworkType {
+	case NETWORK_TYPE_IPV4:
+		return IPv4Addr(p.IPv4.Header.SourceAddress())
+	case NETWORK_TYPE_IPV6:
+		return IPv6Addr(p.IPv6.Header.SourceAddress())
+	default:
+		return netip.Addr{}
+	}
+}
+
+func (p *Packet) DestinationAddress() netip.Addr {
+	switch p.NetworkType {
+	case NETWORK_TYPE_IPV4:
+		return IPv4Addr(p.IPv4.Header.DestinationAddress())
+	case NETWORK_TYPE_IPV6:
+		return IPv6Addr(p.IPv6.Header.DestinationAddress())
+	default:
+		return netip.Addr{}
+	}
+}
+
+func (p *Packet) SourcePort() uint16 {
+	switch p.TransportType {
+	case TRANSPORT_TYPE_TCP:
+		return p.TCP.Header.SourcePort()
+	case TRANSPORT_TYPE_UDP:
+		return p.UDP.Header.SourcePort()
+	default:
+		return 0
+	}
+}
+
+func (p *Packet) DestinationPort() uint16 {
+	switch p.TransportType {
+	case TRANSPORT_TYPE_TCP:
+		return p.TCP.Header.DestinationPort()
+	case TRANSPORT_TYPE_UDP:
+		return p.UDP.Header.DestinationPort()
+	default:
+		return 0
+	}
+}
+
+func (p *Packet) SourceAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(p.SourceAddress(), p.SourcePort())
+}
+
+func (p *Packet) DestinationAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(p.DestinationAddress(), p.DestinationPort())
+}
+
+func (p *Packet) IsIPv6() bool {
+	return p.NetworkType == NETWORK_TYPE_IPV6
+}
+
+func IPv4Addr(a uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(a >> 24), byte(a >> 16), byte(a >> 8), byte(a)})
+}
+
+func IPv6Addr(a IPv6Address) netip.Addr {
+	var b [16]byte
+
+	for i, part := range a {
+		b[i*2] = byte(part >> 8)
+		b[i*2+1] = byte(part)
+	}
+
+	return netip.AddrFrom16(b)
+}
@@ -3,57 +3,59 @@ package main
 import (
 	"fmt"
 	"io"
-	"time"
 )
 
 type LoggingPacketListener struct {
 	writer io.Writer
 }
 
-func (l LoggingPacketListener) NewPacket(timestamp time.Time, linkLayer, networkLayer, transportLayer interface{}) {
-	if transportLayer != nil {
-		switch transportLayer.(type) {
-		case *TCPFrame:
-			tcpFrame := *transportLayer.(*TCPFrame)
-
-			io.WriteString(l.writer, fmt.Sprintf("[%-37s] %15s:%-5d -> %15s:%-5d: %s, TCP [%7s], SN: %d, AN: %d, payload len: %d\n",
-				timestamp,
-				sourceAddressToString(networkLayer), tcpFrame.Header.SourcePort(),
-				destinationAddressToString(networkLayer), tcpFrame.Header.DestinationPort(),
-				networkTypeString(networkLayer), flagString(*tcpFrame.Header),
-				//from.RelativeSequenceNumber(tcpFrame.Header.SequenceNumber()), // FIXME
-				//to.RelativeSequenceNumber(tcpFrame.Header.AcknowledgeNumber()), // FIXME
-				tcpFrame.Header.SequenceNumber(),
-				tcpFrame.Header.AcknowledgeNumber(),
-				len(tcpFrame.Payload)))
-		case *ICMPFrame:
-			icmpFrame := *transportLayer.(*ICMPFrame)
-
-			io.WriteString(l.writer, fmt.Sprintf("[%-37s] %15s -> %15s: ICMP Type %d\n",
-				timestamp,
-				sourceAddressToString(networkLayer),
-				destinationAddressToString(networkLayer),
-				icmpFrame.Header.Type()))
-		case *UDPFrame:
-			udpFrame := *transportLayer.(*UDPFrame)
-
-			io.WriteString(l.writer, fmt.Sprintf("[%-37s] %15s:%-5d -> %15s:%-5d: %s, UDP, payload len: %d\n",
-				timestamp,
-				sourceAddressToString(networkLayer), udpFrame.Header.SourcePort(),
-				destinationAddressToString(networkLayer), udpFrame.Header.DestinationPort(),
-				networkTypeString(networkLayer),
-				udpFrame.Header.Length()-UDP_FRAME_HEADER_LENGTH))
+func (l LoggingPacketListener) NewPacket(packet *Packet) {
+	var line string
+
+	switch packet.TransportType {
+	case TRANSPORT_TYPE_TCP:
+		tcpFrame := packet.TCP
+
+		line = fmt.Sprintf("[%-37s] %15s:%-5d -> %15s:%-5d: %s, TCP [%7s], stream: %d, SN: %d, AN: %d, payload len: %d",
+			packet.Timestamp(),
+			AddressToString(packet.SourceAddress()), tcpFrame.Header.SourcePort(),
+			AddressToString(packet.DestinationAddress()), tcpFrame.Header.DestinationPort(),
+			packet.NetworkType, flagString(*tcpFrame.Header),
+			packet.TCPStream,
+			//from.RelativeSequenceNumber(tcpFrame.Header.SequenceNumber()), // FIXME
+			//to.RelativeSequenceNumber(tcpFrame.Header.AcknowledgeNumber()), // FIXME
+			tcpFrame.Header.SequenceNumber(),
+			tcpFrame.Header.AcknowledgeNumber(),
+			len(tcpFrame.Payload))
+
+		if len(tcpFrame.Options) > 0 {
+			line += ", options: [" + TCPOptionsString(tcpFrame.Options) + "]"
 		}
-	}
-}
+	case TRANSPORT_TYPE_ICMP:
+		line = fmt.Sprintf("[%-37s] %15s -> %15s: %s",
+			packet.Timestamp(),
+			AddressToString(packet.SourceAddress()),
+			AddressToString(packet.DestinationAddress()),
+			icmpTypeCodeString(packet.ICMP.Header, packet.IsIPv6()))
+	case TRANSPORT_TYPE_UDP:
+		udpFrame := packet.UDP
 
-func networkTypeString(n interface{}) string {
-	switch t := n.(type) {
-	case *IPv4Frame:
-		return "IPv4"
-	case *IPv6Frame:
-		return "IPv6"
+		line = fmt.Sprintf("[%-37s] %15s:%-5d -> %15s:%-5d: %s, UDP, payload len: %d",
+			packet.Timestamp(),
+			AddressToString(packet.SourceAddress()), udpFrame.Header.SourcePort(),
+			AddressToString(packet.DestinationAddress()), udpFrame.Header.DestinationPort(),
+			packet.NetworkType,
+			udpFrame.Header.Length()-UDP_FRAME_HEADER_LENGTH)
 	default:
-		panic(fmt.Sprintf("Unknown frame header type: %T", t))
+		return
+	}
+
+	//
+	// append capture metadata (pcap-ng only)
+	//
+	if c := CaptureInfoString(packet.Capture); c != "" {
+		line += " [" + c + "]"
 	}
+
+	io.WriteString(l.writer, line+"\n")
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testIPPacket(timestamp time.Time, src, dst string) *Packet {
+	srcAddr := netip.MustParseAddr(src)
+	dstAddr := netip.MustParseAddr(dst)
+	packet := &Packet{Capture: CaptureInfo{Timestamp: timestamp}}
+
+	if srcAddr.Is4() {
+		data := make([]byte, IPV4_FRAME_HEADER_LENGTH)
+		data[0] = 0x45
+		s, d := srcAddr.As4(), dstAddr.As4()
+		copy(data[12:16], s[:])
+		copy(data[16:20], d[:])
+
+		header, _ := NewIPv4FrameHeader(data)
+		packet.NetworkType = NETWORK_TYPE_IPV4
+		packet.IPv4 = &IPv4Frame{header, nil}
+	} else {
+		data := make([]byte, IPV6_FRAME_HEADER_LENGTH)
+		data[0] = 0x60
+		s, d := srcAddr.As16(), dstAddr.As16()
+		copy(data[8:24], s[:])
+		copy(data[24:40], d[:])
+
+		header, _ := NewIPv6FrameHeader(data)
+		packet.NetworkType = NETWORK_TYPE_IPV6
+		packet.IPv6 = &IPv6Frame{header, nil}
+	}
+
+	return packet
+}
+
+func TestPacketAddresses(t *testing.T) {
+	cases := []struct {
+		src, dst string
+		network  NetworkType
+	}{
+		{"10.0.0.1", "192.168.1.254", NETWORK_TYPE_IPV4},
+		{"2001:db8::1", "ff01::101", NETWORK_TYPE_IPV6},
+	}
+
+	for i, c := range cases {
+		packet := testIPPacket(time.Time{}, c.src, c.dst)
+
+		if packet.NetworkType != c.network {
+			t.Errorf("TestPacketAddresses[%d].NetworkType mismatch, got: %s, want %s", i, packet.NetworkType, c.network)
+		}
+
+		if got := AddressToString(packet.SourceAddress()); got != c.src {
+			t.Errorf("TestPacketAddresses[%d].SourceAddress() mismatch, got: %s, want %s", i, got, c.src)
+		}
+
+		if got := AddressToString(packet.DestinationAddress()); got != c.dst {
+			t.Errorf("TestPacketAddresses[%d].DestinationAddress() mismatch, got: %s, want %s", i, got, c.dst)
+		}
+	}
+}
+
+func TestPacketUnknownLayers(t *testing.T) {
+	packet := &Packet{}
+
+	if packet.SourceAddress().IsValid() || packet.DestinationAddress().IsValid() {
+		t.Errorf("TestPacketUnknownLayers: expected invalid addresses for packet without network layer")
+	}
+
+	if packet.SourcePort() != 0 || packet.DestinationPort() != 0 {
+		t.Errorf("TestPacketUnknownLayers: expected zero ports for packet without transport layer")
+	}
+
+	if got := AddressToString(packet.SourceAddress()); got != "unknown" {
+		t.Errorf("TestPacketUnknownLayers: AddressToString mismatch, got: %s, want unknown", got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+)
+
+const (
+	TLS_RECORD_HANDSHAKE      = 0x16
+	DTLS_RECORD_HEADER_LENGTH = 13
+	// minimum length of a DNS message, the header
+	DNS_HEADER_LENGTH = 12
+	NTP_PACKET_LENGTH = 48
+)
+
+// DetectTCPProtocol guesses the application protocol from the first data of
+// a TCP stream, either direction. Returns an empty string when unknown.
+func DetectTCPProtocol(payload []byte) string {
+	switch {
+	case bytes.HasPrefix(payload, []byte("PRI * HTTP/2.0")):
+		return "http2"
+	case isHttpReq(payload) || isHttpResp(payload):
+		return "http"
+	case isTLSRecord(payload):
+		return "tls"
+	case bytes.HasPrefix(payload, []byte("SSH-")):
+		return "ssh"
+	default:
+		return ""
+	}
+}
+
+// DetectUDPProtocol guesses the application protocol of a UDP conversation
+// from the server port and its first datagram.
+func DetectUDPProtocol(serverPort uint16, payload []byte) string {
+	switch {
+	case (serverPort == 53 || serverPort == 5353) && len(payload) >= DNS_HEADER_LENGTH:
+		if serverPort == 5353 {
+			return "mdns"
+		}
+		return "dns"
+	case serverPort == 123 && len(payload) >= NTP_PACKET_LENGTH:
+		return "ntp"
+	case serverPort == 443 && len(payload) > 0 && payload[0]&0xc0 == 0xc0:
+		//
+		// long header with the fixed bit set
+		//
+		return "quic"
+	case len(payload) >= DTLS_RECORD_HEADER_LENGTH && payload[0] == TLS_RECORD_HANDSHAKE && payload[1] == 0xfe:
+		return "dtls"
+	default:
+		return ""
+	}
+}
+
+// isTLSRecord checks for the header of a TLS handshake record.
+func isTLSRecord(payload []byte) bool {
+	return len(payload) >= 5 && payload[0] == TLS_RECORD_HANDSHAKE && payload[1] == 0x03 && payload[2] <= 0x04
+}
@@ -7,11 +7,11 @@ import (
 	"go-libpcap"
 	"go-libpcapng"
 	"io"
-	"time"
+	"sync/atomic"
 )
 
 type PacketListener interface {
-	NewPacket(timestamp time.Time, linkLayer, networkLayer, transportLayer interface{})
+	NewPacket(packet *Packet)
 }
 
 func readStream(r io.Reader, packetListener PacketListener) error {
@@ -27,6 +27,7 @@ func readStream(r io.Reader, packetListener PacketListener) error {
 		readdebug("pcapng format detected")
 
 		stream := pcapng.NewStream(r)
+		processes := make([]*pcapng.ProcessInformationBlock, 0)
 
 		for {
 			block, err := stream.NextBlock()
@@ -35,15 +36,23 @@ func readStream(r io.Reader, packetListener PacketListener) error {
 			}
 
 			switch block.(type) {
+			case *pcapng.SectionHeaderBlock:
+				//
+				// process indexes are section specific
+				//
+				processes = processes[:0]
+			case *pcapng.ProcessInformationBlock:
+				processes = append(processes, block.(*pcapng.ProcessInformationBlock))
 			case *pcapng.EnhancedPacketBlock:
 				epb := block.(*pcapng.EnhancedPacketBlock)
+				captureInfo := newPcapngCaptureInfo(epb, processes)
 
-				linkLayer, networkLayer, transportLayer, err := readLayerPacket(uint32(epb.Interface.LinkType), stream.ByteOrder(), epb.PacketData)
+				packet, err := readLayerPacket(uint32(epb.Interface.LinkType), stream.ByteOrder(), epb.PacketData, captureInfo)
 				if err != nil {
 					return err
 				}
 
-				packetListener.NewPacket(epb.Timestamp, linkLayer, networkLayer, transportLayer)
+				packetListener.NewPacket(packet)
 			}
 		}
 	} else if pcap.IsPcapStream(data) {
@@ -60,25 +69,75 @@ func readStream(r io.Reader, packetListener PacketListener) error {
 				return err
 			}
 
-			linkLayer, networkLayer, transportLayer, err := readLayerPacket(fileHeader.Network(), fileHeader.ByteOrder, data)
+			captureInfo := CaptureInfo{
+				Timestamp:      packetHeader.Timestamp(),
+				CapturedLength: packetHeader.IncludeLength(),
+				OriginalLength: packetHeader.OriginalLength(),
+			}
+
+			packet, err := readLayerPacket(fileHeader.Network(), fileHeader.ByteOrder, data, captureInfo)
 			if err != nil {
 				return err
 			}
 
-			packetListener.NewPacket(packetHeader.Timestamp(), linkLayer, networkLayer, transportLayer)
+			packetListener.NewPacket(packet)
 		}
 	}
 
 	return nil
 }
 
-func readLayerPacket(network uint32, byteOrder binary.ByteOrder, packetData []byte) (linkLayer, networkLayer, transportLayer interface{}, err error) {
-	var protocol uint8
+func newPcapngCaptureInfo(epb *pcapng.EnhancedPacketBlock, processes []*pcapng.ProcessInformationBlock) CaptureInfo {
+	captureInfo := CaptureInfo{
+		Timestamp:            epb.Timestamp,
+		CapturedLength:       epb.CapturedLength,
+		OriginalLength:       epb.PacketLength,
+		InterfaceId:          epb.InterfaceId,
+		InterfaceName:        epb.Interface.OptionName(),
+		InterfaceDescription: epb.Interface.OptionDescription(),
+	}
+
+	if !epb.HasOptions() {
+		return captureInfo
+	}
+
+	if epb.Options.Comment != nil {
+		captureInfo.Comment = *epb.Options.Comment
+	}
+
+	if epb.Options.Flags != nil {
+		switch epb.Options.Flags.Direction() {
+		case pcapng.DIRECTION_INBOUND:
+			captureInfo.Direction = DIRECTION_INBOUND
+		case pcapng.DIRECTION_OUTBOUND:
+			captureInfo.Direction = DIRECTION_OUTBOUND
+		}
+	}
+
+	if epb.Options.Hash != nil {
+		captureInfo.HashAlgorithm = epb.Options.Hash.Algorithm().String()
+		captureInfo.Hash = epb.Options.Hash.Hash()
+	}
+
+	if idx := epb.Options.ProcessInfoIndex; idx != nil && int(*idx) < len(processes) {
+		pib := processes[*idx]
+
+		captureInfo.HasProcess = true
+		captureInfo.ProcessId = pib.ProcessId
+		if pib.HasOptions() && pib.Options.ProcessName != nil {
+			captureInfo.ProcessName = *pib.Options.ProcessName
+		}
+	}
+
+	return captureInfo
+}
+
+func readLayerPacket(network uint32, byteOrder binary.ByteOrder, packetData []byte, captureInfo CaptureInfo) (*Packet, error) {
 	var payload []byte
-	var linkFrame interface{}
-	var networkFrame interface{}
 	var etherType uint16
 
+	packet := &Packet{Capture: captureInfo}
+
 	//
 	// Read layer frame
 	//
@@ -86,24 +145,28 @@ func readLayerPacket(network uint32, byteOrder binary.ByteOrder, packetData []by
 	case pcap.LINKTYPE_ETHERNET:
 		ethernetFrame, err := NewEthernetFrame(packetData)
 		if err != nil {
-			return nil, nil, nil, err
+			return packet, err
 		}
 		if ethernetFrame == nil {
-			return nil, nil, nil, nil
+			return packet, nil
 		}
 
+		packet.LinkType = LINK_TYPE_ETHERNET
+		packet.Ethernet = ethernetFrame
+
 		etherType = ethernetFrame.Header.Type()
 		payload = ethernetFrame.Payload
 	case pcap.LINKTYPE_NULL:
 		nullFrame, err := NewNullFrame(packetData, byteOrder)
 		if err != nil {
-			return nil, nil, nil, err
+			return packet, err
 		}
 		if nullFrame == nil {
-			return nil, nil, nil, nil
+			return packet, nil
 		}
 
-		linkFrame = nullFrame
+		packet.LinkType = LINK_TYPE_NULL
+		packet.Null = nullFrame
 		payload = nullFrame.Payload
 
 		//
@@ -129,13 +192,13 @@ func readLayerPacket(network uint32, byteOrder binary.ByteOrder, packetData []by
 				} else {
 					// unknown network layer
 					readdebug(fmt.Sprintf("Unsupported lookback of type %d.", nullFrame.LinkType))
-					return nullFrame, nil, nil, nil
+					return packet, nil
 				}
 			}
 		}
 	default:
 		readdebug(fmt.Sprintf("Unsupported network type %d.", network))
-		return nil, nil, nil, nil
+		return packet, nil
 	}
 
 	//
@@ -145,47 +208,68 @@ func readLayerPacket(network uint32, byteOrder binary.ByteOrder, packetData []by
 	case ETHERTYPE_IPV4:
 		ipv4Frame, err := NewIPv4Frame(payload)
 		if err != nil {
-			return linkFrame, nil, nil, err
+			return packet, err
 		}
 
-		networkFrame = ipv4Frame
+		packet.NetworkType = NETWORK_TYPE_IPV4
+		packet.IPv4 = ipv4Frame
+		packet.Protocol = ipv4Frame.Header.Protocol()
 		payload = ipv4Frame.Payload
-		protocol = ipv4Frame.Header.Protocol()
 	case ETHERTYPE_IPV6:
 		ipv6Frame, err := NewIPv6Frame(payload)
 		if err != nil {
-			return linkFrame, nil, nil, err
+			return packet, err
 		}
 
-		networkFrame = ipv6Frame
+		packet.NetworkType = NETWORK_TYPE_IPV6
+		packet.IPv6 = ipv6Frame
+		packet.Protocol = ipv6Frame.Header.Protocol()
 		payload = ipv6Frame.Payload
-		protocol = ipv6Frame.Header.Protocol()
 	default:
 		// unknown network layer
 		readdebug(fmt.Sprintf("Unsupported network layer of type %d [%s].",
 			etherType, EtherTypeToString(etherType)))
-		return linkFrame, nil, nil, nil
+		return packet, nil
 	}
 
 	//
 	// Read transport frame
 	//
-	switch protocol {
+	switch packet.Protocol {
 	case PROTOCOL_TCP:
 		tcpFrame, err := NewTCPFrame(payload)
-		return linkFrame, networkFrame, tcpFrame, err
+		if err != nil {
+			return packet, err
+		}
+
+		packet.TransportType = TRANSPORT_TYPE_TCP
+		packet.TCP = tcpFrame
 	case PROTOCOL_UDP:
 		udpFrame, err := NewUDPFrame(payload)
-		return linkFrame, networkFrame, udpFrame, err
-	case PROTOCOL_ICMP:
+		if err != nil {
+			return packet, err
+		}
+
+		packet.TransportType = TRANSPORT_TYPE_UDP
+		packet.UDP = udpFrame
+	case PROTOCOL_ICMP, PROTOCOL_ICMP_V6:
+		//
+		// ICMPv6 shares the header layout with ICMP, the network layer tells them apart
+		//
 		icmpFrame, err := NewICMPFrame(payload)
-		return linkFrame, networkFrame, icmpFrame, err
+		if err != nil {
+			return packet, err
+		}
+
+		packet.TransportType = TRANSPORT_TYPE_ICMP
+		packet.ICMP = icmpFrame
 	default:
 		// unknown transport layer
 		readdebug(fmt.Sprintf("Unsupported transport layer of protocol %d [%s].",
-			protocol, IpProtocolToString(protocol)))
-		return linkFrame, networkFrame, nil, nil
+			packet.Protocol, IpProtocolToString(packet.Protocol)))
 	}
+
+	return packet, nil
 }
 
 func read(r io.Reader, n uint32) (data []byte, err error) {
@@ -207,6 +291,33 @@ func readExactly(r io.Reader, n uint32) (data []byte, err error) {
 	return buf, err
 }
 
+// StoppableReader ends its input early, returning io.EOF from the next read
+// after Stop. A read in progress is not interrupted.
+type StoppableReader struct {
+	r       io.Reader
+	stopped atomic.Bool
+}
+
+func NewStoppableReader(r io.Reader) *StoppableReader {
+	return &StoppableReader{r: r}
+}
+
+func (s *StoppableReader) Read(p []byte) (int, error) {
+	if s.stopped.Load() {
+		return 0, io.EOF
+	}
+
+	return s.r.Read(p)
+}
+
+func (s *StoppableReader) Stop() {
+	s.stopped.Store(true)
+}
+
+func (s *StoppableReader) Stopped() bool {
+	return s.stopped.Load()
+}
+
 func readdebug(a ...interface{}) {
 	if true {
 		debug("debug-read:", a...)
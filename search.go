@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// stream data kept to find matches which span data chunks
+	DEFAULT_SEARCH_WINDOW  = 4096
+	DEFAULT_SEARCH_CONTEXT = 32
+)
+
+// SearchPattern finds the matches of a pattern, *regexp.Regexp is one.
+type SearchPattern interface {
+	FindAllIndex(b []byte, n int) [][]int
+}
+
+// NewSearchPattern compiles a regular expression, or a pattern of bytes
+// given in hex when isHex is set, e.g. "474554" or "47 45 54".
+func NewSearchPattern(pattern string, isHex, ignoreCase bool) (SearchPattern, error) {
+	if !isHex {
+		if ignoreCase {
+			pattern = "(?i)" + pattern
+		}
+
+		return regexp.Compile(pattern)
+	}
+
+	b, err := hex.DecodeString(strings.Join(strings.Fields(pattern), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty pattern.")
+	}
+
+	return bytesPattern{b, ignoreCase}, nil
+}
+
+// bytesPattern matches a byte sequence. Regular expressions work on UTF-8
+// and cannot match single bytes above 0x7f.
+type bytesPattern struct {
+	pattern    []byte
+	ignoreCase bool
+}
+
+func (p bytesPattern) FindAllIndex(b []byte, n int) [][]int {
+	pattern := p.pattern
+	if p.ignoreCase {
+		pattern = asciiLower(pattern)
+		b = asciiLower(b)
+	}
+
+	var matches [][]int
+	for start := 0; n < 0 || len(matches) < n; {
+		i := bytes.Index(b[start:], pattern)
+		if i < 0 {
+			break
+		}
+
+		matches = append(matches, []int{start + i, start + i + len(pattern)})
+		start += i + len(pattern)
+	}
+
+	return matches
+}
+
+// asciiLower lowercases ASCII letters only, so that binary data keeps its
+// length.
+func asciiLower(b []byte) []byte {
+	lower := make([]byte, len(b))
+
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+
+	return lower
+}
+
+// StreamSearcher looks for a pattern in reassembled TCP streams and in UDP
+// payloads, like ngrep. It is a TCPListener for the TCP stacks and a
+// PacketListener for UDP, and can be shared by several TCP stacks. Matches
+// spanning TCP segments are found when they are shorter than Window.
+type StreamSearcher struct {
+	writer  io.Writer
+	pattern SearchPattern
+
+	// bytes of context printed around a match
+	Context int
+	Window  int
+
+	mu      sync.Mutex
+	streams map[searchStreamKey]*searchStream
+
+	Matches uint64
+}
+
+type searchStreamKey struct {
+	conn     TCPListenerConnection
+	isClient bool
+}
+
+type searchStream struct {
+	// tail of the data seen so far and the stream offset where it starts
+	tail       []byte
+	tailOffset int
+	// end of the last reported match
+	reportedEnd int
+}
+
+func NewStreamSearcher(writer io.Writer, pattern SearchPattern) *StreamSearcher {
+	return &StreamSearcher{
+		writer:  writer,
+		pattern: pattern,
+		Context: DEFAULT_SEARCH_CONTEXT,
+		Window:  DEFAULT_SEARCH_WINDOW,
+		streams: make(map[searchStreamKey]*searchStream),
+	}
+}
+
+// NewPacket searches UDP payloads, each datagram on its own.
+func (s *StreamSearcher) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_UDP {
+		return
+	}
+
+	payload := packet.UDP.Payload
+	matches := s.pattern.FindAllIndex(payload, -1)
+	if len(matches) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range matches {
+		var out bytes.Buffer
+
+		out.WriteString(fmt.Sprintf("[%s] %s:%d -> %s:%d, UDP, offset %d: ",
+			packet.Timestamp().Format(HTTP_HEADER_TIME_FORMAT),
+			AddressToString(packet.SourceAddress()), packet.UDP.Header.SourcePort(),
+			AddressToString(packet.DestinationAddress()), packet.UDP.Header.DestinationPort(),
+			m[0]))
+		s.writeMatch(&out, payload, m[0], m[1])
+
+		s.Matches += 1
+		s.writer.Write(out.Bytes())
+	}
+}
+
+func (s *StreamSearcher) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+}
+
+func (s *StreamSearcher) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := searchStreamKey{conn, isClient}
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &searchStream{}
+		s.streams[key] = stream
+	}
+
+	buf := append(stream.tail, data...)
+	tailLength := len(stream.tail)
+
+	for _, m := range s.pattern.FindAllIndex(buf, -1) {
+		start, end := stream.tailOffset+m[0], stream.tailOffset+m[1]
+
+		//
+		// matches within the tail were reported with the previous data
+		//
+		if m[1] <= tailLength || start < stream.reportedEnd {
+			continue
+		}
+		stream.reportedEnd = end
+
+		var out bytes.Buffer
+
+		direction := "server"
+		if isClient {
+			direction = "client"
+		}
+
+		writeDirectionHeader(&out, conn, isClient, timestamps.First)
+		out.WriteString(fmt.Sprintf(", %s, offset %d: ", direction, start))
+		s.writeMatch(&out, buf, m[0], m[1])
+
+		s.Matches += 1
+		s.writer.Write(out.Bytes())
+	}
+
+	//
+	// keep the end of the data for matches spanning the next chunk
+	//
+	if len(buf) > s.Window {
+		stream.tailOffset += len(buf) - s.Window
+		buf = buf[len(buf)-s.Window:]
+	}
+	stream.tail = append([]byte(nil), buf...)
+}
+
+func (s *StreamSearcher) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//
+	// the data does not continue the tail
+	//
+	key := searchStreamKey{conn, isClient}
+	stream, ok := s.streams[key]
+	if !ok {
+		stream = &searchStream{}
+		s.streams[key] = stream
+	}
+
+	stream.tailOffset += len(stream.tail) + int(length)
+	stream.tail = nil
+}
+
+func (s *StreamSearcher) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, searchStreamKey{conn, isClient})
+}
+
+func (s *StreamSearcher) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, searchStreamKey{conn, true})
+	delete(s.streams, searchStreamKey{conn, false})
+}
+
+// writeMatch writes the match at buf[start:end] highlighted, with context
+// around it.
+func (s *StreamSearcher) writeMatch(out *bytes.Buffer, buf []byte, start, end int) {
+	from := start - s.Context
+	if from < 0 {
+		from = 0
+	}
+	to := end + s.Context
+	if to > len(buf) {
+		to = len(buf)
+	}
+
+	out.Write(convertToPrintable(buf[from:start]))
+	out.WriteString(red(string(convertToPrintable(buf[start:end]))))
+	out.Write(convertToPrintable(buf[end:to]))
+	out.WriteByte('\n')
+}
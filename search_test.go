@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSearchPattern(t *testing.T) {
+	cases := []struct {
+		pattern    string
+		isHex      bool
+		ignoreCase bool
+		in         string
+		want       [][]int
+	}{
+		{"GET", false, false, "GET /get GET", [][]int{{0, 3}, {9, 12}}},
+		{"get", false, true, "GET /get", [][]int{{0, 3}, {5, 8}}},
+		{"a+b", false, false, "xaaab ab", [][]int{{1, 5}, {6, 8}}},
+		{"ff 00", true, false, "\x01\xff\x00\xff\x00", [][]int{{1, 3}, {3, 5}}},
+		{"4745", true, true, "ge GE", [][]int{{0, 2}, {3, 5}}},
+		{"474", true, false, "", nil},
+		{"(", false, false, "", nil},
+	}
+
+	for i, c := range cases {
+		p, err := NewSearchPattern(c.pattern, c.isHex, c.ignoreCase)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("NewSearchPattern[%d] error expected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewSearchPattern[%d] failed: %s", i, err)
+			continue
+		}
+
+		got := p.FindAllIndex([]byte(c.in), -1)
+		if len(got) != len(c.want) {
+			t.Errorf("NewSearchPattern[%d] mismatch, got: %v, want %v", i, got, c.want)
+			continue
+		}
+		for j := range got {
+			if got[j][0] != c.want[j][0] || got[j][1] != c.want[j][1] {
+				t.Errorf("NewSearchPattern[%d] mismatch, got: %v, want %v", i, got, c.want)
+			}
+		}
+	}
+}
+
+func TestStreamSearcher(t *testing.T) {
+	pattern, _ := NewSearchPattern("secret-[0-9]+", false, false)
+
+	var out bytes.Buffer
+	s := NewStreamSearcher(&out, pattern)
+	s.Context = 4
+
+	//
+	// matches split over segments, behind a gap and in both directions
+	//
+	tcpStack := NewTCPStack(s)
+	tcpStack.GapBufferThreshold = 1
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "abc secr"},
+		{true, 8, 0, "et-12 x secret-3"},
+		{false, 0, 0, "secret-45"},
+		{true, 34, 0, "secret-6"},
+		{true, 42, testFIN, ""},
+		{false, 9, testFIN, ""},
+	})
+
+	want := []string{
+		"10.0.0.1:40000 -> 10.0.0.2:80, stream 0, client, offset 4: abc " + red("secret-12") + " x s\n",
+		"10.0.0.1:40000 -> 10.0.0.2:80, stream 0, client, offset 16: 2 x " + red("secret-3") + "\n",
+		"10.0.0.2:80 -> 10.0.0.1:40000, stream 0, server, offset 0: " + red("secret-45") + "\n",
+		"10.0.0.1:40000 -> 10.0.0.2:80, stream 0, client, offset 34: " + red("secret-6") + "\n",
+	}
+
+	if s.Matches != uint64(len(want)) {
+		t.Errorf("TestStreamSearcher mismatch, got: %d matches, want %d: %q", s.Matches, len(want), out.String())
+	}
+	for _, w := range want {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("TestStreamSearcher mismatch, got: %q, want it to contain %q", out.String(), w)
+		}
+	}
+
+	if len(s.streams) != 0 {
+		t.Errorf("TestStreamSearcher streams not released, got: %d", len(s.streams))
+	}
+
+	//
+	// UDP payloads
+	//
+	out.Reset()
+	s.NewPacket(testUDPPacket(time.Unix(1440000000, 0), testTCPEndpoint{"10.0.0.1", 5000}, testTCPEndpoint{"10.0.0.2", 53}, []byte("..secret-7..")))
+
+	if w := "10.0.0.1:5000 -> 10.0.0.2:53, UDP, offset 2: .." + red("secret-7") + "..\n"; !strings.HasSuffix(out.String(), w) {
+		t.Errorf("TestStreamSearcher UDP mismatch, got: %q, want %q", out.String(), w)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net/netip"
 	"strconv"
+	"strings"
 )
 
 func binarystr(i int64) string {
@@ -43,15 +45,12 @@ func (p EthernetFrameHeader) String() string {
 ]`, MacString(p.Destination()), MacString(p.Source()), p.Type(), EtherTypeToString(p.Type()))
 }
 
-func AddressToString(a interface{}) string {
-	switch t := a.(type) {
-	case uint32:
-		return IPv4String(a.(uint32))
-	case IPv6Address:
-		return IPv6String(a.(IPv6Address))
-	default:
-		panic(fmt.Sprintf("Unknown address type: %T", t))
+func AddressToString(a netip.Addr) string {
+	if !a.IsValid() {
+		return "unknown"
 	}
+
+	return a.String()
 }
 
 func IPv4String(a uint32) string {
@@ -108,6 +107,83 @@ func IPv6String(a IPv6Address) string {
 	return s
 }
 
+func (t LinkType) String() string {
+	switch t {
+	case LINK_TYPE_ETHERNET:
+		return "Ethernet"
+	case LINK_TYPE_NULL:
+		return "Null"
+	default:
+		return "unknown"
+	}
+}
+
+func (t NetworkType) String() string {
+	switch t {
+	case NETWORK_TYPE_IPV4:
+		return "IPv4"
+	case NETWORK_TYPE_IPV6:
+		return "IPv6"
+	default:
+		return "unknown"
+	}
+}
+
+func (t TransportType) String() string {
+	switch t {
+	case TRANSPORT_TYPE_TCP:
+		return "TCP"
+	case TRANSPORT_TYPE_UDP:
+		return "UDP"
+	case TRANSPORT_TYPE_ICMP:
+		return "ICMP"
+	default:
+		return "unknown"
+	}
+}
+
+func (d PacketDirection) String() string {
+	switch d {
+	case DIRECTION_INBOUND:
+		return "in"
+	case DIRECTION_OUTBOUND:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// CaptureInfoString returns the capture metadata worth showing next to a
+// packet, for example "eth0 in, pid 42 (curl)". Empty for pcap files.
+func CaptureInfoString(c CaptureInfo) string {
+	parts := make([]string, 0, 3)
+
+	if c.InterfaceName != "" || c.Direction != DIRECTION_UNKNOWN {
+		s := c.InterfaceName
+		if c.Direction != DIRECTION_UNKNOWN {
+			if s != "" {
+				s += " "
+			}
+			s += c.Direction.String()
+		}
+		parts = append(parts, s)
+	}
+
+	if c.HasProcess {
+		if c.ProcessName != "" {
+			parts = append(parts, fmt.Sprintf("pid %d (%s)", c.ProcessId, c.ProcessName))
+		} else {
+			parts = append(parts, fmt.Sprintf("pid %d", c.ProcessId))
+		}
+	}
+
+	if c.Comment != "" {
+		parts = append(parts, fmt.Sprintf("comment: %q", c.Comment))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
 func IpProtocolToString(p uint8) string {
 	switch p {
 	case PROTOCOL_TCP:
@@ -215,3 +291,314 @@ func (p TCPFrameHeader) String() string {
 ]`, p.SourcePort(), p.DestinationPort(), p.SequenceNumber(), p.AcknowledgeNumber(), p.DataOffset(),
 		p.OptionsLength(), binarystr(int64(p.Flags())), flagString(p), p.WindowSize(), p.Checksum(), p.UrgentPointer())
 }
+
+func (r CloseReason) String() string {
+	switch r {
+	case CLOSE_REASON_NONE:
+		return "-"
+	case CLOSE_REASON_OPEN:
+		return "open"
+	case CLOSE_REASON_FIN:
+		return "fin"
+	case CLOSE_REASON_RST:
+		return "rst"
+	case CLOSE_REASON_TIMEOUT:
+		return "timeout"
+	case CLOSE_REASON_EVICTED:
+		return "evicted"
+	case CLOSE_REASON_REUSED:
+		return "reused"
+	default:
+		return "unknown"
+	}
+}
+
+func (k AnomalyKind) String() string {
+	switch k {
+	case ANOMALY_SYN_UNANSWERED:
+		return "syn-unanswered"
+	case ANOMALY_CONNECTION_REFUSED:
+		return "refused"
+	case ANOMALY_HALF_OPEN:
+		return "half-open"
+	case ANOMALY_HANDSHAKE_FAILED:
+		return "handshake-failed"
+	case ANOMALY_SYN_FLOOD:
+		return "syn-flood"
+	case ANOMALY_RST_STORM:
+		return "rst-storm"
+	case ANOMALY_PORT_SCAN:
+		return "port-scan"
+	default:
+		return "unknown"
+	}
+}
+
+func (a Anomaly) String() string {
+	s := fmt.Sprintf("[anomaly] %s %s %s -> %s", a.Timestamp.Format(HTTP_HEADER_TIME_FORMAT), a.Kind, a.Source, a.Destination)
+	if a.Detail != "" {
+		s += ": " + a.Detail
+	}
+
+	return s
+}
+
+func (f FollowFormat) String() string {
+	switch f {
+	case FOLLOW_FORMAT_ASCII:
+		return "ascii"
+	case FOLLOW_FORMAT_HEX:
+		return "hex"
+	case FOLLOW_FORMAT_RAW:
+		return "raw"
+	default:
+		return "unknown"
+	}
+}
+
+func (e StreamEnd) String() string {
+	switch e {
+	case STREAM_END_CLOSED:
+		return "closed"
+	case STREAM_END_RESET:
+		return "reset"
+	case STREAM_END_TRUNCATED:
+		return "truncated"
+	default:
+		return "unknown"
+	}
+}
+
+func TCPOptionKindToString(kind uint8) string {
+	switch kind {
+	case TCP_OPTION_KIND_END:
+		return "eol"
+	case TCP_OPTION_KIND_NOP:
+		return "nop"
+	case TCP_OPTION_KIND_MSS:
+		return "mss"
+	case TCP_OPTION_KIND_WINDOW_SCALE:
+		return "wscale"
+	case TCP_OPTION_KIND_SACK_PERMITTED:
+		return "sackOK"
+	case TCP_OPTION_KIND_SACK:
+		return "sack"
+	case TCP_OPTION_KIND_TIMESTAMPS:
+		return "TS"
+	case TCP_OPTION_KIND_MPTCP:
+		return "mptcp"
+	case TCP_OPTION_KIND_FAST_OPEN:
+		return "tfo"
+	case TCP_OPTION_KIND_EXPERIMENTAL:
+		return "exp"
+	default:
+		return "unknown-" + strconv.Itoa(int(kind))
+	}
+}
+
+func (opt TCPOption) String() string {
+	var o TCPOptions
+	if err := o.add(opt); err != nil {
+		return "bad " + TCPOptionKindToString(opt.Kind)
+	}
+
+	switch {
+	case o.HasMSS:
+		return fmt.Sprintf("mss %d", o.MSS)
+	case o.HasWindowScale:
+		return fmt.Sprintf("wscale %d", o.WindowScale)
+	case o.SACKPermitted:
+		return "sackOK"
+	case len(o.SACKBlocks) > 0:
+		blocks := make([]string, len(o.SACKBlocks))
+		for i, b := range o.SACKBlocks {
+			blocks[i] = fmt.Sprintf("{%d:%d}", b.Left, b.Right)
+		}
+		return fmt.Sprintf("sack %d %s", len(blocks), strings.Join(blocks, ""))
+	case o.HasTimestamps:
+		return fmt.Sprintf("TS val %d ecr %d", o.TimestampValue, o.TimestampEchoReply)
+	case o.HasFastOpen && len(o.FastOpenCookie) == 0:
+		return "tfo cookiereq"
+	case o.HasFastOpen:
+		return fmt.Sprintf("tfo cookie %x", o.FastOpenCookie)
+	case o.HasMPTCP:
+		return fmt.Sprintf("mptcp subtype %d", o.MPTCPSubtype)
+	case opt.Kind == TCP_OPTION_KIND_NOP:
+		return "nop"
+	default:
+		return fmt.Sprintf("%s len %d", TCPOptionKindToString(opt.Kind), len(opt.Data)+2)
+	}
+}
+
+// TCPOptionsString formats the options region of a TCP header like tcpdump
+// does, e.g. "mss 1460,nop,wscale 7".
+func TCPOptionsString(data []byte) string {
+	opts, err := ParseTCPOptions(data)
+
+	strs := make([]string, 0, len(opts)+1)
+	for _, opt := range opts {
+		strs = append(strs, opt.String())
+	}
+	if err != nil {
+		strs = append(strs, "bad opts")
+	}
+
+	return strings.Join(strs, ",")
+}
+
+func ICMPTypeToString(t uint8) string {
+	switch t {
+	case ICMP_TYPE_ECHO_REPLY:
+		return "echo reply"
+	case ICMP_TYPE_DESTINATION_UNREACHABLE:
+		return "destination unreachable"
+	case ICMP_TYPE_SOURCE_QUENCH:
+		return "source quench"
+	case ICMP_TYPE_REDIRECT:
+		return "redirect"
+	case ICMP_TYPE_ECHO_REQUEST:
+		return "echo request"
+	case ICMP_TYPE_ROUTER_ADVERTISEMENT:
+		return "router advertisement"
+	case ICMP_TYPE_ROUTER_SOLICITATION:
+		return "router solicitation"
+	case ICMP_TYPE_TIME_EXCEEDED:
+		return "time exceeded"
+	case ICMP_TYPE_PARAMETER_PROBLEM:
+		return "parameter problem"
+	case ICMP_TYPE_TIMESTAMP_REQUEST:
+		return "timestamp request"
+	case ICMP_TYPE_TIMESTAMP_REPLY:
+		return "timestamp reply"
+	default:
+		return "unknown"
+	}
+}
+
+func ICMPCodeToString(t, code uint8) string {
+	switch t {
+	case ICMP_TYPE_DESTINATION_UNREACHABLE:
+		switch code {
+		case 0:
+			return "network unreachable"
+		case 1:
+			return "host unreachable"
+		case 2:
+			return "protocol unreachable"
+		case 3:
+			return "port unreachable"
+		case 4:
+			return "fragmentation needed"
+		case 5:
+			return "source route failed"
+		case 9:
+			return "network administratively prohibited"
+		case 10:
+			return "host administratively prohibited"
+		case 13:
+			return "communication administratively prohibited"
+		}
+	case ICMP_TYPE_REDIRECT:
+		switch code {
+		case 0:
+			return "redirect for network"
+		case 1:
+			return "redirect for host"
+		}
+	case ICMP_TYPE_TIME_EXCEEDED:
+		switch code {
+		case 0:
+			return "TTL exceeded in transit"
+		case 1:
+			return "fragment reassembly time exceeded"
+		}
+	case ICMP_TYPE_PARAMETER_PROBLEM:
+		switch code {
+		case 0:
+			return "pointer indicates the error"
+		case 1:
+			return "missing a required option"
+		case 2:
+			return "bad length"
+		}
+	default:
+		if code == 0 {
+			return ""
+		}
+	}
+
+	return "unknown"
+}
+
+func ICMPv6TypeToString(t uint8) string {
+	switch t {
+	case ICMPV6_TYPE_DESTINATION_UNREACHABLE:
+		return "destination unreachable"
+	case ICMPV6_TYPE_PACKET_TOO_BIG:
+		return "packet too big"
+	case ICMPV6_TYPE_TIME_EXCEEDED:
+		return "time exceeded"
+	case ICMPV6_TYPE_PARAMETER_PROBLEM:
+		return "parameter problem"
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		return "echo request"
+	case ICMPV6_TYPE_ECHO_REPLY:
+		return "echo reply"
+	case ICMPV6_TYPE_ROUTER_SOLICITATION:
+		return "router solicitation"
+	case ICMPV6_TYPE_ROUTER_ADVERTISEMENT:
+		return "router advertisement"
+	case ICMPV6_TYPE_NEIGHBOR_SOLICITATION:
+		return "neighbor solicitation"
+	case ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT:
+		return "neighbor advertisement"
+	case ICMPV6_TYPE_REDIRECT:
+		return "redirect"
+	default:
+		return "unknown"
+	}
+}
+
+func ICMPv6CodeToString(t, code uint8) string {
+	switch t {
+	case ICMPV6_TYPE_DESTINATION_UNREACHABLE:
+		switch code {
+		case 0:
+			return "no route to destination"
+		case 1:
+			return "administratively prohibited"
+		case 2:
+			return "beyond scope of source address"
+		case 3:
+			return "address unreachable"
+		case 4:
+			return "port unreachable"
+		case 5:
+			return "source address failed ingress/egress policy"
+		case 6:
+			return "reject route to destination"
+		}
+	case ICMPV6_TYPE_TIME_EXCEEDED:
+		switch code {
+		case 0:
+			return "hop limit exceeded in transit"
+		case 1:
+			return "fragment reassembly time exceeded"
+		}
+	case ICMPV6_TYPE_PARAMETER_PROBLEM:
+		switch code {
+		case 0:
+			return "erroneous header field"
+		case 1:
+			return "unrecognized next header type"
+		case 2:
+			return "unrecognized IPv6 option"
+		}
+	default:
+		if code == 0 {
+			return ""
+		}
+	}
+
+	return "unknown"
+}
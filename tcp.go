@@ -29,6 +29,10 @@ func NewTCPFrame(data []byte) (*TCPFrame, error) {
 		return nil, err
 	}
 
+	if header.DataOffset() < TCP_FRAME_HEADER_LENGTH {
+		return nil, errors.New(fmt.Sprintf("invalid data offset %d.", header.DataOffset()))
+	}
+
 	if len(data) < int(header.DataOffset()) {
 		return nil, errors.New(fmt.Sprintf("required at least %d bytes of data.", header.DataOffset()))
 	}
@@ -36,17 +40,18 @@ func NewTCPFrame(data []byte) (*TCPFrame, error) {
 	//
 	// Read TCP options
 	//
-	optsLen := header.OptionsLength()
 	var opts []byte
-	if optsLen > 0 {
-		opts = data[optsLen:]
-	} else {
-		opts = nil
+	if header.OptionsLength() > 0 {
+		opts = data[TCP_FRAME_HEADER_LENGTH:header.DataOffset()]
 	}
 
 	return &TCPFrame{header, opts, data[header.DataOffset():]}, nil
 }
 
+func (f *TCPFrame) DecodeOptions() (TCPOptions, error) {
+	return DecodeTCPOptions(f.Options)
+}
+
 func NewTCPFrameHeader(data []byte) (*TCPFrameHeader, error) {
 	if len(data) < TCP_FRAME_HEADER_LENGTH {
 		return nil, errors.New(fmt.Sprintf("required at least %d bytes of data.", TCP_FRAME_HEADER_LENGTH))
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+type AnomalyKind uint8
+
+const (
+	// SYN without SYN-ACK within the handshake timeout
+	ANOMALY_SYN_UNANSWERED AnomalyKind = iota
+	// SYN answered by RST
+	ANOMALY_CONNECTION_REFUSED
+	// SYN-ACK without the final ACK within the handshake timeout
+	ANOMALY_HALF_OPEN
+	// handshake reset after the SYN-ACK or acknowledged wrong
+	ANOMALY_HANDSHAKE_FAILED
+	ANOMALY_SYN_FLOOD
+	ANOMALY_RST_STORM
+	ANOMALY_PORT_SCAN
+
+	ANOMALY_KIND_COUNT
+)
+
+const (
+	DEFAULT_ANOMALY_HANDSHAKE_TIMEOUT = 3 * time.Second
+	DEFAULT_ANOMALY_RATE_WINDOW       = time.Second
+	DEFAULT_ANOMALY_SYN_FLOOD         = 100
+	DEFAULT_ANOMALY_RST_STORM         = 100
+	DEFAULT_ANOMALY_PORT_SCAN_WINDOW  = 10 * time.Second
+	DEFAULT_ANOMALY_PORT_SCAN         = 20
+)
+
+// AnomalyThresholds configure the TCPAnomalyAnalyzer. Counts are reached
+// within RateWindow for floods and storms, and within PortScanWindow for
+// port scans. Zero or less disables a check.
+type AnomalyThresholds struct {
+	HandshakeTimeout time.Duration
+
+	RateWindow time.Duration
+	// SYNs to one destination address and port
+	SYNFlood int
+	// RSTs sent by one host
+	RSTStorm int
+
+	PortScanWindow time.Duration
+	// distinct ports of a host opened by one source
+	PortScan int
+}
+
+func DefaultAnomalyThresholds() AnomalyThresholds {
+	return AnomalyThresholds{
+		HandshakeTimeout: DEFAULT_ANOMALY_HANDSHAKE_TIMEOUT,
+		RateWindow:       DEFAULT_ANOMALY_RATE_WINDOW,
+		SYNFlood:         DEFAULT_ANOMALY_SYN_FLOOD,
+		RSTStorm:         DEFAULT_ANOMALY_RST_STORM,
+		PortScanWindow:   DEFAULT_ANOMALY_PORT_SCAN_WINDOW,
+		PortScan:         DEFAULT_ANOMALY_PORT_SCAN,
+	}
+}
+
+type Anomaly struct {
+	Kind      AnomalyKind
+	Timestamp time.Time
+
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	Detail string
+}
+
+type anomalyHandshake struct {
+	syn time.Time
+	// order of the handshakes with the same SYN time
+	index     uint64
+	clientISN uint32
+	// data sent with the SYN (TCP Fast Open)
+	synLength  uint32
+	synAckSeen bool
+	serverISN  uint32
+}
+
+// anomalyRate counts events in fixed windows, a window is reported once.
+type anomalyRate struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+func (r *anomalyRate) add(now time.Time, window time.Duration) int {
+	if now.Sub(r.start) >= window {
+		r.start = now
+		r.count = 0
+		r.reported = false
+	}
+
+	r.count += 1
+	return r.count
+}
+
+type anomalyScanKey struct {
+	Source      netip.Addr
+	Destination netip.Addr
+}
+
+type anomalyScan struct {
+	start    time.Time
+	ports    map[uint16]bool
+	reported bool
+}
+
+// TCPAnomalyAnalyzer looks at the TCP headers of all packets, also those the
+// TCP stack ignores, and reports failed handshakes, floods and scans. Events
+// are written as they are detected, counts with WriteReport.
+type TCPAnomalyAnalyzer struct {
+	writer     io.Writer
+	Thresholds AnomalyThresholds
+
+	// handshakes in progress by client flow
+	handshakes map[FlowAddress]*anomalyHandshake
+	synRates   map[netip.AddrPort]*anomalyRate
+	rstRates   map[netip.Addr]*anomalyRate
+	scans      map[anomalyScanKey]*anomalyScan
+	lastSweep  time.Time
+	lastSeen   time.Time
+	// handshakes started so far
+	handshakeCount uint64
+
+	Counts [ANOMALY_KIND_COUNT]uint64
+}
+
+func NewTCPAnomalyAnalyzer(writer io.Writer, thresholds AnomalyThresholds) *TCPAnomalyAnalyzer {
+	return &TCPAnomalyAnalyzer{
+		writer:     writer,
+		Thresholds: thresholds,
+		handshakes: make(map[FlowAddress]*anomalyHandshake),
+		synRates:   make(map[netip.AddrPort]*anomalyRate),
+		rstRates:   make(map[netip.Addr]*anomalyRate),
+		scans:      make(map[anomalyScanKey]*anomalyScan),
+	}
+}
+
+func (a *TCPAnomalyAnalyzer) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_TCP {
+		return
+	}
+
+	tcpHeader := packet.TCP.Header
+	timestamp := packet.Timestamp()
+	flowAddress := FlowAddress{
+		SourceAddress:      packet.SourceAddress(),
+		SourcePort:         tcpHeader.SourcePort(),
+		DestinationAddress: packet.DestinationAddress(),
+		DestinationPort:    tcpHeader.DestinationPort(),
+	}
+
+	a.lastSeen = timestamp
+	a.sweep(timestamp)
+
+	switch {
+	case tcpHeader.FlagRST():
+		a.rst(flowAddress, timestamp)
+	case tcpHeader.FlagSYN() && !tcpHeader.FlagACK():
+		a.syn(flowAddress, tcpHeader.SequenceNumber(), uint32(len(packet.TCP.Payload)), timestamp)
+	case tcpHeader.FlagSYN():
+		h, ok := a.handshakes[flowAddress.Reverse()]
+		//
+		// a fast open server acknowledges the data of the SYN too
+		//
+		ack := tcpHeader.AcknowledgeNumber()
+		if ok && (ack == h.clientISN+1 || ack == h.clientISN+1+h.synLength) {
+			h.synAckSeen = true
+			h.serverISN = tcpHeader.SequenceNumber()
+		}
+	case tcpHeader.FlagACK():
+		h, ok := a.handshakes[flowAddress]
+		if !ok {
+			return
+		}
+
+		//
+		// without the SYN-ACK the capture only sees one direction
+		//
+		if h.synAckSeen && tcpHeader.AcknowledgeNumber() != h.serverISN+1 {
+			a.report(ANOMALY_HANDSHAKE_FAILED, timestamp, flowAddress,
+				fmt.Sprintf("ack %d does not acknowledge the SYN-ACK", tcpHeader.AcknowledgeNumber()))
+		}
+		delete(a.handshakes, flowAddress)
+	}
+}
+
+func (a *TCPAnomalyAnalyzer) syn(flowAddress FlowAddress, seq, length uint32, timestamp time.Time) {
+	//
+	// retransmitted SYN keeps the handshake running
+	//
+	if h, ok := a.handshakes[flowAddress]; !ok || h.clientISN != seq {
+		a.handshakes[flowAddress] = &anomalyHandshake{syn: timestamp, index: a.handshakeCount, clientISN: seq, synLength: length}
+		a.handshakeCount += 1
+	}
+
+	t := a.Thresholds
+	destination := netip.AddrPortFrom(flowAddress.DestinationAddress, flowAddress.DestinationPort)
+
+	if t.SYNFlood > 0 {
+		r, ok := a.synRates[destination]
+		if !ok {
+			r = &anomalyRate{start: timestamp}
+			a.synRates[destination] = r
+		}
+
+		if r.add(timestamp, t.RateWindow) >= t.SYNFlood && !r.reported {
+			r.reported = true
+			a.report(ANOMALY_SYN_FLOOD, timestamp, flowAddress,
+				fmt.Sprintf("%d SYNs to %s within %s", r.count, destination, t.RateWindow))
+		}
+	}
+
+	if t.PortScan > 0 {
+		key := anomalyScanKey{flowAddress.SourceAddress, flowAddress.DestinationAddress}
+
+		s, ok := a.scans[key]
+		if !ok || timestamp.Sub(s.start) >= t.PortScanWindow {
+			s = &anomalyScan{start: timestamp, ports: make(map[uint16]bool)}
+			a.scans[key] = s
+		}
+
+		s.ports[flowAddress.DestinationPort] = true
+		if len(s.ports) >= t.PortScan && !s.reported {
+			s.reported = true
+			a.report(ANOMALY_PORT_SCAN, timestamp, flowAddress,
+				fmt.Sprintf("%d ports of %s within %s", len(s.ports), AddressToString(key.Destination), t.PortScanWindow))
+		}
+	}
+}
+
+func (a *TCPAnomalyAnalyzer) rst(flowAddress FlowAddress, timestamp time.Time) {
+	t := a.Thresholds
+
+	if t.RSTStorm > 0 {
+		r, ok := a.rstRates[flowAddress.SourceAddress]
+		if !ok {
+			r = &anomalyRate{start: timestamp}
+			a.rstRates[flowAddress.SourceAddress] = r
+		}
+
+		if r.add(timestamp, t.RateWindow) >= t.RSTStorm && !r.reported {
+			r.reported = true
+			a.report(ANOMALY_RST_STORM, timestamp, flowAddress,
+				fmt.Sprintf("%d RSTs from %s within %s", r.count, AddressToString(flowAddress.SourceAddress), t.RateWindow))
+		}
+	}
+
+	//
+	// reset by the server
+	//
+	if h, ok := a.handshakes[flowAddress.Reverse()]; ok {
+		delete(a.handshakes, flowAddress.Reverse())
+
+		if h.synAckSeen {
+			a.report(ANOMALY_HANDSHAKE_FAILED, timestamp, flowAddress.Reverse(), "reset by server")
+		} else {
+			a.report(ANOMALY_CONNECTION_REFUSED, timestamp, flowAddress.Reverse(), "")
+		}
+		return
+	}
+
+	//
+	// reset by the client
+	//
+	if h, ok := a.handshakes[flowAddress]; ok {
+		delete(a.handshakes, flowAddress)
+
+		if h.synAckSeen {
+			a.report(ANOMALY_HANDSHAKE_FAILED, timestamp, flowAddress, "reset by client")
+		}
+	}
+}
+
+// sweep reports handshakes which timed out and forgets expired counters.
+// Time is taken from the packets like in the TCP stack.
+func (a *TCPAnomalyAnalyzer) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < IDLE_SWEEP_INTERVAL {
+		return
+	}
+	a.lastSweep = now
+
+	t := a.Thresholds
+
+	a.expireHandshakes(now)
+
+	for destination, r := range a.synRates {
+		if now.Sub(r.start) >= t.RateWindow {
+			delete(a.synRates, destination)
+		}
+	}
+	for source, r := range a.rstRates {
+		if now.Sub(r.start) >= t.RateWindow {
+			delete(a.rstRates, source)
+		}
+	}
+	for key, s := range a.scans {
+		if now.Sub(s.start) >= t.PortScanWindow {
+			delete(a.scans, key)
+		}
+	}
+}
+
+// expireHandshakes forgets the handshakes which timed out, in the order
+// they started. They are reported unless the check is disabled, then the
+// default timeout only keeps the map bounded.
+func (a *TCPAnomalyAnalyzer) expireHandshakes(now time.Time) {
+	timeout := a.Thresholds.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_ANOMALY_HANDSHAKE_TIMEOUT
+	}
+
+	var expired []FlowAddress
+	for flowAddress, h := range a.handshakes {
+		if now.Sub(h.syn) >= timeout {
+			expired = append(expired, flowAddress)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		hi, hj := a.handshakes[expired[i]], a.handshakes[expired[j]]
+		if !hi.syn.Equal(hj.syn) {
+			return hi.syn.Before(hj.syn)
+		}
+		return hi.index < hj.index
+	})
+
+	for _, flowAddress := range expired {
+		h := a.handshakes[flowAddress]
+		delete(a.handshakes, flowAddress)
+
+		if a.Thresholds.HandshakeTimeout <= 0 {
+			continue
+		}
+
+		timestamp := h.syn.Add(timeout)
+		if h.synAckSeen {
+			a.report(ANOMALY_HALF_OPEN, timestamp, flowAddress, "no ACK of the SYN-ACK")
+		} else {
+			a.report(ANOMALY_SYN_UNANSWERED, timestamp, flowAddress, "")
+		}
+	}
+}
+
+// Close reports the handshakes which had timed out by the last packet of
+// the capture but were not swept yet. Younger handshakes may still have
+// completed after the capture ended and are not reported.
+func (a *TCPAnomalyAnalyzer) Close() {
+	a.expireHandshakes(a.lastSeen)
+}
+
+func (a *TCPAnomalyAnalyzer) report(kind AnomalyKind, timestamp time.Time, flowAddress FlowAddress, detail string) {
+	a.Counts[kind] += 1
+
+	anomaly := Anomaly{
+		Kind:        kind,
+		Timestamp:   timestamp,
+		Source:      netip.AddrPortFrom(flowAddress.SourceAddress, flowAddress.SourcePort),
+		Destination: netip.AddrPortFrom(flowAddress.DestinationAddress, flowAddress.DestinationPort),
+		Detail:      detail,
+	}
+
+	io.WriteString(a.writer, anomaly.String()+"\n")
+}
+
+func (a *TCPAnomalyAnalyzer) WriteReport(w io.Writer) {
+	io.WriteString(w, "\nTCP anomalies:\n")
+
+	for kind := AnomalyKind(0); kind < ANOMALY_KIND_COUNT; kind++ {
+		io.WriteString(w, fmt.Sprintf("%18s: %d\n", kind, a.Counts[kind]))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPAnomalyAnalyzerHandshakes(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	later := ts.Add(5 * time.Second)
+	other := testTCPEndpoint{"10.0.0.3", 40001}
+
+	cases := []struct {
+		packets []*Packet
+		kind    AnomalyKind
+		count   uint64
+	}{
+		// completed handshake
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, 5000, 1001, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, 1001, 5001, testACK, nil),
+			testTCPPacket(later, other, testServer, 1, 1, testACK, nil),
+		}, ANOMALY_HALF_OPEN, 0},
+		// retransmitted SYN never answered
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts.Add(time.Second), testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(later, other, testServer, 1, 1, testACK, nil),
+		}, ANOMALY_SYN_UNANSWERED, 1},
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, 0, 1001, testRST|testACK, nil),
+		}, ANOMALY_CONNECTION_REFUSED, 1},
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, 5000, 1001, testSYN|testACK, nil),
+			testTCPPacket(later, other, testServer, 1, 1, testACK, nil),
+		}, ANOMALY_HALF_OPEN, 1},
+		// fast open SYN-ACK acknowledges the data of the SYN
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, []byte("data")),
+			testTCPPacket(ts, testServer, testClient, 5000, 1005, testSYN|testACK, nil),
+			testTCPPacket(later, other, testServer, 1, 1, testACK, nil),
+		}, ANOMALY_HALF_OPEN, 1},
+		// SYN-ACK reset by the client
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, 5000, 1001, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, 1001, 0, testRST, nil),
+		}, ANOMALY_HANDSHAKE_FAILED, 1},
+		// SYN-ACK acknowledged wrong
+		{[]*Packet{
+			testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, 5000, 1001, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, 1001, 9999, testACK, nil),
+		}, ANOMALY_HANDSHAKE_FAILED, 1},
+	}
+
+	for i, c := range cases {
+		var out bytes.Buffer
+		a := NewTCPAnomalyAnalyzer(&out, DefaultAnomalyThresholds())
+
+		for _, p := range c.packets {
+			a.NewPacket(p)
+		}
+
+		var total uint64
+		for _, n := range a.Counts {
+			total += n
+		}
+
+		if a.Counts[c.kind] != c.count || total != c.count {
+			t.Errorf("TestTCPAnomalyAnalyzerHandshakes[%d] mismatch, got: %v, want %d %s", i, a.Counts, c.count, c.kind)
+		}
+
+		if lines := strings.Count(out.String(), "\n"); uint64(lines) != c.count {
+			t.Errorf("TestTCPAnomalyAnalyzerHandshakes[%d] event lines mismatch, got: %d, want %d", i, lines, c.count)
+		}
+	}
+}
+
+func TestTCPAnomalyAnalyzerClose(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+
+	var out bytes.Buffer
+	thresholds := DefaultAnomalyThresholds()
+	thresholds.HandshakeTimeout = 300 * time.Millisecond
+	a := NewTCPAnomalyAnalyzer(&out, thresholds)
+
+	//
+	// timed out by the last packet in the order of their SYNs, the last
+	// handshake is too young to report
+	//
+	for _, p := range []struct {
+		at   time.Duration
+		port uint16
+	}{{0, 40003}, {200 * time.Millisecond, 40002}, {200 * time.Millisecond, 40001}, {900 * time.Millisecond, 40004}} {
+		a.NewPacket(testTCPPacket(ts.Add(p.at), testTCPEndpoint{"10.0.0.1", p.port}, testServer, 1000, 0, testSYN, nil))
+	}
+	a.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{"10.0.0.1:40003 ->", "10.0.0.1:40002 ->", "10.0.0.1:40001 ->"}
+	if len(lines) != len(want) {
+		t.Fatalf("TestTCPAnomalyAnalyzerClose mismatch, got: %q, want %d lines", lines, len(want))
+	}
+	for i, w := range want {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("TestTCPAnomalyAnalyzerClose[%d] mismatch, got: %q, want to contain %q", i, lines[i], w)
+		}
+	}
+
+	//
+	// with the check disabled handshakes are forgotten without a report
+	//
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		out.Reset()
+		thresholds.HandshakeTimeout = timeout
+		a = NewTCPAnomalyAnalyzer(&out, thresholds)
+
+		a.NewPacket(testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil))
+		a.NewPacket(testTCPPacket(ts.Add(time.Minute), testServer, testClient, 1, 1, testACK, nil))
+		a.Close()
+
+		if len(a.handshakes) != 0 || out.Len() != 0 {
+			t.Errorf("TestTCPAnomalyAnalyzerClose disabled by %s mismatch, got: %d handshakes, %q", timeout, len(a.handshakes), out.String())
+		}
+	}
+}
+
+func TestTCPAnomalyAnalyzerRates(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	scanner := testTCPEndpoint{"10.0.0.9", 50000}
+
+	var out bytes.Buffer
+	thresholds := DefaultAnomalyThresholds()
+	thresholds.SYNFlood = 10
+	thresholds.RSTStorm = 10
+	thresholds.PortScan = 5
+	a := NewTCPAnomalyAnalyzer(&out, thresholds)
+
+	//
+	// 20 SYNs to one port within the window, then 20 in the next window
+	//
+	for i := 0; i < 40; i++ {
+		from := testTCPEndpoint{"10.0.1.1", uint16(30000 + i)}
+		at := ts.Add(time.Duration(i) * 40 * time.Millisecond)
+
+		a.NewPacket(testTCPPacket(at, from, testServer, uint32(i), 0, testSYN, nil))
+		a.NewPacket(testTCPPacket(at, testServer, from, 0, uint32(i)+1, testRST|testACK, nil))
+	}
+
+	//
+	// scan of 5 ports, below the threshold after the window
+	//
+	for i := 0; i < 5; i++ {
+		to := testTCPEndpoint{"10.0.0.2", uint16(20 + i)}
+		a.NewPacket(testTCPPacket(ts.Add(time.Duration(i)*time.Second), scanner, to, 1, 0, testSYN, nil))
+	}
+	for i := 0; i < 4; i++ {
+		to := testTCPEndpoint{"10.0.0.2", uint16(100 + i)}
+		a.NewPacket(testTCPPacket(ts.Add(time.Duration(20+i)*time.Second), scanner, to, 1, 0, testSYN, nil))
+	}
+
+	if a.Counts[ANOMALY_SYN_FLOOD] != 2 {
+		t.Errorf("TestTCPAnomalyAnalyzerRates SYN flood mismatch, got: %d, want 2", a.Counts[ANOMALY_SYN_FLOOD])
+	}
+	if a.Counts[ANOMALY_RST_STORM] != 2 {
+		t.Errorf("TestTCPAnomalyAnalyzerRates RST storm mismatch, got: %d, want 2", a.Counts[ANOMALY_RST_STORM])
+	}
+	if a.Counts[ANOMALY_CONNECTION_REFUSED] != 40 {
+		t.Errorf("TestTCPAnomalyAnalyzerRates refused mismatch, got: %d, want 40", a.Counts[ANOMALY_CONNECTION_REFUSED])
+	}
+	if a.Counts[ANOMALY_PORT_SCAN] != 1 {
+		t.Errorf("TestTCPAnomalyAnalyzerRates port scan mismatch, got: %d, want 1", a.Counts[ANOMALY_PORT_SCAN])
+	}
+
+	if !strings.Contains(out.String(), "port-scan 10.0.0.9:50000 -> 10.0.0.2:24: 5 ports of 10.0.0.2 within 10s") {
+		t.Errorf("TestTCPAnomalyAnalyzerRates port scan event missing, got: %s", out.String())
+	}
+}
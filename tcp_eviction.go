@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_IDLE_TIMEOUT            = 5 * time.Minute
+	DEFAULT_CONNECTION_BUFFER_LIMIT = 16 * 1024 * 1024
+	DEFAULT_BUFFER_LIMIT            = 256 * 1024 * 1024
+
+	// how often, in packet time, connections are checked for idleness
+	IDLE_SWEEP_INTERVAL = time.Second
+
+	// how long segments of a closed connection are not picked up as a new
+	// connection, twice the common maximum segment lifetime
+	TIME_WAIT_DURATION = 2 * 30 * time.Second
+)
+
+type EvictionStats struct {
+	// connections without packets for longer than the idle timeout
+	Idle uint64
+	// connections with more buffered data than allowed per connection
+	ConnectionLimit uint64
+	// connections evicted to get all buffered data under the global limit
+	GlobalLimit uint64
+	// connections closed by a new connection on the same ports
+	Reused uint64
+}
+
+func (conn *TCPConnection) bufferedBytes() int {
+	return conn.ClientFlow.bufferedBytes + conn.ServerFlow.bufferedBytes
+}
+
+// removeConnection forgets a connection and the data buffered for it.
+func (tcpStack *TCPStack) removeConnection(conn *TCPConnection) {
+	tcpStack.bufferedBytes -= conn.bufferedBytes()
+
+	delete(tcpStack.connections, conn.ClientFlow.Address)
+	delete(tcpStack.connections, conn.ServerFlow.Address)
+}
+
+// evict closes a connection which is not closed by its own packets.
+func (tcpStack *TCPStack) evict(conn *TCPConnection, counter *uint64, closeReason CloseReason, reason string) {
+	tcpstackdebug(fmt.Sprintf("tcp-debug: evicting connection %s:%d -> %s:%d, %s",
+		AddressToString(conn.ClientFlow.Address.SourceAddress), conn.ClientFlow.Address.SourcePort,
+		AddressToString(conn.ClientFlow.Address.DestinationAddress), conn.ClientFlow.Address.DestinationPort,
+		reason))
+
+	*counter += 1
+	tcpStack.closeConnection(conn, closeReason)
+}
+
+// enterTimeWait remembers the flows of a closed connection for a while, so
+// that its late retransmissions are not picked up as a new connection.
+func (tcpStack *TCPStack) enterTimeWait(conn *TCPConnection) {
+	until := conn.lastSeen.Add(TIME_WAIT_DURATION)
+
+	tcpStack.timeWait[conn.ClientFlow.Address] = until
+	tcpStack.timeWait[conn.ServerFlow.Address] = until
+}
+
+func (tcpStack *TCPStack) inTimeWait(flowAddress FlowAddress, now time.Time) bool {
+	until, ok := tcpStack.timeWait[flowAddress]
+	return ok && now.Before(until)
+}
+
+// evictIdle closes connections which have not seen packets within the idle
+// timeout and expires the time wait of closed connections. Time is taken
+// from the packets so that offline files age the same way as live captures.
+func (tcpStack *TCPStack) evictIdle(now time.Time) {
+	if now.Sub(tcpStack.lastSweep) < IDLE_SWEEP_INTERVAL {
+		return
+	}
+	tcpStack.lastSweep = now
+
+	for flowAddress, conn := range tcpStack.connections {
+		//
+		// each connection is in the map with both of its flows
+		//
+		if tcpStack.IdleTimeout <= 0 || flowAddress != conn.ClientFlow.Address {
+			continue
+		}
+
+		if now.Sub(conn.lastSeen) >= tcpStack.IdleTimeout {
+			tcpStack.evict(conn, &tcpStack.Evictions.Idle, CLOSE_REASON_TIMEOUT, "idle")
+		}
+	}
+
+	for flowAddress, until := range tcpStack.timeWait {
+		if !now.Before(until) {
+			delete(tcpStack.timeWait, flowAddress)
+		}
+	}
+}
+
+// enforceBufferLimits evicts conn when it has too much data buffered, then
+// evicts the least recently active connections with buffered data while the
+// total is over the global limit.
+func (tcpStack *TCPStack) enforceBufferLimits(conn *TCPConnection) {
+	if tcpStack.ConnectionBufferLimit > 0 && conn.bufferedBytes() > tcpStack.ConnectionBufferLimit {
+		tcpStack.evict(conn, &tcpStack.Evictions.ConnectionLimit, CLOSE_REASON_EVICTED, "connection buffer limit")
+	}
+
+	if tcpStack.BufferLimit <= 0 {
+		return
+	}
+
+	for tcpStack.bufferedBytes > tcpStack.BufferLimit {
+		var oldest *TCPConnection
+
+		for flowAddress, c := range tcpStack.connections {
+			if flowAddress != c.ClientFlow.Address || c.bufferedBytes() == 0 {
+				continue
+			}
+
+			if oldest == nil || c.lastSeen.Before(oldest.lastSeen) {
+				oldest = c
+			}
+		}
+
+		if oldest == nil {
+			return
+		}
+
+		tcpStack.evict(oldest, &tcpStack.Evictions.GlobalLimit, CLOSE_REASON_EVICTED, "buffer limit")
+	}
+}
+
+// compactSegment detaches a segment about to be buffered from the captured
+// frame, so that only its payload and the TCP header are kept in memory.
+func compactSegment(segment *BufferedPacket) {
+	p := segment.Packet
+
+	capture := p.Capture
+	capture.Hash = nil
+
+	header := &TCPFrameHeader{append([]byte(nil), p.TCP.Header.data[:TCP_FRAME_HEADER_LENGTH]...)}
+
+	segment.Packet = &Packet{
+		Capture:       capture,
+		LinkType:      p.LinkType,
+		NetworkType:   p.NetworkType,
+		TransportType: p.TransportType,
+		Protocol:      p.Protocol,
+		TCP:           &TCPFrame{Header: header},
+		TCPStream:     p.TCPStream,
+	}
+	segment.Payload = append([]byte(nil), segment.Payload...)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTCPStackIdleEviction(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	tcpStack.IdleTimeout = time.Minute
+
+	ts := time.Unix(1440000000, 0)
+	other := testTCPEndpoint{"10.0.0.3", 40001}
+
+	// half-open connection
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(ts.Add(30*time.Second), other, testServer, 2000, 0, testSYN, nil))
+
+	if l.closedConnections != 0 || len(tcpStack.connections) != 4 {
+		t.Fatalf("TestTCPStackIdleEviction evicted too early, got: %d closed, %d flows", l.closedConnections, len(tcpStack.connections))
+	}
+
+	tcpStack.NewPacket(testTCPPacket(ts.Add(61*time.Second), other, testServer, 2001, 0, testACK, nil))
+
+	if l.closedConnections != 1 || tcpStack.Evictions.Idle != 1 {
+		t.Errorf("TestTCPStackIdleEviction mismatch, got: %d closed, %d evicted, want 1/1", l.closedConnections, tcpStack.Evictions.Idle)
+	}
+
+	if _, ok := tcpStack.connections[testFlowAddress(testClient, testServer)]; ok {
+		t.Errorf("TestTCPStackIdleEviction idle connection still present")
+	}
+
+	if len(tcpStack.connections) != 2 {
+		t.Errorf("TestTCPStackIdleEviction active connection evicted, got: %d flows, want 2", len(tcpStack.connections))
+	}
+}
+
+func TestTCPStackIdleEvictionEndOfStream(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	tcpStack.IdleTimeout = time.Minute
+
+	ts := time.Unix(1440000000, 0)
+	other := testTCPEndpoint{"10.0.0.3", 40001}
+
+	// the client closed its side, the server did not
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "abcd"},
+		{true, 4, testFIN, ""},
+		{false, 0, 0, "efgh"},
+	})
+
+	tcpStack.NewPacket(testTCPPacket(ts.Add(61*time.Second), other, testServer, 2000, 0, testSYN, nil))
+
+	want := []testEnd{{true, STREAM_END_CLOSED}, {false, STREAM_END_TRUNCATED}}
+	if !reflect.DeepEqual(l.ends, want) {
+		t.Errorf("TestTCPStackIdleEvictionEndOfStream ends mismatch, got: %v, want %v", l.ends, want)
+	}
+
+	if l.closedConnections != 1 || tcpStack.Evictions.Idle != 1 {
+		t.Errorf("TestTCPStackIdleEvictionEndOfStream mismatch, got: %d closed, %d evicted, want 1/1", l.closedConnections, tcpStack.Evictions.Idle)
+	}
+}
+
+func TestTCPStackBufferLimits(t *testing.T) {
+	cases := []struct {
+		connectionLimit int
+		limit           int
+		evictions       EvictionStats
+		buffered        int
+	}{
+		{0, 0, EvictionStats{}, 12},
+		{8, 0, EvictionStats{ConnectionLimit: 1}, 0},
+		{0, 8, EvictionStats{GlobalLimit: 1}, 0},
+	}
+
+	for i, c := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+		tcpStack.GapBufferThreshold = 0
+		tcpStack.ConnectionBufferLimit = c.connectionLimit
+		tcpStack.BufferLimit = c.limit
+
+		testReplay(tcpStack, 1000, 5000, []testSegment{
+			{true, 4, 0, "efgh"},
+			{true, 8, 0, "ijkl"},
+			{false, 4, 0, "efgh"},
+		})
+
+		if tcpStack.Evictions != c.evictions {
+			t.Errorf("TestTCPStackBufferLimits[%d] evictions mismatch, got: %+v, want %+v", i, tcpStack.Evictions, c.evictions)
+		}
+
+		if tcpStack.bufferedBytes != c.buffered {
+			t.Errorf("TestTCPStackBufferLimits[%d] buffered bytes mismatch, got: %d, want %d", i, tcpStack.bufferedBytes, c.buffered)
+		}
+
+		if got := l.closedConnections; got != int(c.evictions.ConnectionLimit+c.evictions.GlobalLimit) {
+			t.Errorf("TestTCPStackBufferLimits[%d] closed connections mismatch, got: %d", i, got)
+		}
+	}
+}
+
+func TestTCPStackPortReuse(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	ts := time.Unix(1440000000, 0)
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "abcd"},
+	})
+
+	// retransmitted SYN of the same connection
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, 1005, 5001, testACK, []byte("efgh")))
+
+	if l.newConnections != 1 || l.closedConnections != 0 {
+		t.Errorf("TestTCPStackPortReuse duplicate SYN events mismatch, got: %d/%d, want 1/0", l.newConnections, l.closedConnections)
+	}
+	if got := l.clientData.String(); got != "abcdefgh" {
+		t.Errorf("TestTCPStackPortReuse data mismatch, got: %q, want %q", got, "abcdefgh")
+	}
+
+	// new connection on the same ports
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, 9000, 0, testSYN, nil))
+
+	if l.newConnections != 2 || l.closedConnections != 1 || tcpStack.Evictions.Reused != 1 {
+		t.Errorf("TestTCPStackPortReuse reuse events mismatch, got: %d/%d/%d, want 2/1/1", l.newConnections, l.closedConnections, tcpStack.Evictions.Reused)
+	}
+	if len(tcpStack.connections) != 2 {
+		t.Errorf("TestTCPStackPortReuse flows mismatch, got: %d, want 2", len(tcpStack.connections))
+	}
+}
+
+func TestTCPStackTimeWait(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	tcpStack.MidStreamPickup = true
+	ts := time.Unix(1440000000, 0)
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "abcd"},
+		{true, 4, testFIN, ""},
+		{false, 0, testFIN, ""},
+	})
+
+	// late retransmission is not picked up as a new connection
+	tcpStack.NewPacket(testTCPPacket(ts.Add(time.Second), testClient, testServer, 1001, 5001, testACK, []byte("abcd")))
+
+	if l.newConnections != 1 || len(tcpStack.connections) != 0 {
+		t.Errorf("TestTCPStackTimeWait picked up closed connection, got: %d new, %d flows", l.newConnections, len(tcpStack.connections))
+	}
+
+	// after time wait it is
+	tcpStack.NewPacket(testTCPPacket(ts.Add(TIME_WAIT_DURATION+time.Second), testClient, testServer, 7000, 8000, testACK, []byte("abcd")))
+
+	if l.newConnections != 2 {
+		t.Errorf("TestTCPStackTimeWait connection not picked up after time wait, got: %d new", l.newConnections)
+	}
+}
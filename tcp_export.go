@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EXPORT_TIME_FORMAT = "20060102T150405.000"
+
+	DEFAULT_EXPORT_OPEN_FILES = 64
+)
+
+// ExportTCPListener writes the reassembled data of every connection to
+// files in a directory, like tcpflow. Each direction goes to its own file,
+// or both to one file with a marker line at every change of direction when
+// Interleaved is set. Files are named by the time of the connection and its
+// endpoints, e.g. 20150819T160000.010_10.0.0.1.40000-10.0.0.2.80.client
+//
+// At most OpenFiles files are kept open, the least recently written one is
+// closed and reopened for appending when its connection sends more data.
+type ExportTCPListener struct {
+	dir         string
+	Interleaved bool
+	OpenFiles   int
+
+	conns map[TCPListenerConnection]*exportConnection
+	// open files, most recently written first
+	open *list.List
+}
+
+type exportConnection struct {
+	name string
+
+	client exportFile
+	server exportFile
+	// direction of the last data written to the interleaved file
+	lastClient bool
+	written    bool
+
+	failed bool
+}
+
+// exportFile is the file of one direction, or of both when interleaved.
+type exportFile struct {
+	// empty until the first write
+	path string
+
+	// nil while closed
+	f    *os.File
+	elem *list.Element
+}
+
+func NewExportTCPListener(dir string) *ExportTCPListener {
+	return &ExportTCPListener{
+		dir:       dir,
+		OpenFiles: DEFAULT_EXPORT_OPEN_FILES,
+		conns:     make(map[TCPListenerConnection]*exportConnection),
+		open:      list.New(),
+	}
+}
+
+func (l *ExportTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.conns[conn] = &exportConnection{
+		name: exportFileName(conn, timestamp),
+	}
+}
+
+func (l *ExportTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	ec, ok := l.conns[conn]
+	if !ok || ec.failed {
+		return
+	}
+
+	var err error
+	if l.Interleaved && (!ec.written || ec.lastClient != isClient) {
+		err = l.write(ec, isClient, []byte(exportMarker(conn, isClient, timestamps.First)), data)
+	} else {
+		err = l.write(ec, isClient, data)
+	}
+
+	if err != nil {
+		l.fail(ec, err)
+		return
+	}
+
+	ec.lastClient = isClient
+	ec.written = true
+}
+
+func (l *ExportTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	ec, ok := l.conns[conn]
+	if !ok || ec.failed {
+		return
+	}
+
+	//
+	// the marker keeps the data around the gap apart in both modes
+	//
+	err := l.write(ec, isClient, []byte(fmt.Sprintf("\n=== %d bytes missing ===\n", length)))
+	if err != nil {
+		l.fail(ec, err)
+	}
+
+	//
+	// data after the gap gets a new marker
+	//
+	ec.written = false
+}
+
+func (l *ExportTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+	ec, ok := l.conns[conn]
+	if !ok || l.Interleaved {
+		return
+	}
+
+	if isClient {
+		l.closeFile(&ec.client)
+	} else {
+		l.closeFile(&ec.server)
+	}
+}
+
+func (l *ExportTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	ec, ok := l.conns[conn]
+	if !ok {
+		return
+	}
+
+	delete(l.conns, conn)
+	l.closeFiles(ec)
+}
+
+// Close closes the files of connections which are still open.
+func (l *ExportTCPListener) Close() {
+	for conn, ec := range l.conns {
+		delete(l.conns, conn)
+		l.closeFiles(ec)
+	}
+}
+
+// write appends data to the file of a direction. The file is created on
+// first use so that connections without data leave no files behind.
+func (l *ExportTCPListener) write(ec *exportConnection, isClient bool, data ...[]byte) error {
+	ef, suffix := &ec.client, ".client"
+	if l.Interleaved {
+		suffix = ".stream"
+	} else if !isClient {
+		ef, suffix = &ec.server, ".server"
+	}
+
+	if ef.f == nil {
+		var err error
+		if ef.path == "" {
+			ef.f, err = createExportFile(filepath.Join(l.dir, ec.name), suffix)
+			if err == nil {
+				ef.path = ef.f.Name()
+			}
+		} else {
+			ef.f, err = os.OpenFile(ef.path, os.O_WRONLY|os.O_APPEND, 0)
+		}
+		if err != nil {
+			ef.f = nil
+			return err
+		}
+
+		ef.elem = l.open.PushFront(ef)
+		if l.OpenFiles > 0 && l.open.Len() > l.OpenFiles {
+			l.closeFile(l.open.Back().Value.(*exportFile))
+		}
+	} else {
+		l.open.MoveToFront(ef.elem)
+	}
+
+	for _, d := range data {
+		if _, err := ef.f.Write(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *ExportTCPListener) closeFile(ef *exportFile) {
+	if ef.f == nil {
+		return
+	}
+
+	ef.f.Close()
+	ef.f = nil
+	l.open.Remove(ef.elem)
+	ef.elem = nil
+}
+
+func (l *ExportTCPListener) closeFiles(ec *exportConnection) {
+	l.closeFile(&ec.client)
+	l.closeFile(&ec.server)
+}
+
+func (l *ExportTCPListener) fail(ec *exportConnection, err error) {
+	os.Stderr.WriteString(fmt.Sprintf("export: %s: %s\n", ec.name, err))
+
+	ec.failed = true
+	l.closeFiles(ec)
+}
+
+// createExportFile creates base+suffix, adding a counter to the name when
+// the file exists, e.g. after ports were reused within a millisecond.
+func createExportFile(base, suffix string) (*os.File, error) {
+	name := base + suffix
+
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+
+		name = base + "-" + strconv.Itoa(i) + suffix
+	}
+}
+
+func exportFileName(conn TCPListenerConnection, timestamp time.Time) string {
+	return fmt.Sprintf("%s_%s-%s",
+		timestamp.UTC().Format(EXPORT_TIME_FORMAT),
+		exportEndpointName(conn.ClientAddress, conn.ClientPort),
+		exportEndpointName(conn.ServerAddress, conn.ServerPort))
+}
+
+// exportEndpointName formats an endpoint for file names, colons of IPv6
+// addresses are not allowed on every file system.
+func exportEndpointName(addr netip.Addr, port uint16) string {
+	return strings.ReplaceAll(AddressToString(addr), ":", "-") + "." + strconv.Itoa(int(port))
+}
+
+func exportMarker(conn TCPListenerConnection, isClient bool, timestamp time.Time) string {
+	from := netip.AddrPortFrom(conn.ClientAddress, conn.ClientPort)
+	to := netip.AddrPortFrom(conn.ServerAddress, conn.ServerPort)
+	direction := "client"
+	if !isClient {
+		from, to = to, from
+		direction = "server"
+	}
+
+	return fmt.Sprintf("\n=== %s %s -> %s at %s ===\n", direction, from, to, timestamp.UTC().Format(EXPORT_TIME_FORMAT))
+}
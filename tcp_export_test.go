@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestExportTCPListener(t *testing.T) {
+	const name = "20150819T160000.000_10.0.0.1.40000-10.0.0.2.80"
+
+	segments := []testSegment{
+		{true, 0, 0, "abcd"},
+		{false, 0, 0, "1234"},
+		{false, 4, 0, "5678"},
+		{true, 4, testFIN, "efgh"},
+		{false, 8, testFIN, ""},
+	}
+
+	cases := []struct {
+		interleaved bool
+		files       map[string]string
+	}{
+		{false, map[string]string{
+			name + ".client": "abcdefgh",
+			name + ".server": "12345678",
+		}},
+		{true, map[string]string{
+			name + ".stream": "\n=== client 10.0.0.1:40000 -> 10.0.0.2:80 at 20150819T160000.000 ===\nabcd" +
+				"\n=== server 10.0.0.2:80 -> 10.0.0.1:40000 at 20150819T160000.000 ===\n12345678" +
+				"\n=== client 10.0.0.1:40000 -> 10.0.0.2:80 at 20150819T160000.000 ===\nefgh",
+		}},
+	}
+
+	for i, c := range cases {
+		dir := t.TempDir()
+		l := NewExportTCPListener(dir)
+		l.Interleaved = c.interleaved
+
+		testReplay(NewTCPStack(l), 1000, 5000, segments)
+
+		if len(l.conns) != 0 {
+			t.Errorf("TestExportTCPListener[%d] connection not closed, got: %d open", i, len(l.conns))
+		}
+
+		testExportFiles(t, i, dir, c.files)
+	}
+}
+
+func TestExportTCPListenerReuse(t *testing.T) {
+	const name = "20150819T160000.000_10.0.0.1.40000-10.0.0.2.80"
+
+	dir := t.TempDir()
+	l := NewExportTCPListener(dir)
+	tcpStack := NewTCPStack(l)
+
+	// same tuple and time, the second connection must not overwrite the first
+	testReplay(tcpStack, 1000, 5000, []testSegment{{true, 0, 0, "first"}})
+	testReplay(tcpStack, 9000, 7000, []testSegment{{true, 0, 0, "second"}})
+	l.Close()
+
+	testExportFiles(t, 0, dir, map[string]string{
+		name + ".client":   "first",
+		name + "-1.client": "second",
+	})
+}
+
+func TestExportTCPListenerGap(t *testing.T) {
+	const name = "20150819T160000.000_10.0.0.1.40000-10.0.0.2.80"
+
+	cases := []struct {
+		interleaved bool
+		files       map[string]string
+	}{
+		{false, map[string]string{
+			name + ".server": "head\n=== 6 bytes missing ===\ntail",
+		}},
+		{true, map[string]string{
+			name + ".stream": "\n=== server 10.0.0.2:80 -> 10.0.0.1:40000 at 20150819T160000.000 ===\nhead" +
+				"\n=== 6 bytes missing ===\n" +
+				"\n=== server 10.0.0.2:80 -> 10.0.0.1:40000 at 20150819T160000.000 ===\ntail",
+		}},
+	}
+
+	for i, c := range cases {
+		dir := t.TempDir()
+		l := NewExportTCPListener(dir)
+		l.Interleaved = c.interleaved
+
+		tcpStack := NewTCPStack(l)
+		testReplay(tcpStack, 1000, 5000, []testSegment{
+			{false, 0, 0, "head"},
+			{false, 10, 0, "tail"},
+		})
+		tcpStack.Close()
+
+		testExportFiles(t, i, dir, c.files)
+	}
+}
+
+func TestExportTCPListenerOpenFiles(t *testing.T) {
+	const name = "20150819T160000.000_10.0.0.1.40000-10.0.0.2.80"
+
+	dir := t.TempDir()
+	l := NewExportTCPListener(dir)
+	l.OpenFiles = 1
+
+	// every change of direction closes the other file and reopens it
+	testReplay(NewTCPStack(l), 1000, 5000, []testSegment{
+		{true, 0, 0, "abcd"},
+		{false, 0, 0, "1234"},
+		{true, 4, 0, "efgh"},
+		{false, 4, 0, "5678"},
+	})
+
+	if l.open.Len() != 1 {
+		t.Errorf("TestExportTCPListenerOpenFiles open files mismatch, got: %d, want 1", l.open.Len())
+	}
+
+	l.Close()
+
+	if l.open.Len() != 0 {
+		t.Errorf("TestExportTCPListenerOpenFiles files not closed, got: %d open", l.open.Len())
+	}
+
+	testExportFiles(t, 0, dir, map[string]string{
+		name + ".client": "abcdefgh",
+		name + ".server": "12345678",
+	})
+}
+
+func testExportFiles(t *testing.T, i int, dir string, want map[string]string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	if len(names) != len(want) {
+		t.Errorf("export[%d] files mismatch, got: %v, want %d files", i, names, len(want))
+	}
+
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("export[%d] %s", i, err)
+			continue
+		}
+
+		if string(data) != content {
+			t.Errorf("export[%d] %s mismatch, got: %q, want %q", i, name, data, content)
+		}
+	}
+}
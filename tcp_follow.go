@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FollowFormat uint8
+
+const (
+	FOLLOW_FORMAT_ASCII FollowFormat = iota
+	FOLLOW_FORMAT_HEX
+	FOLLOW_FORMAT_RAW
+)
+
+const (
+	HEX_DUMP_LINE_LENGTH = 16
+)
+
+func ParseFollowFormat(s string) (FollowFormat, error) {
+	switch s {
+	case "ascii":
+		return FOLLOW_FORMAT_ASCII, nil
+	case "hex":
+		return FOLLOW_FORMAT_HEX, nil
+	case "raw":
+		return FOLLOW_FORMAT_RAW, nil
+	default:
+		return FOLLOW_FORMAT_ASCII, errors.New("format must be 'ascii', 'hex' or 'raw'.")
+	}
+}
+
+// TCPFollowFilter selects connections by stream index, or by the addresses
+// of both endpoints in either order.
+type TCPFollowFilter struct {
+	ByIndex bool
+	Index   uint64
+
+	A netip.AddrPort
+	B netip.AddrPort
+}
+
+// ParseTCPFollowFilter parses a stream index like 3, or two endpoints like
+// 10.0.0.1:40000,10.0.0.2:80 or [::1]:40000,[::1]:80.
+func ParseTCPFollowFilter(s string) (TCPFollowFilter, error) {
+	if index, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return TCPFollowFilter{ByIndex: true, Index: index}, nil
+	}
+
+	a, b, ok := strings.Cut(s, ",")
+	if !ok {
+		return TCPFollowFilter{}, errors.New("expected a stream index or two endpoints separated by a comma.")
+	}
+
+	addrA, err := netip.ParseAddrPort(strings.TrimSpace(a))
+	if err != nil {
+		return TCPFollowFilter{}, err
+	}
+
+	addrB, err := netip.ParseAddrPort(strings.TrimSpace(b))
+	if err != nil {
+		return TCPFollowFilter{}, err
+	}
+
+	return TCPFollowFilter{A: addrA, B: addrB}, nil
+}
+
+func (f TCPFollowFilter) Matches(conn TCPListenerConnection) bool {
+	if f.ByIndex {
+		return conn.StreamIndex == f.Index
+	}
+
+	client := netip.AddrPortFrom(conn.ClientAddress, conn.ClientPort)
+	server := netip.AddrPortFrom(conn.ServerAddress, conn.ServerPort)
+
+	return (client == f.A && server == f.B) || (client == f.B && server == f.A)
+}
+
+// FollowTCPListener prints the reassembled data of the connections matching
+// a filter, like "Follow TCP Stream" of Wireshark. Client data is red and
+// server data blue, except in the raw format which writes the data only.
+// One listener can be shared by several TCP stacks.
+type FollowTCPListener struct {
+	writer io.Writer
+	Filter TCPFollowFilter
+	Format FollowFormat
+
+	mu      sync.Mutex
+	streams map[TCPListenerConnection]*followStream
+}
+
+type followStream struct {
+	clientBytes int
+	serverBytes int
+}
+
+func NewFollowTCPListener(writer io.Writer, filter TCPFollowFilter, format FollowFormat) *FollowTCPListener {
+	return &FollowTCPListener{
+		writer:  writer,
+		Filter:  filter,
+		Format:  format,
+		streams: make(map[TCPListenerConnection]*followStream),
+	}
+}
+
+func (l *FollowTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	if !l.Filter.Matches(conn) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.streams[conn] = &followStream{}
+
+	if l.Format != FOLLOW_FORMAT_RAW {
+		io.WriteString(l.writer, green(fmt.Sprintf("===================================================================\n"+
+			"Follow: tcp,%s\nFilter: tcp.stream eq %d\nNode 0: %s\nNode 1: %s\n",
+			l.Format, conn.StreamIndex,
+			netip.AddrPortFrom(conn.ClientAddress, conn.ClientPort),
+			netip.AddrPortFrom(conn.ServerAddress, conn.ServerPort)))+"\n")
+	}
+}
+
+func (l *FollowTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stream, ok := l.streams[conn]
+	if !ok {
+		return
+	}
+
+	offset := &stream.serverBytes
+	color := blue
+	if isClient {
+		offset = &stream.clientBytes
+		color = red
+	}
+
+	switch l.Format {
+	case FOLLOW_FORMAT_RAW:
+		l.writer.Write(data)
+	case FOLLOW_FORMAT_HEX:
+		indent := ""
+		if !isClient {
+			indent = "    "
+		}
+
+		io.WriteString(l.writer, color(hexDump(data, *offset, indent)))
+	default:
+		io.WriteString(l.writer, color(printableString(data)))
+	}
+
+	*offset += len(data)
+}
+
+func (l *FollowTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stream, ok := l.streams[conn]
+	if !ok {
+		return
+	}
+
+	//
+	// offsets continue after the lost data
+	//
+	if isClient {
+		stream.clientBytes += int(length)
+	} else {
+		stream.serverBytes += int(length)
+	}
+
+	if l.Format != FOLLOW_FORMAT_RAW {
+		io.WriteString(l.writer, green(fmt.Sprintf("\n[%d bytes missing]\n", length)))
+	}
+}
+
+func (l *FollowTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+}
+
+func (l *FollowTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stream, ok := l.streams[conn]
+	if !ok {
+		return
+	}
+	delete(l.streams, conn)
+
+	if l.Format != FOLLOW_FORMAT_RAW {
+		io.WriteString(l.writer, green(fmt.Sprintf("\n%d bytes from client, %d bytes from server\n"+
+			"===================================================================", stream.clientBytes, stream.serverBytes))+"\n")
+	}
+}
+
+// printableString replaces the bytes of data which would disturb a terminal
+// with dots, line breaks and tabs are kept.
+func printableString(data []byte) string {
+	b := make([]byte, len(data))
+
+	for i, c := range data {
+		if (c >= 0x20 && c < 0x7f) || c == '\n' || c == '\r' || c == '\t' {
+			b[i] = c
+		} else {
+			b[i] = '.'
+		}
+	}
+
+	return string(b)
+}
+
+// hexDump formats data like hexdump -C, offsets start from offset and lines
+// are prefixed with indent.
+func hexDump(data []byte, offset int, indent string) string {
+	var out bytes.Buffer
+
+	for i := 0; i < len(data); i += HEX_DUMP_LINE_LENGTH {
+		end := i + HEX_DUMP_LINE_LENGTH
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[i:end]
+
+		out.WriteString(fmt.Sprintf("%s%08x  ", indent, offset+i))
+		for j := 0; j < HEX_DUMP_LINE_LENGTH; j++ {
+			if j < len(line) {
+				out.WriteString(fmt.Sprintf("%02x ", line[j]))
+			} else {
+				out.WriteString("   ")
+			}
+			if j == HEX_DUMP_LINE_LENGTH/2-1 {
+				out.WriteByte(' ')
+			}
+		}
+
+		out.WriteString(" |")
+		out.Write(convertToPrintable(line))
+		out.WriteString("|\n")
+	}
+
+	return out.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseTCPFollowFilter(t *testing.T) {
+	client := testListenerConnection("10.0.0.1", 40000, "10.0.0.2", 80, 3)
+	other := testListenerConnection("10.0.0.1", 40001, "10.0.0.2", 80, 4)
+
+	cases := []struct {
+		in     string
+		err    bool
+		client bool
+		other  bool
+	}{
+		{"3", false, true, false},
+		{"4", false, false, true},
+		{"10.0.0.1:40000,10.0.0.2:80", false, true, false},
+		{"10.0.0.2:80, 10.0.0.1:40000", false, true, false},
+		{"[::1]:40000,[::1]:80", false, false, false},
+		{"10.0.0.1:40000", true, false, false},
+		{"10.0.0.1,10.0.0.2:80", true, false, false},
+	}
+
+	for i, c := range cases {
+		f, err := ParseTCPFollowFilter(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("ParseTCPFollowFilter[%d] error mismatch, got: %v", i, err)
+			continue
+		}
+
+		if f.Matches(client) != c.client || f.Matches(other) != c.other {
+			t.Errorf("ParseTCPFollowFilter[%d] match mismatch, got: %t/%t, want %t/%t",
+				i, f.Matches(client), f.Matches(other), c.client, c.other)
+		}
+	}
+}
+
+func testListenerConnection(client string, clientPort uint16, server string, serverPort uint16, index uint64) TCPListenerConnection {
+	return TCPListenerConnection{
+		ClientAddress: netip.MustParseAddr(client),
+		ClientPort:    clientPort,
+		ServerAddress: netip.MustParseAddr(server),
+		ServerPort:    serverPort,
+		StreamIndex:   index,
+	}
+}
+
+func TestFollowTCPListener(t *testing.T) {
+	segments := []testSegment{
+		{true, 0, 0, "GET / HTTP/1.1\r\n\r\n"},
+		{false, 0, 0, "HTTP/1.1 200 OK\r\n\r\n\x00\x01"},
+		{true, 18, testFIN, ""},
+		{false, 21, testFIN, ""},
+	}
+
+	cases := []struct {
+		format FollowFormat
+		want   []string
+	}{
+		{FOLLOW_FORMAT_RAW, []string{"GET / HTTP/1.1\r\n\r\nHTTP/1.1 200 OK\r\n\r\n\x00\x01"}},
+		{FOLLOW_FORMAT_ASCII, []string{
+			"Filter: tcp.stream eq 0\nNode 0: 10.0.0.1:40000\nNode 1: 10.0.0.2:80\n",
+			red("GET / HTTP/1.1\r\n\r\n"),
+			blue("HTTP/1.1 200 OK\r\n\r\n.."),
+			"18 bytes from client, 21 bytes from server",
+		}},
+		{FOLLOW_FORMAT_HEX, []string{
+			red("00000000  47 45 54 20 2f 20 48 54  54 50 2f 31 2e 31 0d 0a  |GET / HTTP/1.1..|\n" +
+				"00000010  0d 0a                                             |..|\n"),
+			blue("    00000000  48 54 54 50 2f 31 2e 31  20 32 30 30 20 4f 4b 0d  |HTTP/1.1 200 OK.|\n" +
+				"    00000010  0a 0d 0a 00 01                                    |.....|\n"),
+		}},
+	}
+
+	for i, c := range cases {
+		var out bytes.Buffer
+		filter, _ := ParseTCPFollowFilter("10.0.0.1:40000,10.0.0.2:80")
+		l := NewFollowTCPListener(&out, filter, c.format)
+
+		testReplay(NewTCPStack(l), 1000, 5000, segments)
+
+		if c.format == FOLLOW_FORMAT_RAW && out.String() != c.want[0] {
+			t.Errorf("TestFollowTCPListener[%d] mismatch, got: %q, want %q", i, out.String(), c.want[0])
+		}
+
+		for _, w := range c.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("TestFollowTCPListener[%d] mismatch, got: %q, want it to contain %q", i, out.String(), w)
+			}
+		}
+
+		if len(l.streams) != 0 {
+			t.Errorf("TestFollowTCPListener[%d] stream not closed", i)
+		}
+	}
+
+	//
+	// other streams are not printed
+	//
+	var out bytes.Buffer
+	l := NewFollowTCPListener(&out, TCPFollowFilter{ByIndex: true, Index: 1}, FOLLOW_FORMAT_ASCII)
+	testReplay(NewTCPStack(l), 1000, 5000, segments)
+
+	if out.Len() != 0 {
+		t.Errorf("TestFollowTCPListener other stream printed, got: %q", out.String())
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// HexDumpTCPListener prints the data of TCP connections as a hexdump with
+// offsets counted per direction, client data red and server data blue. It
+// is meant as the fallback of HttpTCPListener for unknown protocols. Data
+// beyond MaxLength bytes in a direction is not printed.
+type HexDumpTCPListener struct {
+	writer io.Writer
+	// bytes printed per direction of a connection, zero for no limit
+	MaxLength int
+
+	conns map[TCPListenerConnection]*hexDumpConnection
+}
+
+type hexDumpConnection struct {
+	clientBytes int
+	serverBytes int
+}
+
+func NewHexDumpTCPListener(writer io.Writer, maxLength int) *HexDumpTCPListener {
+	return &HexDumpTCPListener{
+		writer:    writer,
+		MaxLength: maxLength,
+		conns:     make(map[TCPListenerConnection]*hexDumpConnection),
+	}
+}
+
+func (l *HexDumpTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.conns[conn] = &hexDumpConnection{}
+}
+
+func (l *HexDumpTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	hc, ok := l.conns[conn]
+	if !ok {
+		return
+	}
+
+	offset := &hc.serverBytes
+	color := blue
+	if isClient {
+		offset = &hc.clientBytes
+		color = red
+	}
+
+	shown := data
+	if l.MaxLength > 0 {
+		shown = shown[:hexDumpShownLength(*offset, len(data), l.MaxLength)]
+	}
+
+	if len(shown) > 0 {
+		var out bytes.Buffer
+
+		writeDirectionHeader(&out, conn, isClient, timestamps.First)
+		out.WriteString(fmt.Sprintf(", %d bytes\n", len(data)))
+		out.WriteString(color(hexDump(shown, *offset, "")))
+		if len(shown) < len(data) {
+			out.WriteString(fmt.Sprintf("... (%d bytes snipped)\n", len(data)-len(shown)))
+		}
+
+		l.writer.Write(out.Bytes())
+	}
+
+	*offset += len(data)
+}
+
+func (l *HexDumpTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	hc, ok := l.conns[conn]
+	if !ok {
+		return
+	}
+
+	offset := &hc.serverBytes
+	if isClient {
+		offset = &hc.clientBytes
+	}
+
+	if l.MaxLength <= 0 || *offset < l.MaxLength {
+		var out bytes.Buffer
+
+		writeDirectionHeader(&out, conn, isClient, timestamp)
+		out.WriteString("\n" + red(fmt.Sprintf("<incomplete: %d bytes missing>", length)) + "\n")
+
+		l.writer.Write(out.Bytes())
+	}
+
+	*offset += int(length)
+}
+
+func (l *HexDumpTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+}
+
+func (l *HexDumpTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	delete(l.conns, conn)
+}
+
+// hexDumpShownLength returns how much of length bytes at offset fit below
+// maxLength.
+func hexDumpShownLength(offset, length, maxLength int) int {
+	if offset >= maxLength {
+		return 0
+	}
+	if offset+length > maxLength {
+		return maxLength - offset
+	}
+
+	return length
+}
+
+// writeDirectionHeader writes the time, sender, receiver and stream index of
+// data sent in one direction of a connection.
+func writeDirectionHeader(out *bytes.Buffer, conn TCPListenerConnection, isClient bool, timestamp time.Time) {
+	from, fromPort := conn.ClientAddress, conn.ClientPort
+	to, toPort := conn.ServerAddress, conn.ServerPort
+	if !isClient {
+		from, fromPort, to, toPort = to, toPort, from, fromPort
+	}
+
+	out.WriteString(fmt.Sprintf("[%s] %s:%d -> %s:%d, stream %d",
+		timestamp.Format(HTTP_HEADER_TIME_FORMAT),
+		AddressToString(from), fromPort,
+		AddressToString(to), toPort,
+		conn.StreamIndex))
+}
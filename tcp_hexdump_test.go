@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHexDumpFallback(t *testing.T) {
+	cases := []struct {
+		maxLength int
+		want      []string
+		notWant   []string
+	}{
+		{0, []string{
+			"10.0.0.2:80 -> 10.0.0.1:40000, stream 0, 16 bytes\n",
+			blue("00000000  53 53 48 2d 32 2e 30 2d  73 65 72 76 65 72 0d 0a  |SSH-2.0-server..|\n"),
+			"10.0.0.1:40000 -> 10.0.0.2:80, stream 0, 16 bytes\n",
+			red("00000000  53 53 48 2d 32 2e 30 2d  63 6c 69 65 6e 74 0d 0a  |SSH-2.0-client..|\n"),
+			blue("00000010  00 01 02 03                                       |....|\n"),
+		}, nil},
+		{10, []string{
+			blue("00000000  53 53 48 2d 32 2e 30 2d  73 65                    |SSH-2.0-se|\n"),
+			"... (6 bytes snipped)\n",
+		}, []string{
+			"00000010",
+		}},
+	}
+
+	for i, c := range cases {
+		var out bytes.Buffer
+		htl := NewHTTPTcpListener(&out)
+		htl.Fallback = NewHexDumpTCPListener(&out, c.maxLength)
+
+		testReplay(NewTCPStack(htl), 1000, 5000, []testSegment{
+			{false, 0, 0, "SSH-2.0-server\r\n"},
+			{true, 0, 0, "SSH-2.0-client\r\n"},
+			{false, 16, 0, "\x00\x01\x02\x03"},
+			{true, 16, testFIN, ""},
+			{false, 20, testFIN, ""},
+		})
+
+		for _, w := range c.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("TestHexDumpFallback[%d] mismatch, got: %q, want it to contain %q", i, out.String(), w)
+			}
+		}
+		for _, w := range c.notWant {
+			if strings.Contains(out.String(), w) {
+				t.Errorf("TestHexDumpFallback[%d] mismatch, got: %q, want it not to contain %q", i, out.String(), w)
+			}
+		}
+
+		if len(htl.fallbackConns) != 0 || len(htl.conns) != 0 {
+			t.Errorf("TestHexDumpFallback[%d] connection not closed", i)
+		}
+	}
+}
+
+func TestHexDumpFallbackResync(t *testing.T) {
+	var out bytes.Buffer
+	htl := NewHTTPTcpListener(&out)
+	htl.Fallback = NewHexDumpTCPListener(&out, 0)
+	htl.ResyncLimit = 16
+
+	tcpStack := NewTCPStack(htl)
+	tcpStack.MidStreamPickup = true
+
+	//
+	// connection picked up mid-stream without a request boundary within
+	// the limit, everything skipped is passed on
+	//
+	ts := time.Unix(1440000000, 0)
+	tcpStack.NewPacket(testTCPPacket(ts, testServer, testClient, 5000, 1000, testACK, []byte("SSH-2.0-server\r\n")))
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, 1000, 5016, testACK, []byte("\x00\x01\x02\x03")))
+
+	want := []string{
+		blue("00000000  53 53 48 2d 32 2e 30 2d  73 65 72 76 65 72 0d 0a  |SSH-2.0-server..|\n"),
+		red("00000000  00 01 02 03                                       |....|\n"),
+	}
+	for _, w := range want {
+		if !strings.Contains(out.String(), w) {
+			t.Errorf("TestHexDumpFallbackResync mismatch, got: %q, want it to contain %q", out.String(), w)
+		}
+	}
+
+	tcpStack.Close()
+
+	if len(htl.fallbackConns) != 0 || len(htl.conns) != 0 {
+		t.Errorf("TestHexDumpFallbackResync connection not closed")
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// outstanding segments per flow kept for data RTT estimation
+	MAX_RTT_PENDING_SEGMENTS = 64
+)
+
+// FlowMetrics are collected from the segments sent by one end of a
+// connection.
+type FlowMetrics struct {
+	Packets uint64
+	// payload bytes, retransmissions included
+	Bytes uint64
+
+	// data RTT, from sending a segment to the acknowledgement covering it.
+	// Retransmitted segments are not sampled.
+	RTTSamples uint64
+	RTTMin     time.Duration
+	RTTMax     time.Duration
+	RTTTotal   time.Duration
+
+	DuplicateACKs uint64
+	// times the advertised window dropped to zero
+	ZeroWindows uint64
+
+	// advertised receive window, scaled when window scaling is in effect
+	WindowMin  uint32
+	WindowMax  uint32
+	WindowLast uint32
+
+	windowSeen bool
+	highestSeq uint32
+	dataSeen   bool
+	lastAck    uint32
+	ackSeen    bool
+	pending    []pendingSegment
+}
+
+type pendingSegment struct {
+	end  uint32
+	sent time.Time
+}
+
+func (m *FlowMetrics) AddRTT(rtt time.Duration) {
+	if m.RTTSamples == 0 || rtt < m.RTTMin {
+		m.RTTMin = rtt
+	}
+	if rtt > m.RTTMax {
+		m.RTTMax = rtt
+	}
+
+	m.RTTTotal += rtt
+	m.RTTSamples += 1
+}
+
+func (m *FlowMetrics) RTTAvg() time.Duration {
+	if m.RTTSamples == 0 {
+		return 0
+	}
+
+	return m.RTTTotal / time.Duration(m.RTTSamples)
+}
+
+// ConnectionMetrics describe the performance of a connection. Handshake
+// times are zero when the handshake was not captured.
+type ConnectionMetrics struct {
+	Start time.Time
+	End   time.Time
+
+	SYN    time.Time
+	SYNACK time.Time
+	ACK    time.Time
+
+	Client FlowMetrics
+	Server FlowMetrics
+}
+
+func (m *ConnectionMetrics) Duration() time.Duration {
+	return m.End.Sub(m.Start)
+}
+
+// HandshakeRTT returns the time from SYN to the ACK of the SYN-ACK, or zero
+// when the handshake was not seen completely.
+func (m *ConnectionMetrics) HandshakeRTT() time.Duration {
+	if m.SYN.IsZero() || m.ACK.IsZero() {
+		return 0
+	}
+
+	return m.ACK.Sub(m.SYN)
+}
+
+// ServerRTT returns the time from SYN to SYN-ACK, the round trip between
+// the capture point and the server.
+func (m *ConnectionMetrics) ServerRTT() time.Duration {
+	if m.SYN.IsZero() || m.SYNACK.IsZero() {
+		return 0
+	}
+
+	return m.SYNACK.Sub(m.SYN)
+}
+
+// ClientRTT returns the time from SYN-ACK to ACK, the round trip between
+// the capture point and the client.
+func (m *ConnectionMetrics) ClientRTT() time.Duration {
+	if m.SYNACK.IsZero() || m.ACK.IsZero() {
+		return 0
+	}
+
+	return m.ACK.Sub(m.SYNACK)
+}
+
+// MetricsTotals sum up the metrics of closed connections.
+type MetricsTotals struct {
+	Connections       uint64
+	Handshakes        uint64
+	HandshakeRTTTotal time.Duration
+	Packets           uint64
+	Bytes             uint64
+	DuplicateACKs     uint64
+	ZeroWindows       uint64
+}
+
+func (t *MetricsTotals) HandshakeRTTAvg() time.Duration {
+	if t.Handshakes == 0 {
+		return 0
+	}
+
+	return t.HandshakeRTTTotal / time.Duration(t.Handshakes)
+}
+
+func (t *MetricsTotals) add(m *ConnectionMetrics) {
+	t.Connections += 1
+	if rtt := m.HandshakeRTT(); rtt > 0 {
+		t.Handshakes += 1
+		t.HandshakeRTTTotal += rtt
+	}
+
+	for _, f := range []*FlowMetrics{&m.Client, &m.Server} {
+		t.Packets += f.Packets
+		t.Bytes += f.Bytes
+		t.DuplicateACKs += f.DuplicateACKs
+		t.ZeroWindows += f.ZeroWindows
+	}
+}
+
+// updateMetrics accounts a packet of conn sent by from. Called for every
+// packet of the connection, before reassembly.
+func (tcpStack *TCPStack) updateMetrics(conn *TCPConnection, from, to *Flow, isClient bool, packet *Packet) {
+	m := &conn.Metrics
+	tcpHeader := packet.TCP.Header
+	timestamp := packet.Timestamp()
+	payloadLength := uint32(len(packet.TCP.Payload))
+
+	if m.Start.IsZero() {
+		m.Start = timestamp
+	}
+	m.End = timestamp
+
+	sender, receiver := &m.Server, &m.Client
+	if isClient {
+		sender, receiver = &m.Client, &m.Server
+	}
+
+	sender.Packets += 1
+	sender.Bytes += uint64(payloadLength)
+
+	//
+	// handshake
+	//
+	switch {
+	case tcpHeader.FlagSYN() && !tcpHeader.FlagACK():
+		if m.SYN.IsZero() {
+			m.SYN = timestamp
+		}
+	case tcpHeader.FlagSYN() && tcpHeader.FlagACK():
+		if m.SYNACK.IsZero() {
+			m.SYNACK = timestamp
+		}
+	case isClient && tcpHeader.FlagACK() && !m.SYNACK.IsZero() && m.ACK.IsZero():
+		if tcpHeader.AcknowledgeNumber() == to.InitialSequenceNumber+1 {
+			m.ACK = timestamp
+		}
+	}
+
+	//
+	// data sent, sample new data only (Karn's algorithm)
+	//
+	if payloadLength > 0 {
+		seq := tcpHeader.SequenceNumber()
+		end := seq + payloadLength
+
+		if !sender.dataSeen || seqGT(end, sender.highestSeq) {
+			if sender.dataSeen && seqLT(seq, sender.highestSeq) {
+				sender.dropPending(end)
+			} else if len(sender.pending) < MAX_RTT_PENDING_SEGMENTS {
+				sender.pending = append(sender.pending, pendingSegment{end, timestamp})
+			}
+
+			sender.highestSeq = end
+			sender.dataSeen = true
+		} else {
+			sender.dropPending(end)
+		}
+	}
+
+	if tcpHeader.FlagRST() {
+		return
+	}
+
+	//
+	// window advertised by the sender
+	//
+	window := from.Window
+	windowChanged := sender.windowSeen && window != sender.WindowLast
+	if window == 0 && (!sender.windowSeen || sender.WindowLast != 0) {
+		sender.ZeroWindows += 1
+	}
+	if !sender.windowSeen || window < sender.WindowMin {
+		sender.WindowMin = window
+	}
+	if window > sender.WindowMax {
+		sender.WindowMax = window
+	}
+	sender.WindowLast = window
+	sender.windowSeen = true
+
+	//
+	// acknowledgement of the other direction
+	//
+	if !tcpHeader.FlagACK() {
+		return
+	}
+
+	ack := tcpHeader.AcknowledgeNumber()
+
+	//
+	// duplicate as defined in RFC 5681: no data, same window, data of the
+	// other side outstanding. Repeated zero windows are not duplicates.
+	//
+	if sender.ackSeen && ack == sender.lastAck && payloadLength == 0 && !windowChanged && window != 0 &&
+		!tcpHeader.FlagSYN() && !tcpHeader.FlagFIN() &&
+		receiver.dataSeen && seqGT(receiver.highestSeq, ack) {
+		sender.DuplicateACKs += 1
+	}
+
+	if !sender.ackSeen || seqGT(ack, sender.lastAck) {
+		receiver.ackPending(ack, timestamp)
+	}
+
+	sender.lastAck = ack
+	sender.ackSeen = true
+}
+
+// ackPending takes an RTT sample from the latest outstanding segment
+// covered by ack.
+func (m *FlowMetrics) ackPending(ack uint32, timestamp time.Time) {
+	n := 0
+	for n < len(m.pending) && seqLEQ(m.pending[n].end, ack) {
+		n += 1
+	}
+
+	if n == 0 {
+		return
+	}
+
+	m.AddRTT(timestamp.Sub(m.pending[n-1].sent))
+	m.pending = m.pending[n:]
+}
+
+// dropPending forgets the outstanding segments overlapping a
+// retransmission ending at end, their acknowledgements are ambiguous.
+func (m *FlowMetrics) dropPending(end uint32) {
+	n := 0
+	for n < len(m.pending) && seqLEQ(m.pending[n].end, end) {
+		n += 1
+	}
+	if n < len(m.pending) {
+		n += 1
+	}
+
+	m.pending = m.pending[n:]
+}
+
+// WriteConnectionSummary writes the metrics of a connection. The summary is
+// written at once, so that summaries of concurrent stacks do not mix.
+func WriteConnectionSummary(w io.Writer, conn *TCPConnection) {
+	var out bytes.Buffer
+	m := &conn.Metrics
+	a := conn.ClientFlow.Address
+
+	out.WriteString(fmt.Sprintf("[tcp] %s:%d -> %s:%d, duration %s, handshake rtt %s (server %s, client %s)\n",
+		AddressToString(a.SourceAddress), a.SourcePort,
+		AddressToString(a.DestinationAddress), a.DestinationPort,
+		m.Duration(), durationString(m.HandshakeRTT()), durationString(m.ServerRTT()), durationString(m.ClientRTT())))
+
+	writeFlowSummary(&out, "client", &m.Client, conn.ClientFlow)
+	writeFlowSummary(&out, "server", &m.Server, conn.ServerFlow)
+
+	w.Write(out.Bytes())
+}
+
+func writeFlowSummary(out *bytes.Buffer, name string, m *FlowMetrics, f *Flow) {
+	rtt := "-"
+	if m.RTTSamples > 0 {
+		rtt = fmt.Sprintf("%s/%s/%s (%d samples)", m.RTTMin, m.RTTAvg(), m.RTTMax, m.RTTSamples)
+	}
+
+	out.WriteString(fmt.Sprintf("  %s: %d packets, %d bytes, rtt min/avg/max %s, %d retransmissions, %d dup acks, %d zero windows, window %d..%d (last %d)\n",
+		name, m.Packets, m.Bytes, rtt, f.Stats.Retransmissions, m.DuplicateACKs, m.ZeroWindows,
+		m.WindowMin, m.WindowMax, m.WindowLast))
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+
+	return d.String()
+}
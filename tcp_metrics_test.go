@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPStackMetrics(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	var summary bytes.Buffer
+	tcpStack.SummaryWriter = &summary
+
+	ts := time.Unix(1440000000, 0)
+	at := func(ms int) time.Time {
+		return ts.Add(time.Duration(ms) * time.Millisecond)
+	}
+	c, s := uint32(1000), uint32(5000)
+
+	packets := []*Packet{
+		testTCPPacket(at(0), testClient, testServer, c, 0, testSYN, nil),
+		testTCPPacket(at(30), testServer, testClient, s, c+1, testSYN|testACK, nil),
+		testTCPPacket(at(35), testClient, testServer, c+1, s+1, testACK, nil),
+		// request acknowledged after 40ms
+		testTCPPacket(at(40), testClient, testServer, c+1, s+1, testACK|testPSH, []byte("abcd")),
+		testTCPPacket(at(80), testServer, testClient, s+1, c+5, testACK, nil),
+		// retransmitted segment is not sampled
+		testTCPPacket(at(100), testServer, testClient, s+1, c+5, testACK, []byte("efgh")),
+		testTCPPacket(at(300), testServer, testClient, s+1, c+5, testACK, []byte("efgh")),
+		testTCPPacket(at(310), testClient, testServer, c+5, s+5, testACK, nil),
+		// lost segment, duplicate acks for the one after it
+		testTCPPacket(at(320), testServer, testClient, s+5, c+5, testACK, []byte("ijkl")),
+		testTCPPacket(at(321), testServer, testClient, s+9, c+5, testACK, []byte("mnop")),
+		testTCPPacket(at(330), testClient, testServer, c+5, s+5, testACK, nil),
+		testTCPPacket(at(331), testClient, testServer, c+5, s+5, testACK, nil),
+		// client stops receiving
+		testTCPPacketOptions(at(340), testClient, testServer, c+5, s+5, testACK, 0, nil, nil),
+		testTCPPacketOptions(at(350), testClient, testServer, c+5, s+5, testACK, 0, nil, nil),
+		testTCPPacket(at(400), testClient, testServer, c+5, s+5, testACK|testRST, nil),
+	}
+
+	for _, packet := range packets {
+		tcpStack.NewPacket(packet)
+	}
+
+	if l.closedConnections != 1 {
+		t.Fatalf("TestTCPStackMetrics connection not closed")
+	}
+
+	totals := tcpStack.Totals
+	want := MetricsTotals{
+		Connections:       1,
+		Handshakes:        1,
+		HandshakeRTTTotal: 35 * time.Millisecond,
+		Packets:           15,
+		Bytes:             20,
+		DuplicateACKs:     2,
+		ZeroWindows:       1,
+	}
+	if totals != want {
+		t.Errorf("TestTCPStackMetrics totals mismatch, got: %+v, want %+v", totals, want)
+	}
+
+	out := summary.String()
+	for _, s := range []string{
+		"handshake rtt 35ms (server 30ms, client 5ms)",
+		"client: 9 packets, 4 bytes, rtt min/avg/max 40ms/40ms/40ms (1 samples), 0 retransmissions, 2 dup acks, 1 zero windows, window 0..65535",
+		"server: 6 packets, 16 bytes, rtt min/avg/max -, 1 retransmissions, 0 dup acks, 0 zero windows",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("TestTCPStackMetrics summary mismatch, got: %q, want to contain %q", out, s)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	TCP_OPTION_KIND_END            = 0
+	TCP_OPTION_KIND_NOP            = 1
+	TCP_OPTION_KIND_MSS            = 2
+	TCP_OPTION_KIND_WINDOW_SCALE   = 3
+	TCP_OPTION_KIND_SACK_PERMITTED = 4
+	TCP_OPTION_KIND_SACK           = 5
+	TCP_OPTION_KIND_TIMESTAMPS     = 8
+	TCP_OPTION_KIND_MPTCP          = 30
+	TCP_OPTION_KIND_FAST_OPEN      = 34
+	TCP_OPTION_KIND_EXPERIMENTAL   = 254
+)
+
+const (
+	// experiment id of TCP Fast Open before it got its own kind
+	TCP_OPTION_EXPERIMENT_FAST_OPEN = 0xF989
+
+	// largest shift allowed by RFC 7323
+	TCP_MAX_WINDOW_SCALE = 14
+)
+
+// TCPOption is a single option in the order it appears in the header. Data
+// does not include the kind and length bytes.
+type TCPOption struct {
+	Kind uint8
+	Data []byte
+}
+
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// TCPOptions holds the decoded values of known options.
+type TCPOptions struct {
+	HasMSS bool
+	MSS    uint16
+
+	HasWindowScale bool
+	WindowScale    uint8
+
+	SACKPermitted bool
+	SACKBlocks    []SACKBlock
+
+	HasTimestamps      bool
+	TimestampValue     uint32
+	TimestampEchoReply uint32
+
+	// cookie is empty on a cookie request
+	HasFastOpen    bool
+	FastOpenCookie []byte
+
+	HasMPTCP     bool
+	MPTCPSubtype uint8
+
+	// options of unknown kinds
+	Unknown []TCPOption
+}
+
+// ParseTCPOptions splits the options region of a TCP header into options.
+// Parsing stops at the end of option list.
+func ParseTCPOptions(data []byte) ([]TCPOption, error) {
+	var opts []TCPOption
+
+	for i := 0; i < len(data); {
+		kind := data[i]
+
+		switch kind {
+		case TCP_OPTION_KIND_END:
+			return opts, nil
+		case TCP_OPTION_KIND_NOP:
+			opts = append(opts, TCPOption{Kind: kind})
+			i += 1
+			continue
+		}
+
+		if i+2 > len(data) {
+			return opts, errors.New(fmt.Sprintf("tcp option %d truncated at offset %d.", kind, i))
+		}
+
+		length := int(data[i+1])
+		if length < 2 || i+length > len(data) {
+			return opts, errors.New(fmt.Sprintf("invalid length %d for tcp option %d.", length, kind))
+		}
+
+		opts = append(opts, TCPOption{Kind: kind, Data: data[i+2 : i+length]})
+		i += length
+	}
+
+	return opts, nil
+}
+
+// DecodeTCPOptions parses the options region of a TCP header and decodes
+// the known options.
+func DecodeTCPOptions(data []byte) (TCPOptions, error) {
+	var o TCPOptions
+
+	opts, err := ParseTCPOptions(data)
+	if err != nil {
+		return o, err
+	}
+
+	for _, opt := range opts {
+		if err := o.add(opt); err != nil {
+			return o, err
+		}
+	}
+
+	return o, nil
+}
+
+func (o *TCPOptions) add(opt TCPOption) error {
+	d := opt.Data
+
+	switch opt.Kind {
+	case TCP_OPTION_KIND_NOP:
+		// padding
+	case TCP_OPTION_KIND_MSS:
+		if len(d) != 2 {
+			return tcpOptionLengthError(opt)
+		}
+		o.HasMSS = true
+		o.MSS = binary.BigEndian.Uint16(d)
+	case TCP_OPTION_KIND_WINDOW_SCALE:
+		if len(d) != 1 {
+			return tcpOptionLengthError(opt)
+		}
+		o.HasWindowScale = true
+		o.WindowScale = d[0]
+	case TCP_OPTION_KIND_SACK_PERMITTED:
+		if len(d) != 0 {
+			return tcpOptionLengthError(opt)
+		}
+		o.SACKPermitted = true
+	case TCP_OPTION_KIND_SACK:
+		if len(d) == 0 || len(d)%8 != 0 {
+			return tcpOptionLengthError(opt)
+		}
+		for i := 0; i < len(d); i += 8 {
+			o.SACKBlocks = append(o.SACKBlocks, SACKBlock{
+				Left:  binary.BigEndian.Uint32(d[i : i+4]),
+				Right: binary.BigEndian.Uint32(d[i+4 : i+8]),
+			})
+		}
+	case TCP_OPTION_KIND_TIMESTAMPS:
+		if len(d) != 8 {
+			return tcpOptionLengthError(opt)
+		}
+		o.HasTimestamps = true
+		o.TimestampValue = binary.BigEndian.Uint32(d[0:4])
+		o.TimestampEchoReply = binary.BigEndian.Uint32(d[4:8])
+	case TCP_OPTION_KIND_MPTCP:
+		if len(d) == 0 {
+			return tcpOptionLengthError(opt)
+		}
+		o.HasMPTCP = true
+		o.MPTCPSubtype = d[0] >> 4
+	case TCP_OPTION_KIND_FAST_OPEN:
+		o.HasFastOpen = true
+		o.FastOpenCookie = d
+	case TCP_OPTION_KIND_EXPERIMENTAL:
+		if len(d) >= 2 && binary.BigEndian.Uint16(d[0:2]) == TCP_OPTION_EXPERIMENT_FAST_OPEN {
+			o.HasFastOpen = true
+			o.FastOpenCookie = d[2:]
+		} else {
+			o.Unknown = append(o.Unknown, opt)
+		}
+	default:
+		o.Unknown = append(o.Unknown, opt)
+	}
+
+	return nil
+}
+
+func tcpOptionLengthError(opt TCPOption) error {
+	return errors.New(fmt.Sprintf("invalid length %d for tcp option %s.", len(opt.Data)+2, TCPOptionKindToString(opt.Kind)))
+}
+
+// ScaledWindow returns the advertised window of a segment shifted by the
+// window scale negotiated for its sender.
+func ScaledWindow(window uint16, scale uint8) uint32 {
+	if scale > TCP_MAX_WINDOW_SCALE {
+		scale = TCP_MAX_WINDOW_SCALE
+	}
+
+	return uint32(window) << scale
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTCPFrameOptions(t *testing.T) {
+	data := []byte{
+		0x30, 0x39, 0x00, 0x50,
+		0x01, 0x02, 0x03, 0x04,
+		0x04, 0x03, 0x02, 0x01,
+		0x70, 0x02, // Data Offset 28 + SYN
+		0x39, 0x08, 0x00, 0x00, 0x00, 0x00,
+		0x02, 0x04, 0x05, 0xb4, // MSS 1460
+		0x01, 0x03, 0x03, 0x07, // NOP, Window Scale 7
+		'G', 'E', 'T',
+	}
+
+	f, err := NewTCPFrame(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := data[20:28]; !bytes.Equal(f.Options, want) {
+		t.Errorf("TestTCPFrameOptions options mismatch, got: %v, want %v", f.Options, want)
+	}
+
+	if want := []byte("GET"); !bytes.Equal(f.Payload, want) {
+		t.Errorf("TestTCPFrameOptions payload mismatch, got: %v, want %v", f.Payload, want)
+	}
+
+	bad := append([]byte{}, data...)
+	bad[12] = 0x40
+	if _, err := NewTCPFrame(bad); err == nil {
+		t.Errorf("TestTCPFrameOptions data offset below header length accepted")
+	}
+}
+
+func TestDecodeTCPOptions(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want TCPOptions
+		str  string
+		err  bool
+	}{
+		// typical Linux SYN
+		{[]byte{
+			0x02, 0x04, 0x05, 0xb4,
+			0x04, 0x02,
+			0x08, 0x0a, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+			0x01,
+			0x03, 0x03, 0x07,
+		}, TCPOptions{
+			HasMSS: true, MSS: 1460,
+			SACKPermitted: true,
+			HasTimestamps: true, TimestampValue: 1,
+			HasWindowScale: true, WindowScale: 7,
+		}, "mss 1460,sackOK,TS val 1 ecr 0,nop,wscale 7", false},
+		// SACK blocks
+		{[]byte{
+			0x01, 0x01,
+			0x05, 0x12,
+			0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x20,
+			0x00, 0x00, 0x00, 0x30, 0x00, 0x00, 0x00, 0x40,
+		}, TCPOptions{
+			SACKBlocks: []SACKBlock{{16, 32}, {48, 64}},
+		}, "nop,nop,sack 2 {16:32}{48:64}", false},
+		// fast open cookie request, cookie and experimental cookie
+		{[]byte{0x22, 0x02}, TCPOptions{HasFastOpen: true, FastOpenCookie: []byte{}}, "tfo cookiereq", false},
+		{[]byte{0x22, 0x04, 0xab, 0xcd}, TCPOptions{HasFastOpen: true, FastOpenCookie: []byte{0xab, 0xcd}}, "tfo cookie abcd", false},
+		{[]byte{0xfe, 0x06, 0xf9, 0x89, 0xab, 0xcd}, TCPOptions{HasFastOpen: true, FastOpenCookie: []byte{0xab, 0xcd}}, "tfo cookie abcd", false},
+		// MPTCP MP_CAPABLE
+		{[]byte{0x1e, 0x04, 0x01, 0x81}, TCPOptions{HasMPTCP: true, MPTCPSubtype: 0}, "mptcp subtype 0", false},
+		// unknown kind, options after end of list are ignored
+		{[]byte{0x45, 0x03, 0x01, 0x00, 0x02, 0x04}, TCPOptions{
+			Unknown: []TCPOption{{0x45, []byte{0x01}}},
+		}, "unknown-69 len 3", false},
+		// truncated
+		{[]byte{0x02, 0x04, 0x05}, TCPOptions{}, "bad opts", true},
+		// wrong length for kind
+		{[]byte{0x02, 0x03, 0x05, 0x00}, TCPOptions{}, "bad mss", true},
+	}
+
+	for i, c := range cases {
+		got, err := DecodeTCPOptions(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("TestDecodeTCPOptions[%d] error mismatch, got: %v, want error %t", i, err, c.err)
+		}
+
+		if !c.err && !reflect.DeepEqual(got, c.want) {
+			t.Errorf("TestDecodeTCPOptions[%d] mismatch, got: %+v, want %+v", i, got, c.want)
+		}
+
+		if s := TCPOptionsString(c.in); s != c.str {
+			t.Errorf("TestDecodeTCPOptions[%d] string mismatch, got: %q, want %q", i, s, c.str)
+		}
+	}
+}
+
+func TestTCPStackWindowScale(t *testing.T) {
+	ws := func(shift uint8) []byte {
+		return []byte{TCP_OPTION_KIND_NOP, TCP_OPTION_KIND_WINDOW_SCALE, 3, shift}
+	}
+
+	cases := []struct {
+		clientOpts   []byte
+		serverOpts   []byte
+		clientWindow uint32
+		serverWindow uint32
+	}{
+		{ws(7), ws(2), 100 << 7, 100 << 2},
+		// only one side offers scaling
+		{ws(7), nil, 100, 100},
+		// shift above the maximum is limited
+		{ws(20), ws(0), 100 << TCP_MAX_WINDOW_SCALE, 100},
+	}
+
+	for i, c := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+		ts := time.Unix(1440000000, 0)
+
+		tcpStack.NewPacket(testTCPPacketOptions(ts, testClient, testServer, 1000, 0, testSYN, 29200, c.clientOpts, nil))
+		tcpStack.NewPacket(testTCPPacketOptions(ts, testServer, testClient, 5000, 1001, testSYN|testACK, 28960, c.serverOpts, nil))
+
+		tcpStack.NewPacket(testTCPPacketOptions(ts, testClient, testServer, 1001, 5001, testACK, 100, nil, nil))
+		tcpStack.NewPacket(testTCPPacketOptions(ts, testServer, testClient, 5001, 1001, testACK, 100, nil, nil))
+
+		conn := tcpStack.connections[testFlowAddress(testClient, testServer)]
+		if conn == nil {
+			t.Fatalf("TestTCPStackWindowScale[%d] connection not found", i)
+		}
+
+		if conn.ClientFlow.Window != c.clientWindow {
+			t.Errorf("TestTCPStackWindowScale[%d] client window mismatch, got: %d, want %d", i, conn.ClientFlow.Window, c.clientWindow)
+		}
+
+		if conn.ServerFlow.Window != c.serverWindow {
+			t.Errorf("TestTCPStackWindowScale[%d] server window mismatch, got: %d, want %d", i, conn.ServerFlow.Window, c.serverWindow)
+		}
+	}
+}
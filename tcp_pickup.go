@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ports which are assumed to be on the server side of a connection when
+// the handshake was not captured
+var wellKnownServerPorts = map[uint16]bool{
+	3128: true,
+	5432: true,
+	6379: true,
+	8000: true,
+	8008: true,
+	8080: true,
+	8443: true,
+	8888: true,
+	9200: true,
+}
+
+func isWellKnownServerPort(port uint16) bool {
+	return port < 1024 || wellKnownServerPorts[port]
+}
+
+// guessSenderIsClient infers the direction of a connection of which the
+// handshake was not seen, from the first data segment. Payload heuristics
+// are the most reliable, then well-known ports and finally the lower port
+// is assumed to belong to the server.
+func guessSenderIsClient(flowAddress FlowAddress, payload []byte) bool {
+	switch {
+	case isHttpReq(payload):
+		return true
+	case isHttpResp(payload):
+		return false
+	}
+
+	srcWellKnown := isWellKnownServerPort(flowAddress.SourcePort)
+	dstWellKnown := isWellKnownServerPort(flowAddress.DestinationPort)
+
+	if srcWellKnown != dstWellKnown {
+		return dstWellKnown
+	}
+
+	return flowAddress.SourcePort > flowAddress.DestinationPort
+}
+
+// pickupConnection creates a connection from a data segment of an unknown
+// flow, used when capture started after the connection was opened.
+// Reassembly starts from this segment, the other direction is synchronized
+// from the acknowledge number or from its first segment.
+func (tcpStack *TCPStack) pickupConnection(flowAddress FlowAddress, packet *Packet) *TCPConnection {
+	isClient := guessSenderIsClient(flowAddress, packet.TCP.Payload)
+
+	clientFlowAddress := flowAddress
+	if !isClient {
+		clientFlowAddress = flowAddress.Reverse()
+	}
+
+	conn := tcpStack.newConnection(clientFlowAddress, packet)
+	conn.MidStream = true
+
+	if !isClient {
+		conn.reverseDirection()
+	}
+
+	from, to, _ := conn.Flows(flowAddress)
+	from.SetInitialSequence(packet.TCP.Header.SequenceNumber())
+	if packet.TCP.Header.FlagACK() {
+		to.SetInitialSequence(packet.TCP.Header.AcknowledgeNumber())
+	}
+
+	tcpstackdebug(fmt.Sprintf("picked up connection in progress, client %s:%d, server %s:%d",
+		AddressToString(clientFlowAddress.SourceAddress), clientFlowAddress.SourcePort,
+		AddressToString(clientFlowAddress.DestinationAddress), clientFlowAddress.DestinationPort))
+
+	return conn
+}
+
+// synAckConnection creates a connection from a SYN-ACK of an unknown flow,
+// used when capture started between the SYN and the SYN-ACK. The receiver
+// is the client and its data starts at the acknowledge number. Data sent
+// with the SYN (TCP Fast Open) was not captured.
+func (tcpStack *TCPStack) synAckConnection(flowAddress FlowAddress, packet *Packet) *TCPConnection {
+	conn := tcpStack.newConnection(flowAddress.Reverse(), packet)
+	conn.reverseDirection()
+
+	ack := packet.TCP.Header.AcknowledgeNumber()
+	conn.ClientFlow.SetInitialSequence(ack - 1)
+	conn.ClientFlow.ExpectedSequenceNumber = ack
+
+	tcpstackdebug(fmt.Sprintf("opened connection from SYN-ACK, client %s:%d, server %s:%d",
+		AddressToString(flowAddress.DestinationAddress), flowAddress.DestinationPort,
+		AddressToString(flowAddress.SourceAddress), flowAddress.SourcePort))
+
+	return conn
+}
+
+// reverseDirection swaps the capture direction of a connection created from
+// a server's packet, direction is recorded for the client's packets.
+func (conn *TCPConnection) reverseDirection() {
+	switch conn.Direction {
+	case DIRECTION_INBOUND:
+		conn.Direction = DIRECTION_OUTBOUND
+	case DIRECTION_OUTBOUND:
+		conn.Direction = DIRECTION_INBOUND
+	}
+}
+
+func isHttpResp(data []byte) bool {
+	// 'HTTP/1.1 200'
+	return len(data) >= 12 &&
+		bytes.HasPrefix(data, []byte("HTTP/")) &&
+		'0' <= data[5] && data[5] <= '9' &&
+		data[6] == '.' &&
+		'0' <= data[7] && data[7] <= '9' &&
+		data[8] == ' '
+}
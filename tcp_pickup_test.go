@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestGuessSenderIsClient(t *testing.T) {
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	cases := []struct {
+		srcPort, dstPort uint16
+		payload          []byte
+		want             bool
+	}{
+		// payload heuristics win over ports
+		{80, 40000, []byte("GET / HTTP/1.1\r\n"), true},
+		{40000, 80, []byte("HTTP/1.1 200 OK\r\n"), false},
+		// well-known ports
+		{40000, 80, []byte("foo"), true},
+		{443, 40000, []byte("foo"), false},
+		{50000, 8080, []byte("foo"), true},
+		// lower port
+		{20000, 30000, []byte("foo"), false},
+		{30000, 20000, []byte("foo"), true},
+	}
+
+	for i, c := range cases {
+		flowAddress := FlowAddress{addr, c.srcPort, addr, c.dstPort}
+
+		got := guessSenderIsClient(flowAddress, c.payload)
+		if got != c.want {
+			t.Errorf("TestGuessSenderIsClient[%d] mismatch, got: %t, want %t", i, got, c.want)
+		}
+	}
+}
+
+func TestTCPStackMidStreamPickup(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	c, s := uint32(0x10000), uint32(0x20000)
+
+	tail := []byte("tail of an earlier response")
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	response := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+
+	packets := []*Packet{
+		// pure ACK of an unknown connection is ignored
+		testTCPPacket(ts, testClient, testServer, c, s, testACK, nil),
+		testTCPPacket(ts, testServer, testClient, s, c, testACK|testPSH, tail),
+		testTCPPacket(ts, testClient, testServer, c, s+uint32(len(tail)), testACK|testPSH, request),
+		testTCPPacket(ts, testServer, testClient, s+uint32(len(tail)), c+uint32(len(request)), testACK|testPSH, response),
+	}
+
+	for _, enabled := range []bool{false, true} {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+		tcpStack.MidStreamPickup = enabled
+
+		for _, packet := range packets {
+			tcpStack.NewPacket(packet)
+		}
+
+		if !enabled {
+			if l.newConnections != 0 || l.serverData.Len() != 0 {
+				t.Errorf("TestTCPStackMidStreamPickup: connection picked up while disabled")
+			}
+			continue
+		}
+
+		if l.newConnections != 1 || !l.conn.MidStream {
+			t.Fatalf("TestTCPStackMidStreamPickup: expected one mid-stream connection, got %d", l.newConnections)
+		}
+
+		if l.conn.ServerPort != testServer.Port || AddressToString(l.conn.ClientAddress) != testClient.Address {
+			t.Errorf("TestTCPStackMidStreamPickup: direction mismatch, got client %s, server port %d", AddressToString(l.conn.ClientAddress), l.conn.ServerPort)
+		}
+
+		if got := l.clientData.String(); got != string(request) {
+			t.Errorf("TestTCPStackMidStreamPickup client data mismatch, got: %q, want %q", got, request)
+		}
+
+		if got, want := l.serverData.String(), string(tail)+string(response); got != want {
+			t.Errorf("TestTCPStackMidStreamPickup server data mismatch, got: %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type OverlapPolicy uint8
+
+const (
+	// data seen first is kept, like most TCP stacks do
+	OVERLAP_FIRST_WINS OverlapPolicy = iota
+	// data seen last replaces buffered data, already delivered data is
+	// never replaced
+	OVERLAP_LAST_WINS
+)
+
+const (
+	DEFAULT_RETRANSMISSION_HISTORY = 16 * 1024
+	DEFAULT_GAP_TIMEOUT            = 10 * time.Second
+	DEFAULT_GAP_BUFFER_THRESHOLD   = 4 * 1024 * 1024
+)
+
+func ParseOverlapPolicy(s string) (OverlapPolicy, error) {
+	switch s {
+	case "first":
+		return OVERLAP_FIRST_WINS, nil
+	case "last":
+		return OVERLAP_LAST_WINS, nil
+	default:
+		return OVERLAP_FIRST_WINS, errors.New("overlap policy must be 'first' or 'last'.")
+	}
+}
+
+type ReassemblyStats struct {
+	// segments of which all data was already delivered
+	Retransmissions uint64
+	// segments partially overlapping delivered or buffered data
+	Overlaps uint64
+	// overlapping data which differs from the data seen before
+	Inconsistencies uint64
+	// skipped holes of lost data and their total length
+	Gaps     uint64
+	GapBytes uint64
+}
+
+func (tcpStack *TCPStack) countRetransmission(f *Flow) {
+	f.Stats.Retransmissions += 1
+	tcpStack.Stats.Retransmissions += 1
+}
+
+func (tcpStack *TCPStack) countOverlap(f *Flow) {
+	f.Stats.Overlaps += 1
+	tcpStack.Stats.Overlaps += 1
+}
+
+func (tcpStack *TCPStack) countGap(f *Flow, length uint32) {
+	f.Stats.Gaps += 1
+	f.Stats.GapBytes += uint64(length)
+	tcpStack.Stats.Gaps += 1
+	tcpStack.Stats.GapBytes += uint64(length)
+}
+
+func (tcpStack *TCPStack) countInconsistency(f *Flow) {
+	f.Stats.Inconsistencies += 1
+	tcpStack.Stats.Inconsistencies += 1
+
+	tcpstackdebug(fmt.Sprintf("tcp-debug: inconsistent retransmitted data %s:%d -> %s:%d",
+		AddressToString(f.Address.SourceAddress), f.Address.SourcePort,
+		AddressToString(f.Address.DestinationAddress), f.Address.DestinationPort))
+}
+
+// trimSegment removes the bytes before the expected sequence number from a
+// segment starting in the past. Returns nil when nothing new is left.
+func (tcpStack *TCPStack) trimSegment(f *Flow, segment *BufferedPacket) *BufferedPacket {
+	tcpHeader := segment.Packet.TCP.Header
+	overlap := int(seqDiff(f.ExpectedSequenceNumber, segment.Seq))
+	if overlap > len(segment.Payload) {
+		overlap = len(segment.Payload)
+	}
+
+	//
+	// overlaps between buffered segments are counted when buffering
+	//
+	count := !segment.accounted
+
+	if count && overlap > 0 && !f.matchesHistory(segment.Seq, segment.Payload[:overlap]) {
+		tcpStack.countInconsistency(f)
+	}
+
+	if overlap == len(segment.Payload) {
+		if len(segment.Payload) > 0 {
+			tcpstackdebug(fmt.Sprintf("tcp-debug: ignored past packet. Expected %d, got %d (diff: %d).",
+				f.ExpectedSequenceNumber, segment.Seq, seqDiff(f.ExpectedSequenceNumber, segment.Seq)))
+			if count {
+				tcpStack.countRetransmission(f)
+			}
+		}
+
+		//
+		// flags right at the expected sequence number still need handling
+		//
+		end := segment.Seq + uint32(len(segment.Payload))
+		if end == f.ExpectedSequenceNumber && (tcpHeader.FlagFIN() || tcpHeader.FlagRST()) {
+			return &BufferedPacket{Packet: segment.Packet, Seq: end, order: segment.order}
+		}
+
+		return nil
+	}
+
+	if count {
+		tcpStack.countOverlap(f)
+	}
+
+	return &BufferedPacket{
+		Packet:  segment.Packet,
+		Seq:     f.ExpectedSequenceNumber,
+		Payload: segment.Payload[overlap:],
+		order:   segment.order,
+	}
+}
+
+// bufferSegment stores a future segment. Data overlapping already buffered
+// segments is resolved here according to the overlap policy, so the
+// buffered segments agree with each other when they are drained.
+func (tcpStack *TCPStack) bufferSegment(f *Flow, segment *BufferedPacket) {
+	segment.order = f.bufferCount
+	f.bufferCount += 1
+
+	if len(f.Buffer) == 0 {
+		f.bufferedSince = segment.Packet.Timestamp()
+	}
+
+	for _, bp := range f.Buffer {
+		var overlapped, differs bool
+
+		switch tcpStack.OverlapPolicy {
+		case OVERLAP_LAST_WINS:
+			overlapped, differs = overwriteOverlap(bp, segment)
+		default:
+			overlapped, differs = overwriteOverlap(segment, bp)
+		}
+
+		if overlapped {
+			bp.accounted = true
+			segment.accounted = true
+
+			if bp.Seq == segment.Seq && len(bp.Payload) == len(segment.Payload) {
+				tcpStack.countRetransmission(f)
+			} else {
+				tcpStack.countOverlap(f)
+			}
+		}
+		if differs {
+			tcpStack.countInconsistency(f)
+		}
+	}
+
+	compactSegment(segment)
+
+	f.Buffer = append(f.Buffer, segment)
+	f.bufferedBytes += len(segment.Payload)
+	tcpStack.bufferedBytes += len(segment.Payload)
+}
+
+// nextBufferedSegment removes and returns the buffered segment covering the
+// expected sequence number, trimmed to start at it. Segments which fall
+// entirely before the expected sequence number are stale and dropped on
+// the way.
+func (tcpStack *TCPStack) nextBufferedSegment(f *Flow) *BufferedPacket {
+	for {
+		idx := -1
+		for i, bp := range f.Buffer {
+			if seqGT(bp.Seq, f.ExpectedSequenceNumber) {
+				continue
+			}
+
+			if idx == -1 || bp.order < f.Buffer[idx].order {
+				idx = i
+			}
+		}
+
+		if idx == -1 {
+			return nil
+		}
+
+		bp := f.Buffer[idx]
+		f.Buffer = append(f.Buffer[:idx], f.Buffer[idx+1:]...)
+		f.bufferedBytes -= len(bp.Payload)
+		tcpStack.bufferedBytes -= len(bp.Payload)
+
+		if bp.Seq == f.ExpectedSequenceNumber {
+			return bp
+		}
+
+		if trimmed := tcpStack.trimSegment(f, bp); trimmed != nil {
+			return trimmed
+		}
+	}
+}
+
+// skipGaps gives up on missing data of flows which have waited for it too
+// long or have too much data buffered behind it. Returns true when the
+// connection was closed.
+func (tcpStack *TCPStack) skipGaps(conn *TCPConnection, now time.Time) bool {
+	for _, f := range []*Flow{conn.ClientFlow, conn.ServerFlow} {
+		if !tcpStack.gapExpired(f, now) {
+			continue
+		}
+
+		if tcpStack.skipGap(conn, f) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tcpStack *TCPStack) gapExpired(f *Flow, now time.Time) bool {
+	if len(f.Buffer) == 0 {
+		return false
+	}
+
+	if tcpStack.GapTimeout > 0 && now.Sub(f.bufferedSince) >= tcpStack.GapTimeout {
+		return true
+	}
+
+	return tcpStack.GapBufferThreshold > 0 && f.bufferedBytes >= tcpStack.GapBufferThreshold
+}
+
+// skipGap reports the hole before the first buffered segment of a flow to
+// the listener and continues reassembly after it. Returns true when the
+// connection was closed by the buffered segments.
+func (tcpStack *TCPStack) skipGap(conn *TCPConnection, f *Flow) bool {
+	if len(f.Buffer) == 0 {
+		return false
+	}
+
+	first := f.Buffer[0].Seq
+	for _, bp := range f.Buffer[1:] {
+		if seqLT(bp.Seq, first) {
+			first = bp.Seq
+		}
+	}
+
+	from, to, isClient := conn.Flows(f.Address)
+	length := uint32(seqDiff(first, f.ExpectedSequenceNumber))
+
+	tcpstackdebug(fmt.Sprintf("tcp-debug: skipping %d missing bytes. Expected %d, continuing from %d.", length, f.ExpectedSequenceNumber, first))
+	tcpStack.countGap(f, length)
+	tcpStack.tcpListener.Gap(conn.ListenerConnection(), length, isClient, conn.lastSeen)
+
+	//
+	// history is no longer contiguous with the data
+	//
+	f.ExpectedSequenceNumber = first
+	f.history = nil
+
+	segment := tcpStack.nextBufferedSegment(f)
+	if segment == nil {
+		return false
+	}
+
+	return tcpStack.drain(conn, from, to, isClient, segment)
+}
+
+// overwriteOverlap copies the bytes of src overlapping dst into dst. Returns
+// whether the segments overlapped and whether the overlapping bytes differed.
+func overwriteOverlap(dst, src *BufferedPacket) (overlapped, differs bool) {
+	dstEnd := dst.Seq + uint32(len(dst.Payload))
+	srcEnd := src.Seq + uint32(len(src.Payload))
+
+	start, end := dst.Seq, dstEnd
+	if seqGT(src.Seq, start) {
+		start = src.Seq
+	}
+	if seqLT(srcEnd, end) {
+		end = srcEnd
+	}
+
+	if !seqLT(start, end) {
+		return false, false
+	}
+
+	dstPart := dst.Payload[seqDiff(start, dst.Seq):seqDiff(end, dst.Seq)]
+	srcPart := src.Payload[seqDiff(start, src.Seq):seqDiff(end, src.Seq)]
+
+	if bytes.Equal(dstPart, srcPart) {
+		return true, false
+	}
+
+	//
+	// payload points to the captured packet, copy before modifying
+	//
+	payload := make([]byte, len(dst.Payload))
+	copy(payload, dst.Payload)
+	copy(payload[seqDiff(start, dst.Seq):], srcPart)
+	dst.Payload = payload
+
+	return true, true
+}
+
+// remember appends delivered data to the retransmission history, keeping
+// at most max bytes.
+func (f *Flow) remember(data []byte, max int) {
+	if max <= 0 {
+		return
+	}
+
+	f.history = append(f.history, data...)
+
+	//
+	// trim lazily to avoid copying on every segment
+	//
+	if len(f.history) > 2*max {
+		f.history = append([]byte(nil), f.history[len(f.history)-max:]...)
+	}
+}
+
+// matchesHistory compares already delivered data starting at seq with data.
+// Bytes which are no longer in the history are assumed to match.
+func (f *Flow) matchesHistory(seq uint32, data []byte) bool {
+	offset := len(f.history) - int(seqDiff(f.ExpectedSequenceNumber, seq))
+	if offset < 0 {
+		if -offset >= len(data) {
+			return true
+		}
+
+		data = data[-offset:]
+		offset = 0
+	}
+
+	end := offset + len(data)
+	if end > len(f.history) {
+		end = len(f.history)
+		data = data[:end-offset]
+	}
+
+	return bytes.Equal(f.history[offset:end], data)
+}
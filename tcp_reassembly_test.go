@@ -0,0 +1,213 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type testSegment struct {
+	fromClient bool
+	offset     uint32
+	flags      uint8
+	payload    string
+}
+
+// testReplay opens a connection with the given initial sequence numbers and
+// replays segments given relative to the first data byte of each direction.
+func testReplay(tcpStack *TCPStack, isnClient, isnServer uint32, segments []testSegment) {
+	ts := time.Unix(1440000000, 0)
+
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, isnClient, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(ts, testServer, testClient, isnServer, isnClient+1, testSYN|testACK, nil))
+	tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, isnClient+1, isnServer+1, testACK, nil))
+
+	for _, s := range segments {
+		flags := s.flags | testACK
+		if s.fromClient {
+			tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, isnClient+1+s.offset, isnServer+1, flags, []byte(s.payload)))
+		} else {
+			tcpStack.NewPacket(testTCPPacket(ts, testServer, testClient, isnServer+1+s.offset, isnClient+1, flags, []byte(s.payload)))
+		}
+	}
+}
+
+func TestTCPStackOverlaps(t *testing.T) {
+	cases := []struct {
+		policy   OverlapPolicy
+		segments []testSegment
+		want     string
+		stats    ReassemblyStats
+	}{
+		// in order
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 4, 0, "efgh"},
+		}, "abcdefgh", ReassemblyStats{}},
+		// full retransmission
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 0, 0, "abcd"},
+			{true, 4, 0, "efgh"},
+		}, "abcdefgh", ReassemblyStats{Retransmissions: 1}},
+		// repacketised retransmission carrying new bytes
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 2, 0, "cdefgh"},
+		}, "abcdefgh", ReassemblyStats{Overlaps: 1}},
+		// retransmission with different data, delivered data wins
+		{OVERLAP_LAST_WINS, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 2, 0, "XXefgh"},
+		}, "abcdefgh", ReassemblyStats{Overlaps: 1, Inconsistencies: 1}},
+		// overlapping buffered segments drain
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 4, 0, "efgh"},
+			{true, 2, 0, "cdef"},
+			{true, 0, 0, "ab"},
+		}, "abcdefgh", ReassemblyStats{Overlaps: 1}},
+		// overlapping buffered segments with different data, first wins
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 4, 0, "efgh"},
+			{true, 2, 0, "cdXX"},
+			{true, 0, 0, "ab"},
+		}, "abcdefgh", ReassemblyStats{Overlaps: 1, Inconsistencies: 1}},
+		// overlapping buffered segments with different data, last wins
+		{OVERLAP_LAST_WINS, []testSegment{
+			{true, 4, 0, "efgh"},
+			{true, 2, 0, "cdXX"},
+			{true, 0, 0, "ab"},
+		}, "abcdXXgh", ReassemblyStats{Overlaps: 1, Inconsistencies: 1}},
+		// same buffered segment twice
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 4, 0, "efgh"},
+			{true, 4, 0, "efgh"},
+			{true, 0, 0, "abcd"},
+		}, "abcdefgh", ReassemblyStats{Retransmissions: 1}},
+		// buffered segment made stale by a larger one
+		{OVERLAP_FIRST_WINS, []testSegment{
+			{true, 4, 0, "ef"},
+			{true, 0, 0, "abcdefgh"},
+		}, "abcdefgh", ReassemblyStats{Retransmissions: 1}},
+	}
+
+	for i, c := range cases {
+		for _, isn := range []uint32{1000, 0xFFFFFFFD} {
+			l := &testTCPListener{}
+			tcpStack := NewTCPStack(l)
+			tcpStack.OverlapPolicy = c.policy
+
+			testReplay(tcpStack, isn, 5000, c.segments)
+
+			if got := l.clientData.String(); got != c.want {
+				t.Errorf("TestTCPStackOverlaps[%d] data mismatch, got: %q, want %q", i, got, c.want)
+			}
+
+			if tcpStack.Stats != c.stats {
+				t.Errorf("TestTCPStackOverlaps[%d] stats mismatch, got: %+v, want %+v", i, tcpStack.Stats, c.stats)
+			}
+		}
+	}
+}
+
+func TestTCPStackFINAfterOverlap(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, 0, "abcd"},
+		// FIN segment of which the data was already seen
+		{true, 0, testFIN, "abcd"},
+		{false, 0, testFIN, ""},
+	})
+
+	if l.closedConnections != 1 {
+		t.Errorf("TestTCPStackFINAfterOverlap: connection not closed")
+	}
+}
+
+func TestTCPStackGapSkip(t *testing.T) {
+	cases := []struct {
+		timeout   time.Duration
+		threshold int
+		segments  []testSegment
+		// seconds after the handshake each segment arrives at
+		times []int64
+		want  string
+		gaps  []testGap
+	}{
+		// lost segment is skipped once the buffer threshold is reached
+		{0, 8, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 8, 0, "ijkl"},
+			{true, 12, 0, "mnop"},
+			{true, 16, 0, "qrst"},
+		}, []int64{0, 0, 0, 0}, "abcdijklmnopqrst", []testGap{{4, true}}},
+		// lost segment is skipped after the timeout
+		{10, 0, []testSegment{
+			{false, 0, 0, "abcd"},
+			{false, 8, 0, "ijkl"},
+			{false, 12, 0, "mnop"},
+			{true, 0, 0, "x"},
+		}, []int64{0, 1, 5, 11}, "abcdijklmnop", []testGap{{4, false}}},
+		// late segment fills the hole before the timeout
+		{10, 0, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 8, 0, "ijkl"},
+			{true, 4, 0, "efgh"},
+			{false, 0, 0, "x"},
+		}, []int64{0, 1, 5, 20}, "abcdefghijkl", nil},
+		// late segment fills the hole just after the timeout
+		{10, 0, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 8, 0, "ijkl"},
+			{true, 4, 0, "efgh"},
+		}, []int64{0, 1, 12}, "abcdefghijkl", nil},
+		// disabled
+		{0, 0, []testSegment{
+			{true, 0, 0, "abcd"},
+			{true, 8, 0, "ijkl"},
+			{false, 0, 0, "x"},
+		}, []int64{0, 0, 3600}, "abcd", nil},
+	}
+
+	for i, c := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+		tcpStack.GapTimeout = c.timeout * time.Second
+		tcpStack.GapBufferThreshold = c.threshold
+
+		ts := time.Unix(1440000000, 0)
+		isnC, isnS := uint32(1000), uint32(5000)
+
+		tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, isnC, 0, testSYN, nil))
+		tcpStack.NewPacket(testTCPPacket(ts, testServer, testClient, isnS, isnC+1, testSYN|testACK, nil))
+		tcpStack.NewPacket(testTCPPacket(ts, testClient, testServer, isnC+1, isnS+1, testACK, nil))
+
+		for j, s := range c.segments {
+			at := ts.Add(time.Duration(c.times[j]) * time.Second)
+			if s.fromClient {
+				tcpStack.NewPacket(testTCPPacket(at, testClient, testServer, isnC+1+s.offset, isnS+1, s.flags|testACK, []byte(s.payload)))
+			} else {
+				tcpStack.NewPacket(testTCPPacket(at, testServer, testClient, isnS+1+s.offset, isnC+1, s.flags|testACK, []byte(s.payload)))
+			}
+		}
+
+		got := l.clientData.String()
+		if len(c.gaps) > 0 && !c.gaps[0].clientData {
+			got = l.serverData.String()
+		}
+		if got != c.want {
+			t.Errorf("TestTCPStackGapSkip[%d] data mismatch, got: %q, want %q", i, got, c.want)
+		}
+
+		if len(l.gaps) != len(c.gaps) {
+			t.Errorf("TestTCPStackGapSkip[%d] gaps mismatch, got: %v, want %v", i, l.gaps, c.gaps)
+			continue
+		}
+		for j := range c.gaps {
+			if l.gaps[j] != c.gaps[j] {
+				t.Errorf("TestTCPStackGapSkip[%d] gap[%d] mismatch, got: %v, want %v", i, j, l.gaps[j], c.gaps[j])
+			}
+		}
+	}
+}
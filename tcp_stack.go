@@ -2,46 +2,135 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
 )
 
 type FlowAddress struct {
-	SourceAddress interface{}
+	SourceAddress netip.Addr
 	SourcePort    uint16
 
-	DestinationAddress interface{}
+	DestinationAddress netip.Addr
 	DestinationPort    uint16
 }
 
+func (a FlowAddress) Reverse() FlowAddress {
+	return FlowAddress{
+		SourceAddress:      a.DestinationAddress,
+		SourcePort:         a.DestinationPort,
+		DestinationAddress: a.SourceAddress,
+		DestinationPort:    a.SourcePort,
+	}
+}
+
 type Flow struct {
 	Address                FlowAddress
 	InitialSequenceNumber  uint32
 	ExpectedSequenceNumber uint32
+	Synchronized           bool
 	Finished               bool
+
+	// out-of-order packets waiting for the gap before them to be filled
+	Buffer        []*BufferedPacket
+	bufferCount   uint64
+	bufferedBytes int
+	bufferedSince time.Time
+
+	// most recently delivered bytes, ending at ExpectedSequenceNumber, for
+	// checking retransmitted data against
+	history []byte
+
+	// window scale sent in the SYN, in effect once both ends have sent one.
+	// Unknown on connections picked up mid-stream.
+	windowScale        uint8
+	windowScaleOffered bool
+	WindowScaled       bool
+
+	// receive window most recently advertised by the sender, scaled
+	Window uint32
+
+	Stats ReassemblyStats
+}
+
+func NewFlow(address FlowAddress) *Flow {
+	return &Flow{
+		Address: address,
+	}
 }
 
 func (f *Flow) SetInitialSequence(s uint32) {
 	f.InitialSequenceNumber = s
 	f.ExpectedSequenceNumber = s
+	f.Synchronized = true
 }
 
+// RelativeSequenceNumber returns s relative to the initial sequence
+// number, which is 1, wrapping around 2^32 like the sequence numbers
+// themselves.
 func (f *Flow) RelativeSequenceNumber(s uint32) uint32 {
-	if s == 0 {
-		return 0
+	return s - f.InitialSequenceNumber + 1
+}
+
+// ScaledWindow returns the window of a segment sent by the flow in bytes.
+func (f *Flow) ScaledWindow(window uint16) uint32 {
+	if !f.WindowScaled {
+		return uint32(window)
 	}
 
-	return s - f.InitialSequenceNumber + 1
+	return ScaledWindow(window, f.windowScale)
 }
 
+// BufferedPacket is a segment waiting for reassembly. Seq and Payload
+// start out as the packet's own and are advanced when the segment is
+// trimmed because of an overlap.
 type BufferedPacket struct {
-	NetworkFrame *interface{}
-	TCPFrame     *TCPFrame
+	Packet  *Packet
+	Seq     uint32
+	Payload []byte
+
+	// arrival order within the flow
+	order uint64
+	// overlap with other buffered segments was already counted
+	accounted bool
 }
 
 type TCPConnection struct {
 	ClientFlow *Flow
 	ServerFlow *Flow
 
-	Buffer map[uint32]*BufferedPacket
+	// capture metadata of the packet which opened the connection
+	InterfaceName string
+	Direction     PacketDirection
+
+	// connection was picked up without seeing the handshake
+	MidStream bool
+	// both ends sent a SYN without ACK
+	SimultaneousOpen bool
+
+	// index assigned by TCPStreamIndexer
+	StreamIndex uint64
+
+	// timestamp of the latest packet
+	lastSeen time.Time
+
+	Metrics ConnectionMetrics
+	// application protocol detected from the first data, empty when unknown
+	Protocol string
+}
+
+func (conn *TCPConnection) ListenerConnection() TCPListenerConnection {
+	return TCPListenerConnection{
+		ClientAddress: conn.ClientFlow.Address.SourceAddress,
+		ClientPort:    conn.ClientFlow.Address.SourcePort,
+		ServerAddress: conn.ClientFlow.Address.DestinationAddress,
+		ServerPort:    conn.ClientFlow.Address.DestinationPort,
+		InterfaceName: conn.InterfaceName,
+		Direction:     conn.Direction,
+		MidStream:     conn.MidStream,
+		StreamIndex:   conn.StreamIndex,
+	}
 }
 
 func (conn *TCPConnection) Flows(flowAddress FlowAddress) (from, to *Flow, isClient bool) {
@@ -55,37 +144,91 @@ func (conn *TCPConnection) Flows(flowAddress FlowAddress) (from, to *Flow, isCli
 type TCPStack struct {
 	connections map[FlowAddress]*TCPConnection
 	tcpListener TCPListener
+
+	// create connections from data segments of unknown flows
+	MidStreamPickup bool
+
+	// which copy of overlapping data is used
+	OverlapPolicy OverlapPolicy
+
+	// number of delivered bytes per flow kept for checking retransmissions
+	RetransmissionHistory int
+
+	// missing data is skipped when a flow has not made progress within
+	// GapTimeout (in packet time) or has GapBufferThreshold bytes
+	// buffered. Zero disables.
+	GapTimeout         time.Duration
+	GapBufferThreshold int
+
+	// connections are evicted after IdleTimeout without packets (in packet
+	// time), or when they have more than ConnectionBufferLimit bytes or all
+	// connections together more than BufferLimit bytes of out-of-order data
+	// buffered. Zero disables.
+	IdleTimeout           time.Duration
+	ConnectionBufferLimit int
+	BufferLimit           int
+
+	bufferedBytes int
+	lastSweep     time.Time
+
+	// flows of recently closed connections and when they expire
+	timeWait map[FlowAddress]time.Time
+
+	Stats     ReassemblyStats
+	Evictions EvictionStats
+
+	// metrics of closed connections
+	Totals MetricsTotals
+	// receives a metrics summary of every closed connection when set
+	SummaryWriter io.Writer
+	// closed connections are added to Conversations when set
+	Conversations *ConversationTable
 }
 
 func NewTCPStack(tcpListener TCPListener) *TCPStack {
 	return &TCPStack{
-		connections: make(map[FlowAddress]*TCPConnection),
-		tcpListener: tcpListener,
+		connections:           make(map[FlowAddress]*TCPConnection),
+		timeWait:              make(map[FlowAddress]time.Time),
+		tcpListener:           tcpListener,
+		OverlapPolicy:         OVERLAP_FIRST_WINS,
+		RetransmissionHistory: DEFAULT_RETRANSMISSION_HISTORY,
+		GapTimeout:            DEFAULT_GAP_TIMEOUT,
+		GapBufferThreshold:    DEFAULT_GAP_BUFFER_THRESHOLD,
+		IdleTimeout:           DEFAULT_IDLE_TIMEOUT,
+		ConnectionBufferLimit: DEFAULT_CONNECTION_BUFFER_LIMIT,
+		BufferLimit:           DEFAULT_BUFFER_LIMIT,
 	}
 }
 
-func (tcpStack *TCPStack) newConnection(clientFlowAddress FlowAddress, tcpFrame *TCPFrame) *TCPConnection {
+func (tcpStack *TCPStack) newConnection(clientFlowAddress FlowAddress, packet *Packet) *TCPConnection {
 	//
 	// create flows
 	//
-	clientFlow := &Flow{clientFlowAddress, 0, 0, false}
+	clientFlow := NewFlow(clientFlowAddress)
 
-	serverFlowAddress := FlowAddress{
-		SourceAddress:      clientFlowAddress.DestinationAddress,
-		SourcePort:         clientFlowAddress.DestinationPort,
-		DestinationAddress: clientFlowAddress.SourceAddress,
-		DestinationPort:    clientFlowAddress.SourcePort,
-	}
-	serverFlow := &Flow{serverFlowAddress, 0, 0, false}
+	serverFlowAddress := clientFlowAddress.Reverse()
+	serverFlow := NewFlow(serverFlowAddress)
 
 	// create connection
-	conn := &TCPConnection{clientFlow, serverFlow, make(map[uint32]*BufferedPacket)}
+	conn := &TCPConnection{
+		ClientFlow:    clientFlow,
+		ServerFlow:    serverFlow,
+		InterfaceName: packet.Capture.InterfaceName,
+		Direction:     packet.Capture.Direction,
+		StreamIndex:   packet.TCPStream,
+	}
 
-	// check for existing connection
-	_, ok := tcpStack.connections[clientFlowAddress]
-	if ok {
-		// FIXME: close, clean existing connection
+	//
+	// ports were reused before the previous connection was seen closing,
+	// the previous connection is over
+	//
+	if existing, ok := tcpStack.connections[clientFlowAddress]; ok {
+		tcpstackdebug("tcp-debug: new connection on ports of an existing one")
+		tcpStack.Evictions.Reused += 1
+		tcpStack.closeConnection(existing, CLOSE_REASON_REUSED)
 	}
+	delete(tcpStack.timeWait, clientFlowAddress)
+	delete(tcpStack.timeWait, serverFlowAddress)
 
 	tcpStack.connections[clientFlowAddress] = conn
 	tcpStack.connections[serverFlowAddress] = conn
@@ -94,99 +237,363 @@ func (tcpStack *TCPStack) newConnection(clientFlowAddress FlowAddress, tcpFrame
 }
 
 type TCPListenerConnection struct {
-	ClientAddress interface{}
+	ClientAddress netip.Addr
 	ClientPort    uint16
 
-	ServerAddress interface{}
+	ServerAddress netip.Addr
 	ServerPort    uint16
+
+	// capture interface and direction of the client's packets
+	InterfaceName string
+	Direction     PacketDirection
+
+	// handshake was not seen, data may start in the middle of the stream
+	MidStream bool
+
+	// index of the connection in the capture, see TCPStreamIndexer
+	StreamIndex uint64
 }
 
+// StreamEnd tells how one direction of a connection ended.
+type StreamEnd uint8
+
+const (
+	// sender closed its side with FIN, the other direction may continue
+	STREAM_END_CLOSED StreamEnd = iota
+	// connection was aborted with RST
+	STREAM_END_RESET
+	// connection was closed before the sender closed its side, by eviction
+	// or at the end of the capture
+	STREAM_END_TRUNCATED
+)
+
+// TCPTimestamps tells when data was captured. First is the capture time of
+// the segment carrying the data and Last of the packet which made it
+// deliverable, they differ for data which waited in the reassembly buffer.
+type TCPTimestamps struct {
+	First time.Time
+	Last  time.Time
+}
+
+// TCPListener receives reassembled connections. Times are capture times:
+// NewConnection gets the time of the SYN or of the first packet of a picked
+// up connection, EndOfStream the time of the FIN or RST and
+// ClosedConnection the time of the last packet of the connection.
 type TCPListener interface {
-	NewConnection(conn TCPListenerConnection)
-	Data(conn TCPListenerConnection, data []byte, clientData bool)
-	ClosedConnection(conn TCPListenerConnection)
+	NewConnection(conn TCPListenerConnection, timestamp time.Time)
+	Data(conn TCPListenerConnection, data []byte, clientData bool, timestamps TCPTimestamps)
+	// Gap reports length bytes which were never captured, data continues
+	// after them
+	Gap(conn TCPListenerConnection, length uint32, clientData bool, timestamp time.Time)
+	// EndOfStream reports that no more data follows in one direction, it
+	// precedes ClosedConnection
+	EndOfStream(conn TCPListenerConnection, clientData bool, end StreamEnd, timestamp time.Time)
+	ClosedConnection(conn TCPListenerConnection, timestamp time.Time)
 }
 
-func (tcpStack *TCPStack) NewPacket(networkFrame *interface{}, tcpFrame *TCPFrame) {
+func (tcpStack *TCPStack) NewPacket(packet *Packet) {
 	var conn *TCPConnection
 	newConnection := false
-	closedConnection := false
+	tcpFrame := packet.TCP
 	flowAddress := FlowAddress{
-		SourceAddress:      sourceAddress(*networkFrame),
+		SourceAddress:      packet.SourceAddress(),
 		SourcePort:         tcpFrame.Header.SourcePort(),
-		DestinationAddress: destinationAddress(*networkFrame),
+		DestinationAddress: packet.DestinationAddress(),
 		DestinationPort:    tcpFrame.Header.DestinationPort(),
 	}
 
+	tcpStack.evictIdle(packet.Timestamp())
+
 	//
 	// find connection
 	//
-	if tcpFrame.Header.FlagSYN() && !tcpFrame.Header.FlagACK() {
+	isSYN := tcpFrame.Header.FlagSYN() && !tcpFrame.Header.FlagACK()
+	if isSYN && tcpStack.isSimultaneousOpen(flowAddress, tcpFrame.Header.SequenceNumber()) {
+		//
+		// both ends sent a SYN, the first one is the client
+		//
+		tcpstackdebug("tcp-debug: simultaneous open.")
+		conn = tcpStack.connections[flowAddress]
+		conn.SimultaneousOpen = true
+	} else if isSYN && !tcpStack.isDuplicateSYN(flowAddress, tcpFrame.Header.SequenceNumber()) {
 		//
 		// create new connection
 		//
-		conn = tcpStack.newConnection(flowAddress, tcpFrame)
+		conn = tcpStack.newConnection(flowAddress, packet)
 		newConnection = true
 	} else {
 		var ok bool
 		conn, ok = tcpStack.connections[flowAddress]
-		if !ok {
+		if !ok && tcpFrame.Header.FlagSYN() && !tcpFrame.Header.FlagRST() {
+			//
+			// capture started after the SYN, open from the SYN-ACK unless it
+			// is a late retransmission of a closed connection
+			//
+			if tcpStack.inTimeWait(flowAddress, packet.Timestamp()) {
+				return
+			}
+
+			conn = tcpStack.synAckConnection(flowAddress, packet)
+			newConnection = true
+		} else if !ok {
+			//
 			// unknown connection, can happen for example when connection is opened before tcpdump starts.
-			return
+			// pick it up from the first data segment if requested.
+			//
+			if !tcpStack.MidStreamPickup || len(tcpFrame.Payload) == 0 || tcpFrame.Header.FlagSYN() || tcpFrame.Header.FlagRST() {
+				return
+			}
+
+			//
+			// late retransmission of a connection which was closed
+			//
+			if tcpStack.inTimeWait(flowAddress, packet.Timestamp()) {
+				return
+			}
+
+			conn = tcpStack.pickupConnection(flowAddress, packet)
+			newConnection = true
 		}
 	}
 
+	conn.lastSeen = packet.Timestamp()
+
 	from, to, isClient := conn.Flows(flowAddress)
 	seq := tcpFrame.Header.SequenceNumber()
 
 	if tcpFrame.Header.FlagSYN() {
 		//
-		// handle SYN
-		//
-		from.SetInitialSequence(seq)
-	} else {
-		//
-		// check packet order
-		// add some kind of thresholds for max diff?
+		// handle SYN, a retransmitted one must not rewind the flow
 		//
-		if seq > from.ExpectedSequenceNumber {
+		if from.Synchronized && from.InitialSequenceNumber == seq {
 			//
-			// future packet
+			// in a simultaneous open both ends repeat their SYN to
+			// acknowledge the other one
 			//
-			tcpstackdebug(fmt.Sprintf("tcp-debug: buffered future packet. Expected %d, got %d (diff: %d).", from.ExpectedSequenceNumber, seq, seq-from.ExpectedSequenceNumber))
-
-			_, ok := conn.Buffer[seq]
-			if !ok {
-				conn.Buffer[seq] = &BufferedPacket{networkFrame, tcpFrame}
+			if conn.SimultaneousOpen && tcpFrame.Header.FlagACK() {
+				tcpStack.updateMetrics(conn, from, to, isClient, packet)
+				return
 			}
-			return
-		} else if seq < from.ExpectedSequenceNumber {
-			//
-			// past packet
-			//
-			tcpstackdebug(fmt.Sprintf("tcp-debug: ignored past packet. Expected %d, got %d (diff: %d).", from.ExpectedSequenceNumber, seq, from.ExpectedSequenceNumber-seq))
+
+			tcpstackdebug("tcp-debug: ignored retransmitted SYN.")
+			tcpStack.countRetransmission(from)
 			return
 		}
-	}
 
-	if len(tcpFrame.Payload) > 0 {
+		from.SetInitialSequence(seq)
+		tcpStack.negotiateWindowScale(from, to, tcpFrame)
+	} else if !from.Synchronized {
 		//
-		// increment next expected sequence number
+		// first segment of this direction on a picked up connection
 		//
-		from.ExpectedSequenceNumber += uint32(len(tcpFrame.Payload))
+		from.SetInitialSequence(seq)
+	}
+
+	//
+	// window of SYN segments is never scaled
+	//
+	if tcpFrame.Header.FlagSYN() {
+		from.Window = uint32(tcpFrame.Header.WindowSize())
 	} else {
-		if tcpFrame.Header.FlagSYN() || tcpFrame.Header.FlagFIN() {
-			//
-			// increment next expected sequence number
-			//
-			from.ExpectedSequenceNumber += 1
+		from.Window = from.ScaledWindow(tcpFrame.Header.WindowSize())
+	}
+
+	tcpStack.updateMetrics(conn, from, to, isClient, packet)
+
+	tcpListenerConn := conn.ListenerConnection()
+	if newConnection {
+		tcpStack.tcpListener.NewConnection(tcpListenerConn, packet.Timestamp())
+	}
+
+	segment := &BufferedPacket{Packet: packet, Seq: seq, Payload: tcpFrame.Payload}
+
+	//
+	// check packet order
+	// add some kind of thresholds for max diff?
+	//
+	if offset := seqDiff(seq, from.ExpectedSequenceNumber); offset > 0 {
+		//
+		// future packet
+		//
+		if len(segment.Payload) > 0 || tcpFrame.Header.FlagFIN() || tcpFrame.Header.FlagRST() {
+			tcpstackdebug(fmt.Sprintf("tcp-debug: buffered future packet. Expected %d, got %d (diff: %d).", from.ExpectedSequenceNumber, seq, offset))
+			tcpStack.bufferSegment(from, segment)
+		}
+		segment = nil
+	} else if offset < 0 && !tcpFrame.Header.FlagSYN() {
+		//
+		// past packet, keep only the bytes beyond the expected sequence number
+		//
+		segment = tcpStack.trimSegment(from, segment)
+	}
+
+	//
+	// Handle the segment and everything it makes contiguous in the buffer
+	//
+	if segment != nil && tcpStack.drain(conn, from, to, isClient, segment) {
+		return
+	}
+
+	//
+	// give up waiting for segments which are most likely lost, after the
+	// segment had its chance to fill the hole. The buffer may also have
+	// grown over the thresholds
+	//
+	if tcpStack.skipGaps(conn, packet.Timestamp()) {
+		return
+	}
+
+	tcpStack.enforceBufferLimits(conn)
+}
+
+// drain handles an in-order segment and the buffered segments following it.
+// Returns true when the connection was closed.
+func (tcpStack *TCPStack) drain(conn *TCPConnection, from, to *Flow, isClient bool, segment *BufferedPacket) bool {
+	for segment != nil {
+		if tcpStack.handleSegment(conn, from, to, isClient, segment) {
+			return true
+		}
+
+		//
+		// progress was made, restart waiting for the rest of the buffer
+		//
+		from.bufferedSince = segment.Packet.Timestamp()
+
+		segment = tcpStack.nextBufferedSegment(from)
+	}
+
+	return false
+}
+
+// negotiateWindowScale records the window scale option of a SYN segment.
+// Scaling is in effect in both directions when both SYNs carry the option.
+func (tcpStack *TCPStack) negotiateWindowScale(from, to *Flow, tcpFrame *TCPFrame) {
+	opts, err := tcpFrame.DecodeOptions()
+	if err != nil {
+		tcpstackdebug("tcp-debug: invalid options in SYN:", err)
+	}
+
+	from.windowScale = opts.WindowScale
+	from.windowScaleOffered = opts.HasWindowScale
+
+	if from.windowScaleOffered && to.windowScaleOffered {
+		from.WindowScaled = true
+		to.WindowScaled = true
+	}
+}
+
+// isSimultaneousOpen checks whether a SYN comes from the server side of a
+// connection of which only the client's SYN was seen, or is a retransmission
+// of such a SYN.
+func (tcpStack *TCPStack) isSimultaneousOpen(flowAddress FlowAddress, seq uint32) bool {
+	conn, ok := tcpStack.connections[flowAddress]
+	if !ok || conn.MidStream || conn.ServerFlow.Address != flowAddress {
+		return false
+	}
+
+	return !conn.ServerFlow.Synchronized || conn.ServerFlow.InitialSequenceNumber == seq
+}
+
+// isDuplicateSYN checks whether a SYN is a retransmission of the SYN which
+// opened the tracked connection of the flow.
+func (tcpStack *TCPStack) isDuplicateSYN(flowAddress FlowAddress, seq uint32) bool {
+	conn, ok := tcpStack.connections[flowAddress]
+	if !ok {
+		return false
+	}
+
+	return conn.ClientFlow.Address == flowAddress &&
+		conn.ClientFlow.Synchronized &&
+		conn.ClientFlow.InitialSequenceNumber == seq
+}
+
+// closeConnection notifies the listener and forgets the connection. The
+// directions which did not end with FIN or RST, because the connection was
+// evicted or the capture ended, end with STREAM_END_TRUNCATED.
+func (tcpStack *TCPStack) closeConnection(conn *TCPConnection, reason CloseReason) {
+	tcpListenerConn := conn.ListenerConnection()
+
+	if !conn.ClientFlow.Finished {
+		tcpStack.tcpListener.EndOfStream(tcpListenerConn, true, STREAM_END_TRUNCATED, conn.lastSeen)
+	}
+	if !conn.ServerFlow.Finished {
+		tcpStack.tcpListener.EndOfStream(tcpListenerConn, false, STREAM_END_TRUNCATED, conn.lastSeen)
+	}
+	conn.ClientFlow.Finished, conn.ServerFlow.Finished = true, true
+
+	tcpStack.tcpListener.ClosedConnection(tcpListenerConn, conn.lastSeen)
+
+	tcpStack.Totals.add(&conn.Metrics)
+	if tcpStack.SummaryWriter != nil {
+		WriteConnectionSummary(tcpStack.SummaryWriter, conn)
+	}
+	if tcpStack.Conversations != nil {
+		tcpStack.Conversations.Add(tcpConversation(conn, reason))
+	}
+	tcpStack.removeConnection(conn)
+	tcpStack.enterTimeWait(conn)
+}
+
+// Close flushes the connections still open at the end of a capture, in the
+// order they started. Data waiting behind a gap is delivered after reporting
+// the gap and the connections are closed.
+func (tcpStack *TCPStack) Close() {
+	var conns []*TCPConnection
+	for flowAddress, conn := range tcpStack.connections {
+		if flowAddress == conn.ClientFlow.Address {
+			conns = append(conns, conn)
 		}
 	}
 
+	sort.Slice(conns, func(i, j int) bool {
+		if !conns[i].Metrics.Start.Equal(conns[j].Metrics.Start) {
+			return conns[i].Metrics.Start.Before(conns[j].Metrics.Start)
+		}
+		return conns[i].StreamIndex < conns[j].StreamIndex
+	})
+
+	for _, conn := range conns {
+		tcpStack.flushConnection(conn)
+	}
+}
+
+func (tcpStack *TCPStack) flushConnection(conn *TCPConnection) {
+	for _, f := range []*Flow{conn.ClientFlow, conn.ServerFlow} {
+		for len(f.Buffer) > 0 {
+			if tcpStack.skipGap(conn, f) {
+				return
+			}
+		}
+	}
+
+	tcpStack.closeConnection(conn, CLOSE_REASON_OPEN)
+}
+
+// handleSegment delivers an in-order segment to the listener and handles
+// its FIN and RST flags. Returns true when the connection was closed.
+func (tcpStack *TCPStack) handleSegment(conn *TCPConnection, from, to *Flow, isClient bool, segment *BufferedPacket) bool {
+	tcpHeader := segment.Packet.TCP.Header
+	closedConnection := false
+
+	//
+	// increment next expected sequence number, SYN takes one sequence
+	// number before the data it may carry (TCP Fast Open) and FIN one after
+	//
+	if tcpHeader.FlagSYN() {
+		from.ExpectedSequenceNumber += 1
+	}
+	if len(segment.Payload) > 0 {
+		from.ExpectedSequenceNumber += uint32(len(segment.Payload))
+		from.remember(segment.Payload, tcpStack.RetransmissionHistory)
+	}
+	if tcpHeader.FlagFIN() {
+		from.ExpectedSequenceNumber += 1
+	}
+
 	//
 	// Handle FIN
 	//
-	if tcpFrame.Header.FlagFIN() {
+	if tcpHeader.FlagFIN() {
 		from.Finished = true
 
 		// wait for last ack?
@@ -198,41 +605,74 @@ func (tcpStack *TCPStack) NewPacket(networkFrame *interface{}, tcpFrame *TCPFram
 	//
 	// Handle RST
 	//
-	if tcpFrame.Header.FlagRST() {
+	if tcpHeader.FlagRST() {
 		closedConnection = true
 	}
 
 	//
 	// Notify
 	//
-	tcpListenerConn := TCPListenerConnection{
-		ClientAddress: conn.ClientFlow.Address.SourceAddress,
-		ClientPort:    conn.ClientFlow.Address.SourcePort,
-		ServerAddress: conn.ClientFlow.Address.DestinationAddress,
-		ServerPort:    conn.ClientFlow.Address.DestinationPort,
-	}
+	tcpListenerConn := conn.ListenerConnection()
+	timestamp := segment.Packet.Timestamp()
 
-	if newConnection {
-		tcpStack.tcpListener.NewConnection(tcpListenerConn)
+	if len(segment.Payload) > 0 {
+		if conn.Protocol == "" {
+			conn.Protocol = DetectTCPProtocol(segment.Payload)
+		}
+
+		tcpStack.tcpListener.Data(tcpListenerConn, segment.Payload, isClient, TCPTimestamps{timestamp, conn.lastSeen})
 	}
-	if len(tcpFrame.Payload) > 0 {
-		tcpStack.tcpListener.Data(tcpListenerConn, tcpFrame.Payload, isClient)
+	if tcpHeader.FlagFIN() {
+		tcpStack.tcpListener.EndOfStream(tcpListenerConn, isClient, STREAM_END_CLOSED, timestamp)
+	}
+	if tcpHeader.FlagRST() {
+		//
+		// abort the directions which were not closed yet
+		//
+		if !from.Finished {
+			tcpStack.tcpListener.EndOfStream(tcpListenerConn, isClient, STREAM_END_RESET, timestamp)
+		}
+		if !to.Finished {
+			tcpStack.tcpListener.EndOfStream(tcpListenerConn, !isClient, STREAM_END_RESET, timestamp)
+		}
+		from.Finished, to.Finished = true, true
 	}
 	if closedConnection {
-		tcpStack.tcpListener.ClosedConnection(tcpListenerConn)
+		reason := CLOSE_REASON_FIN
+		if tcpHeader.FlagRST() {
+			reason = CLOSE_REASON_RST
+		}
 
-		delete(tcpStack.connections, conn.ClientFlow.Address)
-		delete(tcpStack.connections, conn.ServerFlow.Address)
+		tcpStack.closeConnection(conn, reason)
 	}
 
-	//
-	// Handle next buffered packet
-	//
-	bp, ok := conn.Buffer[from.ExpectedSequenceNumber]
-	if ok {
-		delete(conn.Buffer, from.ExpectedSequenceNumber)
-		tcpStack.NewPacket(bp.NetworkFrame, bp.TCPFrame)
-	}
+	return closedConnection
+}
+
+//
+// Sequence number comparison in serial number arithmetic (RFC 1982), the
+// numbers wrap around at 2^32 and a is considered less than b when b is
+// less than 2^31 ahead of it.
+//
+
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+func seqLT(a, b uint32) bool {
+	return seqDiff(a, b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return seqDiff(a, b) <= 0
+}
+
+func seqGT(a, b uint32) bool {
+	return seqDiff(a, b) > 0
+}
+
+func seqGEQ(a, b uint32) bool {
+	return seqDiff(a, b) >= 0
 }
 
 func tcpstackdebug(a ...interface{}) {
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const (
+	testFIN = 0x01
+	testSYN = 0x02
+	testRST = 0x04
+	testPSH = 0x08
+	testACK = 0x10
+)
+
+type testTCPEndpoint struct {
+	Address string
+	Port    uint16
+}
+
+var (
+	testClient = testTCPEndpoint{"10.0.0.1", 40000}
+	testServer = testTCPEndpoint{"10.0.0.2", 80}
+)
+
+func testTCPPacket(timestamp time.Time, from, to testTCPEndpoint, seq, ack uint32, flags uint8, payload []byte) *Packet {
+	return testTCPPacketOptions(timestamp, from, to, seq, ack, flags, 65535, nil, payload)
+}
+
+// testTCPPacketOptions builds a TCP packet with the given window and
+// options, which must be padded to a multiple of 4 bytes.
+func testTCPPacketOptions(timestamp time.Time, from, to testTCPEndpoint, seq, ack uint32, flags uint8, window uint16, options, payload []byte) *Packet {
+	data := make([]byte, TCP_FRAME_HEADER_LENGTH, TCP_FRAME_HEADER_LENGTH+len(options)+len(payload))
+	binary.BigEndian.PutUint16(data[0:2], from.Port)
+	binary.BigEndian.PutUint16(data[2:4], to.Port)
+	binary.BigEndian.PutUint32(data[4:8], seq)
+	binary.BigEndian.PutUint32(data[8:12], ack)
+	data[12] = uint8(5+len(options)/4) << 4
+	data[13] = flags
+	binary.BigEndian.PutUint16(data[14:16], window)
+	data = append(data, options...)
+	data = append(data, payload...)
+
+	tcpFrame, err := NewTCPFrame(data)
+	if err != nil {
+		panic(err)
+	}
+
+	packet := testIPPacket(timestamp, from.Address, to.Address)
+	packet.Protocol = PROTOCOL_TCP
+	packet.TransportType = TRANSPORT_TYPE_TCP
+	packet.TCP = tcpFrame
+
+	return packet
+}
+
+func testFlowAddress(from, to testTCPEndpoint) FlowAddress {
+	return FlowAddress{
+		SourceAddress:      netip.MustParseAddr(from.Address),
+		SourcePort:         from.Port,
+		DestinationAddress: netip.MustParseAddr(to.Address),
+		DestinationPort:    to.Port,
+	}
+}
+
+type testTCPListener struct {
+	conn              TCPListenerConnection
+	newConnections    int
+	closedConnections int
+	clientData        bytes.Buffer
+	serverData        bytes.Buffer
+	gaps              []testGap
+	ends              []testEnd
+	timestamps        []TCPTimestamps
+	closedAt          time.Time
+}
+
+type testEnd struct {
+	clientData bool
+	end        StreamEnd
+}
+
+type testGap struct {
+	length     uint32
+	clientData bool
+}
+
+func (l *testTCPListener) NewConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.conn = conn
+	l.newConnections += 1
+}
+
+func (l *testTCPListener) Data(conn TCPListenerConnection, data []byte, isClient bool, timestamps TCPTimestamps) {
+	l.timestamps = append(l.timestamps, timestamps)
+
+	if isClient {
+		l.clientData.Write(data)
+	} else {
+		l.serverData.Write(data)
+	}
+}
+
+func (l *testTCPListener) Gap(conn TCPListenerConnection, length uint32, isClient bool, timestamp time.Time) {
+	l.gaps = append(l.gaps, testGap{length, isClient})
+}
+
+func (l *testTCPListener) EndOfStream(conn TCPListenerConnection, isClient bool, end StreamEnd, timestamp time.Time) {
+	l.ends = append(l.ends, testEnd{isClient, end})
+}
+
+func (l *testTCPListener) ClosedConnection(conn TCPListenerConnection, timestamp time.Time) {
+	l.closedAt = timestamp
+	l.closedConnections += 1
+}
+
+// testConversation replays a simple request/response conversation starting
+// from the given initial sequence numbers. Client data is sent in two
+// segments with the second one arriving first.
+func testConversation(isnClient, isnServer uint32, request1, request2, response []byte) []*Packet {
+	ts := time.Unix(1440000000, 0)
+	c, s := isnClient, isnServer
+
+	packets := []*Packet{
+		testTCPPacket(ts, testClient, testServer, c, 0, testSYN, nil),
+		testTCPPacket(ts, testServer, testClient, s, c+1, testSYN|testACK, nil),
+		testTCPPacket(ts, testClient, testServer, c+1, s+1, testACK, nil),
+	}
+	c, s = c+1, s+1
+
+	seg1 := testTCPPacket(ts, testClient, testServer, c, s, testACK, request1)
+	seg2 := testTCPPacket(ts, testClient, testServer, c+uint32(len(request1)), s, testACK|testPSH, request2)
+	packets = append(packets, seg2, seg1)
+	c += uint32(len(request1) + len(request2))
+
+	packets = append(packets,
+		testTCPPacket(ts, testServer, testClient, s, c, testACK|testPSH, response),
+		testTCPPacket(ts, testClient, testServer, c, s+uint32(len(response)), testACK|testFIN, nil),
+		testTCPPacket(ts, testServer, testClient, s+uint32(len(response)), c+1, testACK|testFIN, nil),
+	)
+
+	return packets
+}
+
+func TestTCPStackSequenceWraparound(t *testing.T) {
+	request1 := []byte("GET / HTTP/1.1\r\n")
+	request2 := []byte("Host: example.com\r\n\r\n")
+	response := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+
+	cases := []struct {
+		isnClient uint32
+		isnServer uint32
+	}{
+		{1000, 5000},
+		// wrap inside the first client segment
+		{0xFFFFFFF8, 5000},
+		// wrap exactly between the client segments
+		{0xFFFFFFFF - uint32(len(request1)), 5000},
+		// wrap on the SYN and inside the server response
+		{0xFFFFFFFF, 0xFFFFFFF0},
+		{0x7FFFFFF0, 0x80000000},
+	}
+
+	for i, c := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+
+		for _, packet := range testConversation(c.isnClient, c.isnServer, request1, request2, response) {
+			tcpStack.NewPacket(packet)
+		}
+
+		wantClient := append(append([]byte{}, request1...), request2...)
+		if !bytes.Equal(l.clientData.Bytes(), wantClient) {
+			t.Errorf("TestTCPStackSequenceWraparound[%d] client data mismatch, got: %q, want %q", i, l.clientData.Bytes(), wantClient)
+		}
+
+		if !bytes.Equal(l.serverData.Bytes(), response) {
+			t.Errorf("TestTCPStackSequenceWraparound[%d] server data mismatch, got: %q, want %q", i, l.serverData.Bytes(), response)
+		}
+
+		if l.newConnections != 1 || l.closedConnections != 1 {
+			t.Errorf("TestTCPStackSequenceWraparound[%d] connection events mismatch, got: %d/%d, want 1/1", i, l.newConnections, l.closedConnections)
+		}
+
+		if len(tcpStack.connections) != 0 {
+			t.Errorf("TestTCPStackSequenceWraparound[%d] connections left: %d", i, len(tcpStack.connections))
+		}
+	}
+}
+
+func TestSequenceNumberComparison(t *testing.T) {
+	cases := []struct {
+		a, b uint32
+		lt   bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{0xFFFFFFFF, 0, true},
+		{0, 0xFFFFFFFF, false},
+		{0xFFFFFF00, 0x100, true},
+		{0x100, 0xFFFFFF00, false},
+		{5, 5, false},
+	}
+
+	for i, c := range cases {
+		if got := seqLT(c.a, c.b); got != c.lt {
+			t.Errorf("TestSequenceNumberComparison[%d] seqLT(%d, %d) mismatch, got: %t, want %t", i, c.a, c.b, got, c.lt)
+		}
+
+		if got := seqGT(c.b, c.a); got != c.lt {
+			t.Errorf("TestSequenceNumberComparison[%d] seqGT(%d, %d) mismatch, got: %t, want %t", i, c.b, c.a, got, c.lt)
+		}
+	}
+}
+
+func TestRelativeSequenceNumber(t *testing.T) {
+	f := NewFlow(FlowAddress{})
+	f.SetInitialSequence(0xFFFFFFF0)
+
+	cases := []struct {
+		in   uint32
+		want uint32
+	}{
+		{0xFFFFFFF0, 1},
+		{0xFFFFFFF1, 2},
+		{0, 17},
+		{100, 117},
+	}
+
+	for i, c := range cases {
+		if got := f.RelativeSequenceNumber(c.in); got != c.want {
+			t.Errorf("TestRelativeSequenceNumber[%d] mismatch, got: %d, want %d", i, got, c.want)
+		}
+	}
+}
+
+func TestTCPStackEndOfStream(t *testing.T) {
+	cases := []struct {
+		segments []testSegment
+		ends     []testEnd
+		closed   int
+	}{
+		// half-close, the other direction continues
+		{[]testSegment{
+			{true, 0, testFIN, "req"},
+			{false, 0, 0, "resp"},
+		}, []testEnd{{true, STREAM_END_CLOSED}}, 0},
+		// graceful close of both directions
+		{[]testSegment{
+			{true, 0, testFIN, "req"},
+			{false, 0, testFIN, "resp"},
+		}, []testEnd{{true, STREAM_END_CLOSED}, {false, STREAM_END_CLOSED}}, 1},
+		// reset after a half-close aborts only the open direction
+		{[]testSegment{
+			{true, 0, testFIN, "req"},
+			{false, 0, testRST, ""},
+		}, []testEnd{{true, STREAM_END_CLOSED}, {false, STREAM_END_RESET}}, 1},
+		// reset aborts both directions
+		{[]testSegment{
+			{true, 0, 0, "req"},
+			{true, 3, testRST, ""},
+		}, []testEnd{{true, STREAM_END_RESET}, {false, STREAM_END_RESET}}, 1},
+	}
+
+	for i, c := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+
+		testReplay(tcpStack, 1000, 5000, c.segments)
+
+		if len(l.ends) != len(c.ends) {
+			t.Errorf("TestTCPStackEndOfStream[%d] mismatch, got: %v, want %v", i, l.ends, c.ends)
+			continue
+		}
+		for j := range c.ends {
+			if l.ends[j] != c.ends[j] {
+				t.Errorf("TestTCPStackEndOfStream[%d] end[%d] mismatch, got: %v, want %v", i, j, l.ends[j], c.ends[j])
+			}
+		}
+
+		if l.closedConnections != c.closed {
+			t.Errorf("TestTCPStackEndOfStream[%d] closed mismatch, got: %d, want %d", i, l.closedConnections, c.closed)
+		}
+	}
+}
+
+func TestTCPStackTimestamps(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	ts := time.Unix(1440000000, 0)
+	at := func(ms int) time.Time {
+		return ts.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tcpStack.NewPacket(testTCPPacket(at(0), testClient, testServer, 1000, 0, testSYN, nil))
+	tcpStack.NewPacket(testTCPPacket(at(1), testServer, testClient, 5000, 1001, testSYN|testACK, nil))
+	tcpStack.NewPacket(testTCPPacket(at(2), testClient, testServer, 1001, 5001, testACK, nil))
+
+	// second segment arrives first and waits for the first one
+	tcpStack.NewPacket(testTCPPacket(at(10), testClient, testServer, 1005, 5001, testACK, []byte("efgh")))
+	tcpStack.NewPacket(testTCPPacket(at(20), testClient, testServer, 1001, 5001, testACK, []byte("abcd")))
+	tcpStack.NewPacket(testTCPPacket(at(30), testServer, testClient, 5001, 1009, testACK|testRST, nil))
+
+	want := []TCPTimestamps{
+		{at(20), at(20)},
+		{at(10), at(20)},
+	}
+
+	if len(l.timestamps) != len(want) {
+		t.Fatalf("TestTCPStackTimestamps mismatch, got: %v, want %v", l.timestamps, want)
+	}
+	for i := range want {
+		if !l.timestamps[i].First.Equal(want[i].First) || !l.timestamps[i].Last.Equal(want[i].Last) {
+			t.Errorf("TestTCPStackTimestamps[%d] mismatch, got: %v, want %v", i, l.timestamps[i], want[i])
+		}
+	}
+
+	if !l.closedAt.Equal(at(30)) {
+		t.Errorf("TestTCPStackTimestamps close time mismatch, got: %v, want %v", l.closedAt, at(30))
+	}
+}
+
+func TestTCPStackHandshakeVariants(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	c, s := uint32(1000), uint32(5000)
+
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	n := uint32(len(request))
+
+	cases := []struct {
+		name    string
+		packets []*Packet
+	}{
+		{"fast open", []*Packet{
+			testTCPPacket(ts, testClient, testServer, c, 0, testSYN, request[:4]),
+			testTCPPacket(ts, testServer, testClient, s, c+5, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, c+5, s+1, testACK, request[4:]),
+			testTCPPacket(ts, testServer, testClient, s+1, c+n+1, testACK, []byte("resp")),
+			testTCPPacket(ts, testClient, testServer, c+n+1, s+5, testACK|testFIN, nil),
+			testTCPPacket(ts, testServer, testClient, s+5, c+n+2, testACK|testFIN, nil),
+		}},
+		{"capture started after the SYN", []*Packet{
+			testTCPPacket(ts, testServer, testClient, s, c+1, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, c+1, s+1, testACK, request),
+			testTCPPacket(ts, testServer, testClient, s+1, c+n+1, testACK, []byte("resp")),
+			testTCPPacket(ts, testClient, testServer, c+n+1, s+5, testACK|testFIN, nil),
+			testTCPPacket(ts, testServer, testClient, s+5, c+n+2, testACK|testFIN, nil),
+		}},
+		{"simultaneous open", []*Packet{
+			testTCPPacket(ts, testClient, testServer, c, 0, testSYN, nil),
+			testTCPPacket(ts, testServer, testClient, s, 0, testSYN, nil),
+			testTCPPacket(ts, testClient, testServer, c, s+1, testSYN|testACK, nil),
+			testTCPPacket(ts, testServer, testClient, s, c+1, testSYN|testACK, nil),
+			testTCPPacket(ts, testClient, testServer, c+1, s+1, testACK, request),
+			testTCPPacket(ts, testServer, testClient, s+1, c+n+1, testACK, []byte("resp")),
+			testTCPPacket(ts, testClient, testServer, c+n+1, s+5, testACK|testFIN, nil),
+			testTCPPacket(ts, testServer, testClient, s+5, c+n+2, testACK|testFIN, nil),
+		}},
+	}
+
+	for _, tc := range cases {
+		l := &testTCPListener{}
+		tcpStack := NewTCPStack(l)
+		tcpStack.GapBufferThreshold = 1
+
+		for _, packet := range tc.packets {
+			tcpStack.NewPacket(packet)
+		}
+
+		if l.newConnections != 1 || l.closedConnections != 1 || l.conn.MidStream {
+			t.Errorf("TestTCPStackHandshakeVariants[%s] mismatch, got: %d opened, %d closed, mid-stream %t, want one connection",
+				tc.name, l.newConnections, l.closedConnections, l.conn.MidStream)
+		}
+		if l.conn.ClientPort != testClient.Port || l.conn.ServerPort != testServer.Port {
+			t.Errorf("TestTCPStackHandshakeVariants[%s] direction mismatch, got client port %d, server port %d",
+				tc.name, l.conn.ClientPort, l.conn.ServerPort)
+		}
+		if got := l.clientData.String(); got != string(request) {
+			t.Errorf("TestTCPStackHandshakeVariants[%s] client data mismatch, got: %q, want %q", tc.name, got, request)
+		}
+		if got := l.serverData.String(); got != "resp" {
+			t.Errorf("TestTCPStackHandshakeVariants[%s] server data mismatch, got: %q, want %q", tc.name, got, "resp")
+		}
+		if len(l.gaps) != 0 || tcpStack.Stats != (ReassemblyStats{}) {
+			t.Errorf("TestTCPStackHandshakeVariants[%s] mismatch, got: gaps %v, stats %+v", tc.name, l.gaps, tcpStack.Stats)
+		}
+	}
+}
+
+func TestTCPStackClose(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+
+	//
+	// client half-closed, server data waits behind a gap
+	//
+	testReplay(tcpStack, 1000, 5000, []testSegment{
+		{true, 0, testFIN, "req"},
+		{false, 0, 0, "head"},
+		{false, 10, 0, "tail"},
+	})
+
+	if l.serverData.String() != "head" || l.closedConnections != 0 {
+		t.Fatalf("TestTCPStackClose mismatch before close, got: %q, %d closed", l.serverData.String(), l.closedConnections)
+	}
+
+	tcpStack.Close()
+
+	if got := l.serverData.String(); got != "headtail" {
+		t.Errorf("TestTCPStackClose data mismatch, got: %q, want %q", got, "headtail")
+	}
+	if want := []testGap{{6, false}}; len(l.gaps) != 1 || l.gaps[0] != want[0] {
+		t.Errorf("TestTCPStackClose gaps mismatch, got: %v, want %v", l.gaps, want)
+	}
+
+	want := []testEnd{{true, STREAM_END_CLOSED}, {false, STREAM_END_TRUNCATED}}
+	if len(l.ends) != len(want) || l.ends[0] != want[0] || l.ends[1] != want[1] {
+		t.Errorf("TestTCPStackClose ends mismatch, got: %v, want %v", l.ends, want)
+	}
+
+	if l.closedConnections != 1 || len(tcpStack.connections) != 0 || tcpStack.bufferedBytes != 0 {
+		t.Errorf("TestTCPStackClose mismatch, got: %d closed, %d connections, %d bytes buffered",
+			l.closedConnections, len(tcpStack.connections), tcpStack.bufferedBytes)
+	}
+}
+
+func TestTCPStackCloseOrder(t *testing.T) {
+	l := &testTCPListener{}
+	tcpStack := NewTCPStack(l)
+	tcpStack.Conversations = NewConversationTable()
+
+	ts := time.Unix(1440000000, 0)
+	ports := []uint16{40005, 40001, 40004, 40002, 40003}
+	for i, port := range ports {
+		client := testTCPEndpoint{"10.0.0.1", port}
+		tcpStack.NewPacket(testTCPPacket(ts.Add(time.Duration(i)*time.Millisecond), client, testServer, 1000, 0, testSYN, nil))
+	}
+
+	tcpStack.Close()
+
+	conversations := tcpStack.Conversations.conversations
+	if len(conversations) != len(ports) {
+		t.Fatalf("TestTCPStackCloseOrder mismatch, got: %d closed, want %d", len(conversations), len(ports))
+	}
+	for i, port := range ports {
+		if got := conversations[i].Client.Port(); got != port {
+			t.Errorf("TestTCPStackCloseOrder[%d] mismatch, got: %d, want %d", i, got, port)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+)
+
+// TCPStreamIndexer numbers TCP connections in the order in which they
+// appear in the capture, like tcp.stream of Wireshark, and stores the index
+// in the packets. It must see the packets before they are spread to the TCP
+// stacks, so that the numbering does not depend on sharding.
+type TCPStreamIndexer struct {
+	// streams are forgotten after IdleTimeout without packets, zero keeps
+	// them forever
+	IdleTimeout time.Duration
+
+	// streams by both of their flows
+	streams   map[FlowAddress]*tcpStream
+	next      uint64
+	lastSweep time.Time
+}
+
+type tcpStream struct {
+	index uint64
+	// flow of the SYN which opened the stream
+	client   FlowAddress
+	isn      uint32
+	synSeen  bool
+	lastSeen time.Time
+
+	// SYN of the other end in a simultaneous open
+	peerISN     uint32
+	peerSYNSeen bool
+}
+
+// belongs checks whether a SYN is a retransmission of one of the SYNs of
+// the stream, or the SYN of the other end in a simultaneous open.
+func (s *tcpStream) belongs(flowAddress FlowAddress, seq uint32) bool {
+	switch {
+	case !s.synSeen:
+		return false
+	case flowAddress == s.client:
+		return s.isn == seq
+	default:
+		return !s.peerSYNSeen || s.peerISN == seq
+	}
+}
+
+func NewTCPStreamIndexer() *TCPStreamIndexer {
+	return &TCPStreamIndexer{
+		IdleTimeout: DEFAULT_IDLE_TIMEOUT,
+		streams:     make(map[FlowAddress]*tcpStream),
+	}
+}
+
+func (ix *TCPStreamIndexer) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_TCP {
+		return
+	}
+
+	tcpHeader := packet.TCP.Header
+	timestamp := packet.Timestamp()
+	flowAddress := FlowAddress{
+		SourceAddress:      packet.SourceAddress(),
+		SourcePort:         tcpHeader.SourcePort(),
+		DestinationAddress: packet.DestinationAddress(),
+		DestinationPort:    tcpHeader.DestinationPort(),
+	}
+
+	ix.sweep(timestamp)
+
+	stream, ok := ix.streams[flowAddress]
+
+	//
+	// a SYN opens a new stream unless it belongs to the current one
+	//
+	isSYN := tcpHeader.FlagSYN() && !tcpHeader.FlagACK()
+	if !ok || (isSYN && !stream.belongs(flowAddress, tcpHeader.SequenceNumber())) {
+		if ok {
+			delete(ix.streams, flowAddress.Reverse())
+		}
+
+		stream = &tcpStream{index: ix.next}
+		if isSYN {
+			stream.synSeen = true
+			stream.client = flowAddress
+			stream.isn = tcpHeader.SequenceNumber()
+		}
+		ix.next += 1
+
+		ix.streams[flowAddress] = stream
+		ix.streams[flowAddress.Reverse()] = stream
+	}
+
+	if isSYN && flowAddress != stream.client {
+		stream.peerSYNSeen = true
+		stream.peerISN = tcpHeader.SequenceNumber()
+	}
+
+	stream.lastSeen = timestamp
+	packet.TCPStream = stream.index
+}
+
+func (ix *TCPStreamIndexer) sweep(now time.Time) {
+	if ix.IdleTimeout <= 0 || now.Sub(ix.lastSweep) < IDLE_SWEEP_INTERVAL {
+		return
+	}
+	ix.lastSweep = now
+
+	for flowAddress, stream := range ix.streams {
+		if now.Sub(stream.lastSeen) >= ix.IdleTimeout {
+			delete(ix.streams, flowAddress)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPStreamIndexer(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	other := testTCPEndpoint{"10.0.0.3", 40001}
+
+	cases := []struct {
+		packet *Packet
+		want   uint64
+	}{
+		{testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil), 0},
+		// retransmitted SYN
+		{testTCPPacket(ts, testClient, testServer, 1000, 0, testSYN, nil), 0},
+		{testTCPPacket(ts, testServer, testClient, 5000, 1001, testSYN|testACK, nil), 0},
+		// mid-stream connection
+		{testTCPPacket(ts, other, testServer, 1, 1, testACK, []byte("x")), 1},
+		{testTCPPacket(ts, testClient, testServer, 1001, 5001, testACK, []byte("GET")), 0},
+		{testTCPPacket(ts, testServer, other, 1, 2, testACK, nil), 1},
+		// ports reused with a new ISN
+		{testTCPPacket(ts.Add(time.Second), testClient, testServer, 9000, 0, testSYN, nil), 2},
+		{testTCPPacket(ts.Add(time.Second), testServer, testClient, 7000, 9001, testSYN|testACK, nil), 2},
+		// simultaneous open, the SYNs of both ends and their repetitions
+		{testTCPPacket(ts.Add(2*time.Second), other, testServer, 3000, 0, testSYN, nil), 3},
+		{testTCPPacket(ts.Add(2*time.Second), testServer, other, 8000, 0, testSYN, nil), 3},
+		{testTCPPacket(ts.Add(2*time.Second), other, testServer, 3000, 8001, testSYN|testACK, nil), 3},
+		{testTCPPacket(ts.Add(2*time.Second), testServer, other, 8000, 0, testSYN, nil), 3},
+		// idle stream forgotten
+		{testTCPPacket(ts.Add(10*time.Minute), testServer, other, 1, 2, testACK, nil), 4},
+	}
+
+	ix := NewTCPStreamIndexer()
+
+	for i, c := range cases {
+		ix.NewPacket(c.packet)
+
+		if c.packet.TCPStream != c.want {
+			t.Errorf("TestTCPStreamIndexer[%d] mismatch, got: %d, want %d", i, c.packet.TCPStream, c.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_UDP_IDLE_TIMEOUT = 60 * time.Second
+)
+
+type UDPFlowStats struct {
+	Datagrams uint64
+	Bytes     uint64
+}
+
+// UDPFlow groups the datagrams exchanged between two endpoints. The client
+// is the sender of the first datagram, unless it was sent from a well-known
+// port to one which is not.
+type UDPFlow struct {
+	// client to server
+	Address FlowAddress
+
+	// capture metadata of the first datagram
+	InterfaceName string
+	Direction     PacketDirection
+
+	Start    time.Time
+	lastSeen time.Time
+	// order of the flows with the same start time
+	index uint64
+
+	Client UDPFlowStats
+	Server UDPFlowStats
+
+	// application protocol detected from the first payload, empty when unknown
+	Protocol string
+}
+
+func (flow *UDPFlow) ListenerConnection() UDPListenerConnection {
+	return UDPListenerConnection{
+		ClientAddress: flow.Address.SourceAddress,
+		ClientPort:    flow.Address.SourcePort,
+		ServerAddress: flow.Address.DestinationAddress,
+		ServerPort:    flow.Address.DestinationPort,
+		InterfaceName: flow.InterfaceName,
+		Direction:     flow.Direction,
+	}
+}
+
+type UDPListenerConnection struct {
+	ClientAddress netip.Addr
+	ClientPort    uint16
+
+	ServerAddress netip.Addr
+	ServerPort    uint16
+
+	// capture interface and direction of the first datagram
+	InterfaceName string
+	Direction     PacketDirection
+}
+
+type UDPListener interface {
+	NewFlow(conn UDPListenerConnection, timestamp time.Time)
+	Datagram(conn UDPListenerConnection, payload []byte, clientData bool, timestamp time.Time)
+	ClosedFlow(conn UDPListenerConnection, timestamp time.Time)
+}
+
+type UDPStackStats struct {
+	Flows     uint64
+	Datagrams uint64
+	// flows closed after the idle timeout
+	Expired uint64
+}
+
+// UDPStack tracks UDP flows like TCPStack tracks connections. UDP has no
+// close, flows end after IdleTimeout without datagrams (in packet time) or
+// when the stack is closed.
+type UDPStack struct {
+	flows       map[FlowAddress]*UDPFlow
+	udpListener UDPListener
+
+	// zero keeps flows until Close
+	IdleTimeout time.Duration
+	lastSweep   time.Time
+
+	Stats UDPStackStats
+
+	// closed flows are added to Conversations when set
+	Conversations *ConversationTable
+}
+
+func NewUDPStack(udpListener UDPListener) *UDPStack {
+	return &UDPStack{
+		flows:       make(map[FlowAddress]*UDPFlow),
+		udpListener: udpListener,
+		IdleTimeout: DEFAULT_UDP_IDLE_TIMEOUT,
+	}
+}
+
+func (udpStack *UDPStack) NewPacket(packet *Packet) {
+	if packet.TransportType != TRANSPORT_TYPE_UDP {
+		return
+	}
+
+	udpFrame := packet.UDP
+	timestamp := packet.Timestamp()
+	flowAddress := FlowAddress{
+		SourceAddress:      packet.SourceAddress(),
+		SourcePort:         udpFrame.Header.SourcePort(),
+		DestinationAddress: packet.DestinationAddress(),
+		DestinationPort:    udpFrame.Header.DestinationPort(),
+	}
+
+	udpStack.expireIdle(timestamp)
+
+	flow, ok := udpStack.flows[flowAddress]
+	if !ok {
+		flow = udpStack.newFlow(flowAddress, packet)
+	}
+
+	isClient := flow.Address == flowAddress
+	stats := &flow.Server
+	if isClient {
+		stats = &flow.Client
+	}
+
+	stats.Datagrams += 1
+	stats.Bytes += uint64(len(udpFrame.Payload))
+	flow.lastSeen = timestamp
+	udpStack.Stats.Datagrams += 1
+
+	if flow.Protocol == "" && len(udpFrame.Payload) > 0 {
+		flow.Protocol = DetectUDPProtocol(flow.Address.DestinationPort, udpFrame.Payload)
+	}
+
+	udpStack.udpListener.Datagram(flow.ListenerConnection(), udpFrame.Payload, isClient, timestamp)
+}
+
+func (udpStack *UDPStack) newFlow(flowAddress FlowAddress, packet *Packet) *UDPFlow {
+	clientFlowAddress := flowAddress
+
+	//
+	// first datagram seen is a reply from a server
+	//
+	if isWellKnownServerPort(flowAddress.SourcePort) && !isWellKnownServerPort(flowAddress.DestinationPort) {
+		clientFlowAddress = flowAddress.Reverse()
+	}
+
+	flow := &UDPFlow{
+		Address:       clientFlowAddress,
+		InterfaceName: packet.Capture.InterfaceName,
+		Direction:     packet.Capture.Direction,
+		Start:         packet.Timestamp(),
+		index:         udpStack.Stats.Flows,
+	}
+
+	udpStack.flows[flowAddress] = flow
+	udpStack.flows[flowAddress.Reverse()] = flow
+	udpStack.Stats.Flows += 1
+
+	udpstackdebug(fmt.Sprintf("udp-debug: new flow %s:%d -> %s:%d",
+		AddressToString(clientFlowAddress.SourceAddress), clientFlowAddress.SourcePort,
+		AddressToString(clientFlowAddress.DestinationAddress), clientFlowAddress.DestinationPort))
+
+	udpStack.udpListener.NewFlow(flow.ListenerConnection(), flow.Start)
+
+	return flow
+}
+
+func (udpStack *UDPStack) closeFlow(flow *UDPFlow, reason CloseReason) {
+	delete(udpStack.flows, flow.Address)
+	delete(udpStack.flows, flow.Address.Reverse())
+
+	udpStack.udpListener.ClosedFlow(flow.ListenerConnection(), flow.lastSeen)
+
+	if udpStack.Conversations != nil {
+		udpStack.Conversations.Add(udpConversation(flow, reason))
+	}
+}
+
+// expireIdle closes flows without datagrams within the idle timeout.
+func (udpStack *UDPStack) expireIdle(now time.Time) {
+	if udpStack.IdleTimeout <= 0 || now.Sub(udpStack.lastSweep) < IDLE_SWEEP_INTERVAL {
+		return
+	}
+	udpStack.lastSweep = now
+
+	for flowAddress, flow := range udpStack.flows {
+		if flowAddress == flow.Address && now.Sub(flow.lastSeen) >= udpStack.IdleTimeout {
+			udpStack.Stats.Expired += 1
+			udpStack.closeFlow(flow, CLOSE_REASON_TIMEOUT)
+		}
+	}
+}
+
+// Close closes the flows still open in the order they started, called at
+// the end of a capture.
+func (udpStack *UDPStack) Close() {
+	var flows []*UDPFlow
+	for flowAddress, flow := range udpStack.flows {
+		if flowAddress == flow.Address {
+			flows = append(flows, flow)
+		}
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		if !flows[i].Start.Equal(flows[j].Start) {
+			return flows[i].Start.Before(flows[j].Start)
+		}
+		return flows[i].index < flows[j].index
+	})
+
+	for _, flow := range flows {
+		udpStack.closeFlow(flow, CLOSE_REASON_OPEN)
+	}
+}
+
+func udpstackdebug(a ...interface{}) {
+	if true {
+		debug("debug-udpstack:", a...)
+	}
+}
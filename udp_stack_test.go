@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUDPListener records the callbacks of a UDPListener.
+type testUDPListener struct {
+	events []string
+}
+
+func (l *testUDPListener) NewFlow(conn UDPListenerConnection, timestamp time.Time) {
+	l.events = append(l.events, fmt.Sprintf("new %s:%d->%s:%d",
+		AddressToString(conn.ClientAddress), conn.ClientPort, AddressToString(conn.ServerAddress), conn.ServerPort))
+}
+
+func (l *testUDPListener) Datagram(conn UDPListenerConnection, payload []byte, isClient bool, timestamp time.Time) {
+	l.events = append(l.events, fmt.Sprintf("data %t %d", isClient, len(payload)))
+}
+
+func (l *testUDPListener) ClosedFlow(conn UDPListenerConnection, timestamp time.Time) {
+	l.events = append(l.events, fmt.Sprintf("closed %d", conn.ServerPort))
+}
+
+func TestUDPStack(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	client := testTCPEndpoint{"10.0.0.1", 50000}
+	server := testTCPEndpoint{"10.0.0.53", 53}
+	ntp := testTCPEndpoint{"10.0.0.123", 123}
+
+	l := &testUDPListener{}
+	udpStack := NewUDPStack(l)
+	udpStack.IdleTimeout = 10 * time.Second
+
+	//
+	// both directions in one flow, the first datagram of the second flow is
+	// a reply from a server
+	//
+	udpStack.NewPacket(testUDPPacket(ts, client, server, make([]byte, 30)))
+	udpStack.NewPacket(testUDPPacket(ts.Add(time.Second), server, client, make([]byte, 100)))
+	udpStack.NewPacket(testUDPPacket(ts.Add(2*time.Second), ntp, client, make([]byte, 48)))
+
+	//
+	// the dns flow expires, the ntp flow is still open
+	//
+	udpStack.NewPacket(testUDPPacket(ts.Add(11*time.Second), client, ntp, make([]byte, 48)))
+	udpStack.Close()
+
+	want := []string{
+		"new 10.0.0.1:50000->10.0.0.53:53",
+		"data true 30",
+		"data false 100",
+		"new 10.0.0.1:50000->10.0.0.123:123",
+		"data false 48",
+		"closed 53",
+		"data true 48",
+		"closed 123",
+	}
+
+	if strings.Join(l.events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("TestUDPStack mismatch, got: %q, want %q", l.events, want)
+	}
+
+	if want := (UDPStackStats{Flows: 2, Datagrams: 4, Expired: 1}); udpStack.Stats != want {
+		t.Errorf("TestUDPStack stats mismatch, got: %+v, want %+v", udpStack.Stats, want)
+	}
+	if len(udpStack.flows) != 0 {
+		t.Errorf("TestUDPStack flows not released, got: %d", len(udpStack.flows))
+	}
+}
+
+func TestUDPStackCloseOrder(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	client := testTCPEndpoint{"10.0.0.1", 50000}
+
+	l := &testUDPListener{}
+	udpStack := NewUDPStack(l)
+
+	var want []string
+	for _, port := range []uint16{5005, 5001, 5004, 5002, 5003} {
+		udpStack.NewPacket(testUDPPacket(ts, client, testTCPEndpoint{"10.0.0.2", port}, make([]byte, 12)))
+		want = append(want, fmt.Sprintf("closed %d", port))
+	}
+	l.events = nil
+
+	// flows started at the same time close in the order they were seen
+	udpStack.Close()
+
+	if strings.Join(l.events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("TestUDPStackCloseOrder mismatch, got: %q, want %q", l.events, want)
+	}
+}
+
+func TestUDPDispatcher(t *testing.T) {
+	ts := time.Unix(1440000000, 0)
+	client := testTCPEndpoint{"10.0.0.1", 50000}
+
+	byPort := &testUDPListener{}
+	byProtocol := &testUDPListener{}
+	other := &testUDPListener{}
+
+	d := NewUDPDispatcher()
+	d.HandlePort(5353, byPort)
+	d.HandleProtocol("dns", byProtocol)
+	d.Default = other
+
+	udpStack := NewUDPStack(d)
+	udpStack.NewPacket(testUDPPacket(ts, client, testTCPEndpoint{"10.0.0.2", 5353}, make([]byte, 12)))
+	udpStack.NewPacket(testUDPPacket(ts, client, testTCPEndpoint{"10.0.0.3", 53}, make([]byte, 12)))
+	udpStack.NewPacket(testUDPPacket(ts, client, testTCPEndpoint{"10.0.0.4", 9999}, make([]byte, 5)))
+	udpStack.Close()
+
+	cases := []struct {
+		l      *testUDPListener
+		server string
+		port   uint16
+		length int
+	}{
+		{byPort, "10.0.0.2", 5353, 12},
+		{byProtocol, "10.0.0.3", 53, 12},
+		{other, "10.0.0.4", 9999, 5},
+	}
+
+	for i, c := range cases {
+		want := []string{
+			fmt.Sprintf("new 10.0.0.1:50000->%s:%d", c.server, c.port),
+			fmt.Sprintf("data true %d", c.length),
+			fmt.Sprintf("closed %d", c.port),
+		}
+		if strings.Join(c.l.events, "\n") != strings.Join(want, "\n") {
+			t.Errorf("TestUDPDispatcher[%d] mismatch, got: %q, want %q", i, c.l.events, want)
+		}
+	}
+
+	if len(d.flows) != 0 {
+		t.Errorf("TestUDPDispatcher flows not released, got: %d", len(d.flows))
+	}
+}